@@ -0,0 +1,58 @@
+package carrier
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/cyzhang39/go_market/models"
+)
+
+// SignatureHeader carries the signature of a webhook call. Calls are signed
+// the same way as payment webhooks, see payment.Sign.
+const SignatureHeader = "Carrier-Signature"
+
+var (
+	ErrNoCarrier        = errors.New("no tracker for that carrier")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// Update is a verified webhook call with new events of the parcel Tracking.
+type Update struct {
+	Tracking string                 `json:"tracking"`
+	Events   []models.TrackingEvent `json:"events"`
+}
+
+// CarrierTracker follows parcels of one carrier. Track returns the whole
+// timeline of a parcel so far, for polling. Carriers that push their
+// events call our webhook, which VerifyWebhook checks and reads.
+type CarrierTracker interface {
+	Name() string
+	Track(ctx context.Context, tracking string) ([]models.TrackingEvent, error)
+	VerifyWebhook(payload []byte, signature string) (Update, error)
+}
+
+var (
+	mu       sync.RWMutex
+	trackers = map[string]CarrierTracker{}
+)
+
+// Register makes a tracker available by its name. Names are matched without
+// regard to case, so shipments entered as "UPS" are tracked by "ups".
+func Register(t CarrierTracker) {
+	mu.Lock()
+	defer mu.Unlock()
+	trackers[strings.ToLower(t.Name())] = t
+}
+
+// Get returns the tracker of a carrier.
+func Get(name string) (CarrierTracker, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	t, ok := trackers[strings.ToLower(name)]
+	if !ok {
+		return nil, ErrNoCarrier
+	}
+	return t, nil
+}
@@ -0,0 +1,64 @@
+package carrier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"github.com/cyzhang39/go_market/payment"
+)
+
+// fakeSteps are the scans a fake parcel goes through, one per Track.
+var fakeSteps = []models.TrackingEvent{
+	{Status: models.TrackInTransit, Description: "Picked up", Location: "Origin depot"},
+	{Status: models.TrackInTransit, Description: "Arrived at sorting hub", Location: "Sorting hub"},
+	{Status: models.TrackOutForDelivery, Description: "Out for delivery", Location: "Local depot"},
+	{Status: models.TrackDelivered, Description: "Delivered", Location: "Front door"},
+}
+
+// Fake is a CarrierTracker for development and tests. Every parcel is
+// known, and each time it is tracked it moves one scan further until it is
+// delivered. Webhook calls are verified with Secret.
+type Fake struct {
+	Secret []byte
+
+	mu      sync.Mutex
+	parcels map[string][]models.TrackingEvent
+}
+
+func NewFake(secret []byte) *Fake {
+	return &Fake{Secret: secret, parcels: map[string][]models.TrackingEvent{}}
+}
+
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+func (f *Fake) Track(ctx context.Context, tracking string) ([]models.TrackingEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	events := f.parcels[tracking]
+	if n := len(events); n < len(fakeSteps) {
+		ev := fakeSteps[n]
+		ev.ID = fmt.Sprintf("%s-%d", tracking, n+1)
+		ev.At = time.Now()
+		events = append(events, ev)
+		f.parcels[tracking] = events
+	}
+	return append([]models.TrackingEvent{}, events...), nil
+}
+
+func (f *Fake) VerifyWebhook(payload []byte, signature string) (Update, error) {
+	var up Update
+	if err := payment.Verify(f.Secret, payload, signature, time.Now()); err != nil {
+		return up, ErrInvalidSignature
+	}
+	if err := json.Unmarshal(payload, &up); err != nil {
+		return up, err
+	}
+	return up, nil
+}
@@ -0,0 +1,282 @@
+package currency
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"github.com/gin-gonic/gin"
+)
+
+const Header = "Accept-Currency"
+
+const (
+	HalfUp   = "half_up"
+	HalfEven = "half_even"
+	Down     = "down"
+	Up       = "up"
+)
+
+var ErrNoRate = errors.New("no exchange rate for currency")
+
+// Rule is how converted amounts are rounded. Increment is in minor units, so
+// 5 rounds CHF to the nearest 0.05.
+type Rule struct {
+	Increment int64  `json:"increment"`
+	Mode      string `json:"mode"`
+}
+
+// Table holds how many units of each currency one unit of Base buys. Rates
+// are decimal strings so they are never read through a float.
+type Table struct {
+	Base      string            `json:"base"`
+	Rates     map[string]string `json:"rates"`
+	Rounding  map[string]Rule   `json:"rounding"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+
+	rats map[string]*big.Rat
+}
+
+var defaultRounding = map[string]Rule{
+	"CHF": {Increment: 5, Mode: HalfUp},
+}
+
+var (
+	mu      sync.RWMutex
+	path    string
+	current = &Table{Base: models.DefaultCurrency, Rates: map[string]string{}, rats: map[string]*big.Rat{models.DefaultCurrency: big.NewRat(1, 1)}}
+)
+
+// Load reads the rate table from a JSON file and makes it current. The path
+// is remembered for Reload.
+func Load(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var t Table
+	if err := json.Unmarshal(b, &t); err != nil {
+		return err
+	}
+	if err := t.prepare(); err != nil {
+		return err
+	}
+	if t.UpdatedAt.IsZero() {
+		t.UpdatedAt = time.Now()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	path = file
+	current = &t
+	return nil
+}
+
+func Reload() error {
+	mu.RLock()
+	file := path
+	mu.RUnlock()
+	if file == "" {
+		return errors.New("no rates file loaded")
+	}
+	return Load(file)
+}
+
+func (t *Table) prepare() error {
+	t.Base = strings.ToUpper(t.Base)
+	if t.Base == "" {
+		t.Base = models.DefaultCurrency
+	}
+	if !models.KnownCurrency(t.Base) {
+		return models.ErrUnknownCurrency
+	}
+	t.rats = map[string]*big.Rat{t.Base: big.NewRat(1, 1)}
+	for code, rate := range t.Rates {
+		code = strings.ToUpper(code)
+		if !models.KnownCurrency(code) {
+			return models.ErrUnknownCurrency
+		}
+		r, ok := new(big.Rat).SetString(rate)
+		if !ok || r.Sign() <= 0 {
+			return errors.New("invalid rate for " + code)
+		}
+		t.rats[code] = r
+	}
+	rounding := map[string]Rule{}
+	for code, rule := range t.Rounding {
+		rounding[strings.ToUpper(code)] = rule
+	}
+	t.Rounding = rounding
+	for code, rule := range defaultRounding {
+		if _, ok := t.Rounding[code]; !ok {
+			t.Rounding[code] = rule
+		}
+	}
+	return nil
+}
+
+func Current() Table {
+	mu.RLock()
+	defer mu.RUnlock()
+	return *current
+}
+
+func Base() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current.Base
+}
+
+// Supported normalizes a currency code and reports "" if there is no rate
+// for it.
+func Supported(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	mu.RLock()
+	defer mu.RUnlock()
+	if _, ok := current.rats[code]; !ok {
+		return ""
+	}
+	return code
+}
+
+const preferenceKey = "currencyPreference"
+
+// Prefer registers how to look up the user's saved currency. It is only
+// called by Display, so requests that show no price never load it.
+func Prefer(c *gin.Context, lookup func() string) {
+	c.Set(preferenceKey, lookup)
+}
+
+// Display is the currency prices should be shown in for this request: the
+// Accept-Currency header, else the preference registered with Prefer, else
+// the base currency. The answer is kept for the rest of the request.
+func Display(c *gin.Context) string {
+	if code := c.GetString("currency"); code != "" {
+		return code
+	}
+	code := Supported(c.GetHeader(Header))
+	if code == "" {
+		if v, ok := c.Get(preferenceKey); ok {
+			code = Supported(v.(func() string)())
+		}
+	}
+	if code == "" {
+		code = Base()
+	}
+	c.Set("currency", code)
+	return code
+}
+
+func Convert(m models.Money, to string) (models.Money, error) {
+	if m.Currency == to {
+		return m, nil
+	}
+	mu.RLock()
+	from, okFrom := current.rats[m.Currency]
+	rate, okTo := current.rats[to]
+	rule := current.Rounding[to]
+	mu.RUnlock()
+	if !okFrom || !okTo {
+		return models.Money{}, ErrNoRate
+	}
+
+	v := new(big.Rat).SetFrac64(m.Amount, pow10(models.Exponent(m.Currency)))
+	v.Quo(v, from)
+	v.Mul(v, rate)
+	v.Mul(v, new(big.Rat).SetInt64(pow10(models.Exponent(to))))
+	return models.Money{Amount: Round(v, rule), Currency: to}, nil
+}
+
+// ConvertPtr is Convert for optional prices, returning nil when there is
+// nothing to show.
+func ConvertPtr(m *models.Money, to string) *models.Money {
+	if m == nil {
+		return nil
+	}
+	v, err := Convert(*m, to)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// Round rounds a value in minor units to the rule's increment.
+func Round(v *big.Rat, rule Rule) int64 {
+	inc := rule.Increment
+	if inc <= 0 {
+		inc = 1
+	}
+	q := new(big.Rat).Quo(v, new(big.Rat).SetInt64(inc))
+
+	num, den := q.Num(), q.Denom()
+	whole, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() != 0 {
+		neg := q.Sign() < 0
+		twice := new(big.Int).Abs(rem)
+		twice.Lsh(twice, 1)
+		cmp := twice.Cmp(den)
+
+		away := false
+		switch rule.Mode {
+		case Down:
+			away = false
+		case Up:
+			away = true
+		case HalfEven:
+			away = cmp > 0 || (cmp == 0 && whole.Bit(0) == 1)
+		default:
+			away = cmp >= 0
+		}
+		if away {
+			if neg {
+				whole.Sub(whole, big.NewInt(1))
+			} else {
+				whole.Add(whole, big.NewInt(1))
+			}
+		}
+	}
+	return whole.Int64() * inc
+}
+
+// Total adds up a cart, price times quantity per line, in the given currency. With to empty the cart's own
+// currency is used, or the base currency if the lines are mixed.
+func Total(cart []models.UserProd, to string) (models.Money, error) {
+	if to == "" {
+		to = Base()
+		if len(cart) > 0 {
+			to = cart[0].Price.Currency
+			for _, item := range cart {
+				if item.Price.Currency != to {
+					to = Base()
+					break
+				}
+			}
+		}
+	}
+
+	total := models.Money{Currency: to}
+	for _, item := range cart {
+		v, err := Convert(item.LineTotal(), to)
+		if err != nil {
+			return models.Money{}, err
+		}
+		total, err = total.Add(v)
+		if err != nil {
+			return models.Money{}, err
+		}
+	}
+	return total, nil
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
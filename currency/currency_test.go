@@ -0,0 +1,98 @@
+package currency
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/cyzhang39/go_market/models"
+)
+
+// useTable makes t the current rate table for the rest of the test.
+func useTable(tb testing.TB, t Table) {
+	tb.Helper()
+	if err := t.prepare(); err != nil {
+		tb.Fatal(err)
+	}
+	mu.Lock()
+	old := current
+	current = &t
+	mu.Unlock()
+	tb.Cleanup(func() {
+		mu.Lock()
+		current = old
+		mu.Unlock()
+	})
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		num, den int64
+		rule     Rule
+		want     int64
+	}{
+		{25, 10, Rule{Mode: HalfUp}, 3},
+		{24, 10, Rule{Mode: HalfUp}, 2},
+		{-25, 10, Rule{Mode: HalfUp}, -3},
+		{25, 10, Rule{Mode: HalfEven}, 2},
+		{35, 10, Rule{Mode: HalfEven}, 4},
+		{26, 10, Rule{Mode: HalfEven}, 3},
+		{29, 10, Rule{Mode: Down}, 2},
+		{-29, 10, Rule{Mode: Down}, -2},
+		{21, 10, Rule{Mode: Up}, 3},
+		{-21, 10, Rule{Mode: Up}, -3},
+		{7, 1, Rule{Mode: Up}, 7},
+		{25, 10, Rule{}, 3},
+		{1234, 1, Rule{Increment: 5, Mode: HalfUp}, 1235},
+		{1232, 1, Rule{Increment: 5, Mode: HalfUp}, 1230},
+		{1234, 1, Rule{Increment: 5, Mode: Down}, 1230},
+		{1231, 1, Rule{Increment: 5, Mode: Up}, 1235},
+		{1234, 1, Rule{Increment: 0, Mode: HalfUp}, 1234},
+	}
+	for _, tt := range tests {
+		got := Round(big.NewRat(tt.num, tt.den), tt.rule)
+		if got != tt.want {
+			t.Errorf("Round(%d/%d, %+v) = %d, want %d", tt.num, tt.den, tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	useTable(t, Table{
+		Base:  "USD",
+		Rates: map[string]string{"EUR": "0.9", "JPY": "150", "CHF": "0.8833"},
+	})
+	tests := []struct {
+		in   models.Money
+		to   string
+		want models.Money
+		err  error
+	}{
+		{models.Money{Amount: 1000, Currency: "USD"}, "USD", models.Money{Amount: 1000, Currency: "USD"}, nil},
+		{models.Money{Amount: 1000, Currency: "USD"}, "EUR", models.Money{Amount: 900, Currency: "EUR"}, nil},
+		{models.Money{Amount: 900, Currency: "EUR"}, "USD", models.Money{Amount: 1000, Currency: "USD"}, nil},
+		{models.Money{Amount: 999, Currency: "USD"}, "JPY", models.Money{Amount: 1499, Currency: "JPY"}, nil},
+		{models.Money{Amount: 1500, Currency: "JPY"}, "EUR", models.Money{Amount: 900, Currency: "EUR"}, nil},
+		// 10.00 USD is 8.833 CHF, to the nearest 0.05
+		{models.Money{Amount: 1000, Currency: "USD"}, "CHF", models.Money{Amount: 885, Currency: "CHF"}, nil},
+		{models.Money{Amount: 1000, Currency: "USD"}, "GBP", models.Money{}, ErrNoRate},
+		{models.Money{Amount: 1000, Currency: "GBP"}, "USD", models.Money{}, ErrNoRate},
+	}
+	for _, tt := range tests {
+		got, err := Convert(tt.in, tt.to)
+		if err != tt.err || got != tt.want {
+			t.Errorf("Convert(%+v, %s) = %+v, %v, want %+v, %v", tt.in, tt.to, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestConvertDefaultTable(t *testing.T) {
+	// before any rates are loaded the base currency still converts to itself
+	in := models.Money{Amount: 1234, Currency: models.DefaultCurrency}
+	got, err := Convert(in, models.DefaultCurrency)
+	if err != nil || got != in {
+		t.Errorf("Convert(%+v) = %+v, %v", in, got, err)
+	}
+	if Supported(models.DefaultCurrency) == "" {
+		t.Errorf("Supported(%s) = \"\"", models.DefaultCurrency)
+	}
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrAddressNotFound = errors.New("address not found")
+	ErrAddressesBusy   = errors.New("addresses kept changing while being edited")
+)
+
+// addressTries is how often an edit is tried again when the addresses
+// changed between reading and storing them.
+const addressTries = 5
+
+// AddressPatch holds the fields of an address to change; nil fields are
+// left as they are. Setting a default moves it from the address that had
+// it, and an address can not give its default up, only have it moved.
+type AddressPatch struct {
+	Label           *string `json:"label" validate:"omitempty,max=50"`
+	Name            *string `json:"name" validate:"omitempty,max=100"`
+	Phone           *string `json:"phone" validate:"omitempty,max=30"`
+	House           *string `json:"house"`
+	Street          *string `json:"street"`
+	City            *string `json:"city"`
+	Postal          *string `json:"postal"`
+	Region          *string `json:"region"`
+	DefaultShipping *bool   `json:"defaultShipping"`
+	DefaultBilling  *bool   `json:"defaultBilling"`
+}
+
+// editAddresses reads the user's addresses, lets edit change them and
+// stores the result if they are still as they were read. Addresses changed
+// meanwhile are read and edited again.
+func editAddresses(ctx context.Context, users *mongo.Collection, uid primitive.ObjectID, edit func([]models.Address) ([]models.Address, error)) ([]models.Address, error) {
+	for try := 0; try < addressTries; try++ {
+		// the stored array as it is, to compare against byte for byte
+		var user struct {
+			AddressInfo bson.RawValue `bson:"addressInfo"`
+		}
+		if err := users.FindOne(ctx, bson.M{"id": uid}).Decode(&user); err != nil {
+			return nil, ErrInvalidUser
+		}
+		var read []models.Address
+		guard := bson.M{"id": uid, "addressInfo": bson.M{"$exists": false}}
+		if user.AddressInfo.Type != 0 {
+			if err := user.AddressInfo.Unmarshal(&read); err != nil {
+				log.Println(err)
+				return nil, err
+			}
+			guard["addressInfo"] = user.AddressInfo
+		}
+		addrs, err := edit(read)
+		if err != nil {
+			return nil, err
+		}
+		res, err := users.UpdateOne(ctx, guard, bson.M{"$set": bson.M{"addressInfo": addrs}})
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		if res.MatchedCount > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, ErrAddressesBusy
+}
+
+// keepDefaults moves the defaults to address i when it asks for them, and
+// hands defaults nobody holds to the first address.
+func keepDefaults(addrs []models.Address, i int) {
+	shipping, billing := false, false
+	for j := range addrs {
+		if i >= 0 && j != i {
+			addrs[j].DefaultShipping = addrs[j].DefaultShipping && !addrs[i].DefaultShipping
+			addrs[j].DefaultBilling = addrs[j].DefaultBilling && !addrs[i].DefaultBilling
+		}
+		shipping = shipping || addrs[j].DefaultShipping
+		billing = billing || addrs[j].DefaultBilling
+	}
+	if len(addrs) > 0 {
+		addrs[0].DefaultShipping = addrs[0].DefaultShipping || !shipping
+		addrs[0].DefaultBilling = addrs[0].DefaultBilling || !billing
+	}
+}
+
+// AddAddress adds an address to the user's. The first address a user adds
+// is their default for both shipping and billing.
+func AddAddress(ctx context.Context, users *mongo.Collection, uid primitive.ObjectID, addr models.Address) (models.Address, error) {
+	addr.ID = primitive.NewObjectID()
+	_, err := editAddresses(ctx, users, uid, func(addrs []models.Address) ([]models.Address, error) {
+		addrs = append(addrs, addr)
+		keepDefaults(addrs, len(addrs)-1)
+		addr = addrs[len(addrs)-1]
+		return addrs, nil
+	})
+	return addr, err
+}
+
+// EditAddress changes the fields of one of the user's addresses that patch
+// sets.
+func EditAddress(ctx context.Context, users *mongo.Collection, uid primitive.ObjectID, aid primitive.ObjectID, patch AddressPatch) (models.Address, error) {
+	var addr models.Address
+	_, err := editAddresses(ctx, users, uid, func(addrs []models.Address) ([]models.Address, error) {
+		for i := range addrs {
+			if addrs[i].ID != aid {
+				continue
+			}
+			a := &addrs[i]
+			if patch.Label != nil {
+				a.Label = *patch.Label
+			}
+			if patch.Name != nil {
+				a.Name = *patch.Name
+			}
+			if patch.Phone != nil {
+				a.Phone = *patch.Phone
+			}
+			if patch.House != nil {
+				a.House = patch.House
+			}
+			if patch.Street != nil {
+				a.Street = patch.Street
+			}
+			if patch.City != nil {
+				a.City = patch.City
+			}
+			if patch.Postal != nil {
+				a.Postal = patch.Postal
+			}
+			if patch.Region != nil {
+				a.Region = patch.Region
+			}
+			if patch.DefaultShipping != nil && *patch.DefaultShipping {
+				a.DefaultShipping = true
+			}
+			if patch.DefaultBilling != nil && *patch.DefaultBilling {
+				a.DefaultBilling = true
+			}
+			keepDefaults(addrs, i)
+			addr = addrs[i]
+			return addrs, nil
+		}
+		return nil, ErrAddressNotFound
+	})
+	return addr, err
+}
+
+// DeleteAddress removes one of the user's addresses. Defaults it held pass
+// to the first address left.
+func DeleteAddress(ctx context.Context, users *mongo.Collection, uid primitive.ObjectID, aid primitive.ObjectID) error {
+	_, err := editAddresses(ctx, users, uid, func(addrs []models.Address) ([]models.Address, error) {
+		for i := range addrs {
+			if addrs[i].ID == aid {
+				addrs = append(addrs[:i], addrs[i+1:]...)
+				keepDefaults(addrs, -1)
+				return addrs, nil
+			}
+		}
+		return nil, ErrAddressNotFound
+	})
+	return err
+}
+
+// BillingAddress finds the user's default billing address, or fallback
+// when they have none.
+func BillingAddress(ctx context.Context, users *mongo.Collection, uid primitive.ObjectID, fallback models.Address) (models.Address, error) {
+	var user models.User
+	if err := users.FindOne(ctx, bson.M{"id": uid}).Decode(&user); err != nil {
+		return models.Address{}, ErrInvalidUser
+	}
+	for _, addr := range user.AddressInfo {
+		if addr.DefaultBilling {
+			return addr, nil
+		}
+	}
+	return fallback, nil
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/cyzhang39/go_market/models"
+)
+
+func TestKeepDefaults(t *testing.T) {
+	// each address as its shipping and billing defaults, "sb", "s", "b" or ""
+	addrs := func(flags ...string) []models.Address {
+		out := make([]models.Address, len(flags))
+		for i, f := range flags {
+			for _, c := range f {
+				switch c {
+				case 's':
+					out[i].DefaultShipping = true
+				case 'b':
+					out[i].DefaultBilling = true
+				}
+			}
+		}
+		return out
+	}
+	flags := func(addrs []models.Address) []string {
+		out := make([]string, len(addrs))
+		for i, a := range addrs {
+			if a.DefaultShipping {
+				out[i] += "s"
+			}
+			if a.DefaultBilling {
+				out[i] += "b"
+			}
+		}
+		return out
+	}
+	tests := []struct {
+		name string
+		in   []models.Address
+		i    int
+		want []string
+	}{
+		{"first address takes both", addrs(""), 0, []string{"sb"}},
+		{"new address without defaults", addrs("sb", ""), 1, []string{"sb", ""}},
+		{"new default shipping moves it", addrs("sb", "s"), 1, []string{"b", "s"}},
+		{"new default billing moves it", addrs("sb", "", "b"), 2, []string{"s", "", "b"}},
+		{"both move", addrs("s", "b", "sb"), 2, []string{"", "", "sb"}},
+		{"asking for defaults already held", addrs("", "sb"), 1, []string{"", "sb"}},
+		{"defaults of a deleted address pass to the first", addrs("", "b"), -1, []string{"s", "b"}},
+		{"nothing held", addrs("", ""), -1, []string{"sb", ""}},
+		{"no addresses", addrs(), -1, []string{}},
+	}
+	for _, tt := range tests {
+		keepDefaults(tt.in, tt.i)
+		got := flags(tt.in)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for j := range got {
+			if got[j] != tt.want[j] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
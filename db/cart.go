@@ -2,6 +2,8 @@ package db
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
 	"time"
 	"errors"
@@ -9,164 +11,676 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
 	ErrInvalidProduct = errors.New("invalid Product")
 	ErrInvalidUser = errors.New("invalid User")
 	ErrInvalidCart = errors.New("unable to process cart action")
+	ErrCartLimit = errors.New("quantity over the per order limit")
+	ErrInvalidGuestCart = errors.New("guest cart not found or expired")
+	ErrNothingToReorder = errors.New("none of the order's products are sold any more")
 )
 
-func CartAdd(ctx context.Context, products *mongo.Collection, users *mongo.Collection, pid primitive.ObjectID, uid string) error {
-	search, err := products.Find(ctx, bson.M{"id": pid})
+// MaxLineQuantity caps every cart line, also for products without their own
+// MaxPerOrder.
+const MaxLineQuantity = 99
+
+// GuestCartTTL is how long a guest cart lives after its last change.
+const GuestCartTTL = 30 * 24 * time.Hour
+
+func snapshot(p models.Product) models.UserProd {
+	line := models.UserProd{ID: p.ID, Name: p.Name, Img: p.Img, Quantity: 1, TaxClass: p.TaxClass, Weight: p.Weight, Seller: p.Seller}
+	if p.Price != nil {
+		line.Price = *p.Price
+	}
+	return line
+}
+
+func lineLimit(p models.Product) int64 {
+	if p.MaxPerOrder > 0 && p.MaxPerOrder < MaxLineQuantity {
+		return p.MaxPerOrder
+	}
+	return MaxLineQuantity
+}
+
+// unitsWithin is a cart filter that the units of the lines cond picks add
+// up to at most max. Limits hold per product, across its variants.
+func unitsWithin(cond bson.M, max int64) bson.M {
+	units := bson.M{"$map": bson.M{
+		"input": bson.M{"$filter": bson.M{"input": bson.M{"$ifNull": bson.A{"$items", bson.A{}}}, "cond": cond}},
+		"in":    bson.M{"$max": bson.A{"$$this.quantity", 1}},
+	}}
+	return bson.M{"$lte": bson.A{bson.M{"$sum": units}, max}}
+}
+
+// productLimits loads the limit of every product lines hold. Products gone
+// from the catalog get MaxLineQuantity.
+func productLimits(ctx context.Context, products *mongo.Collection, lines []models.UserProd) (map[primitive.ObjectID]int64, error) {
+	ids := make([]primitive.ObjectID, 0, len(lines))
+	for _, line := range lines {
+		ids = append(ids, line.ID)
+	}
+	var found []models.Product
+	cur, err := products.Find(ctx, bson.M{"id": bson.M{"$in": ids}})
+	if err == nil {
+		err = cur.All(ctx, &found)
+	}
 	if err != nil {
 		log.Println(err)
-		return ErrInvalidCart
+		return nil, ErrInvalidCart
+	}
+	limits := map[primitive.ObjectID]int64{}
+	for _, line := range lines {
+		limits[line.ID] = MaxLineQuantity
+	}
+	for _, p := range found {
+		limits[p.ID] = lineLimit(p)
 	}
+	return limits, nil
+}
 
-	var uProd []models.UserProd
-	err = search.All(ctx, &uProd)
+// capLines lowers lines so no product goes over its limit, counting all of
+// its variants together, and drops lines left with nothing.
+func capLines(lines []models.UserProd, limits map[primitive.ObjectID]int64) []models.UserProd {
+	capped := make([]models.UserProd, 0, len(lines))
+	used := map[primitive.ObjectID]int64{}
+	for _, line := range lines {
+		left := limits[line.ID] - used[line.ID]
+		if left <= 0 {
+			continue
+		}
+		line.Quantity = line.Units()
+		if line.Quantity > left {
+			line.Quantity = left
+		}
+		used[line.ID] += line.Quantity
+		capped = append(capped, line)
+	}
+	return capped
+}
+
+// checkLimits fails with ErrCartLimit if lines hold more of a product than
+// it allows per order, counting all of its variants together.
+func checkLimits(ctx context.Context, products *mongo.Collection, lines []models.UserProd) error {
+	limits, err := productLimits(ctx, products, lines)
 	if err != nil {
-		log.Println(err)
-		return ErrInvalidProduct
+		return err
 	}
+	used := map[primitive.ObjectID]int64{}
+	for _, line := range lines {
+		used[line.ID] += line.Units()
+		if used[line.ID] > limits[line.ID] {
+			return ErrCartLimit
+		}
+	}
+	return nil
+}
+
+func lineMatch(pid primitive.ObjectID, variant string) bson.M {
+	return bson.M{"id": pid, "variant": variant}
+}
 
+// CartKey picks the cart a request works on: a signed in user's by UID, or
+// a guest's by Token.
+type CartKey struct {
+	UID   primitive.ObjectID
+	Token string
+}
+
+func UserCart(uid string) (CartKey, error) {
 	uHex, err := primitive.ObjectIDFromHex(uid)
 	if err != nil {
 		log.Println(err)
-		return ErrInvalidUser
+		return CartKey{}, ErrInvalidUser
 	}
+	return CartKey{UID: uHex}, nil
+}
 
-	idx := bson.D{primitive.E{Key: "id", Value: uHex}}
-	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "cart", Value: bson.D{{Key: "$each", Value: uProd}}}}}}
+func GuestCart(token string) CartKey {
+	return CartKey{Token: token}
+}
 
-	_, err = users.UpdateOne(ctx, idx, update)
-	if err != nil {
-		return ErrInvalidUser
+func (k CartKey) filter() bson.M {
+	if k.Token != "" {
+		return bson.M{"token": k.Token}
+	}
+	return bson.M{"uid": k.UID}
+}
+
+// ensureCart creates a user's cart on first use. Guest carts are only ever
+// created by NewGuestCart; touching one pushes its expiry back.
+func ensureCart(ctx context.Context, key CartKey) error {
+	now := time.Now()
+	if key.Token != "" {
+		update := bson.M{"$set": bson.M{"updatedAt": now, "expiresAt": now.Add(GuestCartTTL)}}
+		res, err := Carts.UpdateOne(ctx, key.filter(), update)
+		if err != nil {
+			log.Println(err)
+			return ErrInvalidCart
+		}
+		if res.MatchedCount == 0 {
+			return ErrInvalidGuestCart
+		}
+		return nil
 	}
-	return nil 
 
+	update := bson.M{
+		"$set":         bson.M{"updatedAt": now},
+		"$setOnInsert": bson.M{"id": primitive.NewObjectID(), "items": bson.A{}},
+	}
+	_, err := Carts.UpdateOne(ctx, key.filter(), update, options.Update().SetUpsert(true))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		log.Println(err)
+		return ErrInvalidCart
+	}
+	return nil
 }
 
-func CartRemove(ctx context.Context, products *mongo.Collection, users *mongo.Collection, pid primitive.ObjectID, uid string) error {
-	uHex, err := primitive.ObjectIDFromHex(uid)
+// addLine raises the quantity of the cart line for the same product and
+// variant, or adds the line if the cart has none, never taking the product
+// over limit across its variants.
+func addLine(ctx context.Context, key CartKey, line models.UserProd, limit int64) error {
+	qty := line.Units()
+	if qty > limit {
+		return ErrCartLimit
+	}
+	if err := ensureCart(ctx, key); err != nil {
+		return err
+	}
+
+	within := unitsWithin(bson.M{"$eq": bson.A{"$$this.id", line.ID}}, limit-qty)
+	idx := key.filter()
+	idx["items"] = bson.M{"$elemMatch": lineMatch(line.ID, line.Variant)}
+	idx["$expr"] = within
+	res, err := Carts.UpdateOne(ctx, idx, bson.M{"$inc": bson.M{"items.$.quantity": qty}})
 	if err != nil {
 		log.Println(err)
-		return ErrInvalidUser
+		return ErrInvalidCart
+	}
+	if res.MatchedCount > 0 {
+		return nil
 	}
 
-	idx := bson.D(primitive.D{primitive.E{Key: "id", Value: uHex}})
-	update := bson.M{"$pull": bson.M{"cart": bson.M{"id": pid}}}
-
-	_, err = users.UpdateMany(ctx, idx, update)
+	line.Quantity = qty
+	idx = key.filter()
+	idx["items"] = bson.M{"$not": bson.M{"$elemMatch": lineMatch(line.ID, line.Variant)}}
+	idx["$expr"] = within
+	res, err = Carts.UpdateOne(ctx, idx, bson.M{"$push": bson.M{"items": line}})
 	if err != nil {
+		log.Println(err)
 		return ErrInvalidCart
 	}
+	if res.MatchedCount == 0 {
+		// the line is there or not, and either way the product would pass
+		// its limit
+		return ErrCartLimit
+	}
 	return nil
 }
 
-// func CartGet() {
+// pullLines drops the lines of a cart matching match.
+func pullLines(ctx context.Context, key CartKey, match bson.M) error {
+	update := bson.M{"$pull": bson.M{"items": match}, "$set": bson.M{"updatedAt": time.Now()}}
+	_, err := Carts.UpdateOne(ctx, key.filter(), update)
+	if err != nil {
+		log.Println(err)
+		return ErrInvalidCart
+	}
+	return nil
+}
 
-// }
+// MergeLines folds lines for the same product and variant into one, adding
+// up their quantities. The first line seen keeps its price snapshot.
+func MergeLines(carts ...[]models.UserProd) []models.UserProd {
+	merged := make([]models.UserProd, 0)
+	at := map[string]int{}
+	for _, cart := range carts {
+		for _, line := range cart {
+			key := line.ID.Hex() + "/" + line.Variant
+			if i, ok := at[key]; ok {
+				merged[i].Quantity += line.Units()
+				continue
+			}
+			line.Quantity = line.Units()
+			at[key] = len(merged)
+			merged = append(merged, line)
+		}
+	}
+	return merged
+}
 
-func CartBuy(ctx context.Context, users *mongo.Collection, uid string) error {
-	uHex, err := primitive.ObjectIDFromHex(uid)
+func CartAdd(ctx context.Context, products *mongo.Collection, key CartKey, pid primitive.ObjectID, variant string, qty int64) error {
+	var prod models.Product
+	err := products.FindOne(ctx, bson.M{"id": pid}).Decode(&prod)
 	if err != nil {
 		log.Println(err)
-		return ErrInvalidUser
+		return ErrInvalidProduct
 	}
-	var user models.User
-	var order models.Order
 
-	order.ID = primitive.NewObjectID()
-	order.OrderTime = time.Now()
-	order.Cart = make([]models.UserProd, 0)
-	order.Payment.Cash = true
+	line := snapshot(prod)
+	line.Variant = variant
+	line.Quantity = qty
+	return addLine(ctx, key, line, lineLimit(prod))
+}
 
-	ret := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$cart"}}}}
-	group := bson.D{{Key: "$group", Value: bson.D{primitive.E{Key: "_id", Value: "$id"}, {Key: "total", Value: bson.D{primitive.E{Key: "$sum", Value: "$cart.price"}}}}}}
-	res, err := users.Aggregate(ctx, mongo.Pipeline{ret, group})
-	ctx.Done()
+// CartDecrement lowers a line's quantity and drops the line once it would
+// reach zero.
+func CartDecrement(ctx context.Context, key CartKey, pid primitive.ObjectID, variant string, qty int64) error {
+	match := lineMatch(pid, variant)
+	match["quantity"] = bson.M{"$gt": qty}
+	idx := key.filter()
+	idx["items"] = bson.M{"$elemMatch": match}
+	res, err := Carts.UpdateOne(ctx, idx, bson.M{"$inc": bson.M{"items.$.quantity": -qty}})
 	if err != nil {
-		panic(err)
+		log.Println(err)
+		return ErrInvalidCart
+	}
+	if res.MatchedCount > 0 {
+		return nil
 	}
+	return pullLines(ctx, key, lineMatch(pid, variant))
+}
 
-	var uCart []bson.M
-	err = res.All(ctx, &uCart)
-	if err != nil {
-		panic(err)
+func CartSetQuantity(ctx context.Context, products *mongo.Collection, key CartKey, pid primitive.ObjectID, variant string, qty int64) error {
+	if qty <= 0 {
+		return pullLines(ctx, key, lineMatch(pid, variant))
 	}
-	var price float64
-	for _, item := range uCart {
-		p := item["total"]
-		price = p.(float64)
 
+	var prod models.Product
+	err := products.FindOne(ctx, bson.M{"id": pid}).Decode(&prod)
+	if err != nil {
+		log.Println(err)
+		return ErrInvalidProduct
+	}
+	if qty > lineLimit(prod) {
+		return ErrCartLimit
 	}
-	order.Price = float64(price)
 
-	idx := bson.D{primitive.E{Key: "id", Value: uHex}}
-	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "status", Value: order}}}}
-	_, err = users.UpdateMany(ctx, idx, update)
+	// the product's other variants count towards the limit too
+	others := bson.M{"$and": bson.A{
+		bson.M{"$eq": bson.A{"$$this.id", pid}},
+		bson.M{"$ne": bson.A{bson.M{"$ifNull": bson.A{"$$this.variant", ""}}, variant}},
+	}}
+	idx := key.filter()
+	idx["items"] = bson.M{"$elemMatch": lineMatch(pid, variant)}
+	idx["$expr"] = unitsWithin(others, lineLimit(prod)-qty)
+	res, err := Carts.UpdateOne(ctx, idx, bson.M{"$set": bson.M{"items.$.quantity": qty}})
 	if err != nil {
 		log.Println(err)
+		return ErrInvalidCart
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+
+	line := snapshot(prod)
+	line.Variant = variant
+	line.Quantity = qty
+	return addLine(ctx, key, line, lineLimit(prod))
+}
 
+func CartRemove(ctx context.Context, key CartKey, pid primitive.ObjectID) error {
+	return pullLines(ctx, key, bson.M{"id": pid})
+}
+
+// GetCart loads a cart. A user without one yet gets an empty cart; a guest
+// token that matches nothing has expired or never existed.
+func GetCart(ctx context.Context, key CartKey) (models.Cart, error) {
+	var cart models.Cart
+	err := Carts.FindOne(ctx, key.filter()).Decode(&cart)
+	if err == mongo.ErrNoDocuments && key.Token == "" {
+		uid := key.UID
+		return models.Cart{UID: &uid, Items: make([]models.UserProd, 0), Coupons: make([]string, 0)}, nil
+	}
+	if err == mongo.ErrNoDocuments {
+		return cart, ErrInvalidGuestCart
 	}
-	err = users.FindOne(ctx, bson.D{primitive.E{Key: "id", Value: uHex}}).Decode(&user)
 	if err != nil {
 		log.Println(err)
+		return cart, ErrInvalidCart
+	}
+	if cart.Items == nil {
+		cart.Items = make([]models.UserProd, 0)
+	}
+	if cart.Coupons == nil {
+		cart.Coupons = make([]string, 0)
+	}
+	return cart, nil
+}
 
+// NewGuestCart opens an empty cart for a visitor who has not signed in and
+// returns it with the token that addresses it.
+func NewGuestCart(ctx context.Context) (models.Cart, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return models.Cart{}, err
+	}
+	now := time.Now()
+	expires := now.Add(GuestCartTTL)
+	cart := models.Cart{
+		ID:        primitive.NewObjectID(),
+		Token:     hex.EncodeToString(b),
+		Items:     make([]models.UserProd, 0),
+		UpdatedAt: now,
+		ExpiresAt: &expires,
 	}
+	if _, err := Carts.InsertOne(ctx, cart); err != nil {
+		log.Println(err)
+		return models.Cart{}, ErrInvalidCart
+	}
+	return cart, nil
+}
 
-	idx2 := bson.D{primitive.E{Key: "id", Value: uHex}}
-	update2 := bson.M{"$push": bson.M{"statu8s.$[].cart": bson.M{"$each": user.Cart}}}
-	_, err = users.UpdateOne(ctx, idx2, update2)
+// MergeGuestCart moves a guest cart into the user's cart when they sign in.
+// Lines both carts hold are added up and capped at the product's limit.
+func MergeGuestCart(ctx context.Context, products *mongo.Collection, token string, uid primitive.ObjectID) error {
+	guest, err := GetCart(ctx, GuestCart(token))
+	if err != nil {
+		return err
+	}
+	key := CartKey{UID: uid}
+	cart, err := GetCart(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := setLines(ctx, products, key, MergeLines(cart.Items, guest.Items)); err != nil {
+		return err
+	}
+	_, err = Carts.DeleteOne(ctx, GuestCart(token).filter())
 	if err != nil {
 		log.Println(err)
 	}
+	return nil
+}
+
+// setLines replaces the lines of a cart, capping each product at its
+// limit across its variants.
+func setLines(ctx context.Context, products *mongo.Collection, key CartKey, lines []models.UserProd) error {
+	limits, err := productLimits(ctx, products, lines)
+	if err != nil {
+		return err
+	}
+	lines = capLines(lines, limits)
 
-	empty := make([]models.UserProd, 0)
-	idx3 := bson.D{primitive.E{Key: "id", Value: uHex}}
-	update3 := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "cart", Value: empty}}}}
-	_, err = users.UpdateOne(ctx, idx3, update3)
+	if err := ensureCart(ctx, key); err != nil {
+		return err
+	}
+	_, err = Carts.UpdateOne(ctx, key.filter(), bson.M{"$set": bson.M{"items": lines, "updatedAt": time.Now()}})
 	if err != nil {
 		log.Println(err)
+		return ErrInvalidCart
 	}
 	return nil
+}
 
+// Reorder adds the lines of a past order to the buyer's cart at today's
+// prices. The review says which prices changed since the order and which
+// products are no longer sold; those are left out.
+func Reorder(ctx context.Context, products *mongo.Collection, order models.Order) (models.CartReview, error) {
+	review, err := ReviewCart(ctx, products, order.Cart)
+	if err != nil {
+		return review, err
+	}
+	review.Confirm = ""
+	if len(review.Items) == 0 {
+		return review, ErrNothingToReorder
+	}
+	key := CartKey{UID: order.UID}
+	cart, err := GetCart(ctx, key)
+	if err != nil {
+		return review, err
+	}
+	return review, setLines(ctx, products, key, MergeLines(cart.Items, review.Items))
 }
 
-func Buy(ctx context.Context, products *mongo.Collection, users *mongo.Collection, pid primitive.ObjectID, uid string) error {
+// func CartGet() {
+
+// }
+
+// Checkout holds what the buyer chose for an order: the Confirm value of a
+// cart review they agreed to, the address it goes to, how it ships and
+// whether it is paid in cash. Orders not paid in cash wait for PayOrder.
+type Checkout struct {
+	Confirm  string
+	Address  string
+	Shipping string
+	Cash     bool
+}
+
+// CartBuy places an order for the cart at current prices. If any price
+// changed or a product is gone it returns the review with ErrCartChanged
+// instead, until it is called again with the review's Confirm value.
+// Otherwise it returns the order placed, awaiting payment.
+// A cart with items from several sellers is split into a sub-order per
+// seller under the order returned, which is what the buyer pays.
+// Redeeming promotions, taking stock, writing the orders and emptying the
+// cart happen in one transaction, so either all of them do or none. A cart
+// changed meanwhile fails with ErrCartChanged and is left as it is.
+func CartBuy(ctx context.Context, products *mongo.Collection, users *mongo.Collection, uid string, opts Checkout) (models.Order, models.CartReview, error) {
 	uHex, err := primitive.ObjectIDFromHex(uid)
 	if err != nil {
 		log.Println(err)
-		return ErrInvalidUser
+		return models.Order{}, models.CartReview{}, ErrInvalidUser
 	}
-
-	var uProd models.UserProd
 	var order models.Order
+
 	order.ID = primitive.NewObjectID()
+	order.UID = uHex
 	order.OrderTime = time.Now()
-	order.Cart = make([]models.UserProd, 0)
-	order.Payment.Cash = true
-	// check product exists
-	err = products.FindOne(ctx, bson.D{primitive.E{Key: "id", Value: pid}}).Decode(&uProd)
+	order.Payment.Cash = opts.Cash
+	openOrder(&order, "checkout")
+
+	key := CartKey{UID: uHex}
+	cart, err := GetCart(ctx, key)
+	if err != nil {
+		return order, models.CartReview{}, err
+	}
+	review, err := ReviewCart(ctx, products, cart.Items)
+	if err != nil {
+		return order, review, err
+	}
+	if review.Confirm != "" && review.Confirm != opts.Confirm {
+		return order, review, ErrCartChanged
+	}
+	if len(review.Items) == 0 {
+		return order, review, ErrEmptyCart
+	}
+	// the cart only keeps to the limits as they were when lines were added
+	if err := checkLimits(ctx, products, review.Items); err != nil {
+		return order, review, err
+	}
+	order.Cart = review.Items
+	discounts, err := priceOrder(ctx, users, &order, cart.Coupons, opts)
+	if err != nil {
+		return order, review, err
+	}
+	err = Transact(ctx, func(sc mongo.SessionContext) error {
+		if err := RedeemPromotions(sc, uHex, order.ID, discounts.Promotions); err != nil {
+			return err
+		}
+		if err := takeStock(sc, products, order.Cart); err != nil {
+			return err
+		}
+		if _, err := Orders.InsertOne(sc, order); err != nil {
+			return err
+		}
+		for _, child := range order.SubOrders {
+			if _, err := Orders.InsertOne(sc, child); err != nil {
+				return err
+			}
+		}
+		return emptyCart(sc, key, review)
+	})
+	if err == ErrCartChanged {
+		// show the buyer the cart as it is now
+		if cart, err := GetCart(ctx, key); err == nil {
+			if now, err := ReviewCart(ctx, products, cart.Items); err == nil {
+				review = now
+			}
+		}
+	}
 	if err != nil {
 		log.Println(err)
 	}
-	
-	order.Price = uProd.Price
-	idx := bson.D{primitive.E{Key: "id", Value: uHex}}
-	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "status", Value: order}}}}
-	_, err = users.UpdateOne(ctx, idx, update)
+	return order, review, err
+}
+
+// emptyCart takes what was bought out of a cart, with the lines the buyer
+// agreed to leave out. The cart may have changed since it was read; if any
+// line bought is no longer there as it was, nothing is taken and the
+// checkout fails with ErrCartChanged.
+func emptyCart(ctx context.Context, key CartKey, review models.CartReview) error {
+	held := make(bson.A, 0, len(review.Items))
+	bought := make(bson.A, 0, len(review.Items)+len(review.Unavailable))
+	for _, line := range review.Items {
+		match := lineMatch(line.ID, line.Variant)
+		match["quantity"] = line.Units()
+		if line.Units() == 1 {
+			// older lines may not keep a quantity of one
+			match["quantity"] = bson.M{"$in": bson.A{nil, 0, 1}}
+		}
+		held = append(held, bson.M{"items": bson.M{"$elemMatch": match}})
+		bought = append(bought, match)
+	}
+	for _, line := range review.Unavailable {
+		bought = append(bought, lineMatch(line.ID, line.Variant))
+	}
+	filter := key.filter()
+	filter["$and"] = held
+	update := bson.M{
+		"$pull": bson.M{"items": bson.M{"$or": bought}},
+		"$set":  bson.M{"coupons": bson.A{}, "updatedAt": time.Now()},
+	}
+	res, err := Carts.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrCartChanged
+	}
+	return nil
+}
+
+// priceOrder works out what order costs for the lines in its cart: its
+// automatic promotions and coupons, tax and shipping to the address chosen,
+// and who it is billed to. An order with items from several sellers gets
+// its sub-orders. It returns the discounts, for redeeming once the order
+// is placed.
+func priceOrder(ctx context.Context, users *mongo.Collection, order *models.Order, coupons []string, opts Checkout) (models.Discounts, error) {
+	discounts, err := CartDiscounts(ctx, order.UID, order.Cart, coupons, "")
+	if err != nil {
+		return discounts, err
+	}
+	order.Subtotal = discounts.Subtotal
+	if discounts.Discount.Amount > 0 {
+		order.DC = &discounts.Discount
+	}
+	order.Promotions = discounts.Promotions
+
+	addr, err := UserAddress(ctx, users, order.UID, opts.Address)
+	if err != nil {
+		return discounts, err
+	}
+	taxes, err := CartTax(ctx, order.Cart, discounts, addr, discounts.Total.Currency)
+	if err != nil {
+		return discounts, err
+	}
+	order.Tax = taxes.Lines
+	if taxes.Total.Amount > 0 {
+		order.TaxTotal = &taxes.Total
+	}
+	quotes, err := ShippingQuotes(ctx, order.Cart, discounts.Total, addr, discounts.FreeShipping, discounts.Total.Currency)
+	if err != nil {
+		return discounts, err
+	}
+	order.Shipping, err = PickShipping(ctx, quotes, opts.Shipping)
+	if err != nil {
+		return discounts, err
+	}
+	if !addr.ID.IsZero() {
+		order.ShipTo = &addr
+	}
+	bill, err := BillingAddress(ctx, users, order.UID, addr)
+	if err != nil {
+		return discounts, err
+	}
+	if !bill.ID.IsZero() {
+		order.BillTo = &bill
+	}
+
+	order.Price, err = discounts.Total.Add(taxes.Added)
+	if err == nil && order.Shipping != nil {
+		order.Price, err = order.Price.Add(order.Shipping.Cost)
+	}
 	if err != nil {
 		log.Println(err)
+		return discounts, ErrInvalidCart
 	}
+	groups := groupBySeller(order.Cart)
+	if len(groups) == 1 {
+		order.Seller = groups[0].seller
+		return discounts, nil
+	}
+	order.SubOrders, err = subOrders(ctx, order, groups, discounts, addr, opts.Shipping)
+	return discounts, err
+}
 
-	idx2 := bson.D{primitive.E{Key: "id", Value: uHex}}
-	update2 := bson.M{"$push": bson.M{"status.$[].cart": uProd}}
-	_, err = users.UpdateOne(ctx, idx2, update2)
+// Buy places an order for one unit of a product straight away, without
+// going through the cart. It is priced like a checkout, with automatic
+// promotions, tax and shipping to the address chosen. Redeeming
+// promotions, taking stock and writing the order happen in one
+// transaction.
+func Buy(ctx context.Context, products *mongo.Collection, users *mongo.Collection, pid primitive.ObjectID, uid string, opts Checkout) (models.Order, error) {
+	var order models.Order
+	uHex, err := primitive.ObjectIDFromHex(uid)
 	if err != nil {
 		log.Println(err)
+		return order, ErrInvalidUser
 	}
-	return nil
-}
\ No newline at end of file
+	n, err := users.CountDocuments(ctx, bson.M{"id": uHex})
+	if err != nil {
+		log.Println(err)
+		return order, err
+	}
+	if n == 0 {
+		return order, ErrInvalidUser
+	}
+
+	var prod models.Product
+	err = products.FindOne(ctx, bson.D{primitive.E{Key: "id", Value: pid}}).Decode(&prod)
+	if err != nil || prod.Price == nil {
+		log.Println(err)
+		return order, ErrInvalidProduct
+	}
+	uProd := snapshot(prod)
+	if err := checkLimits(ctx, products, []models.UserProd{uProd}); err != nil {
+		return order, err
+	}
+
+	order.ID = primitive.NewObjectID()
+	order.UID = uHex
+	order.OrderTime = time.Now()
+	order.Cart = []models.UserProd{uProd}
+	order.Payment.Cash = opts.Cash
+	openOrder(&order, "buy")
+	discounts, err := priceOrder(ctx, users, &order, nil, opts)
+	if err != nil {
+		return order, err
+	}
+	err = Transact(ctx, func(sc mongo.SessionContext) error {
+		if err := RedeemPromotions(sc, uHex, order.ID, discounts.Promotions); err != nil {
+			return err
+		}
+		if err := takeStock(sc, products, order.Cart); err != nil {
+			return err
+		}
+		_, err := Orders.InsertOne(sc, order)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return order, err
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrInvalidCategory = errors.New("invalid Category")
+
+func GetCategory(ctx context.Context, cid primitive.ObjectID) (models.Category, error) {
+	var cat models.Category
+	err := Categories.FindOne(ctx, bson.M{"id": cid}).Decode(&cat)
+	if err == mongo.ErrNoDocuments {
+		return cat, ErrInvalidCategory
+	}
+	return cat, err
+}
+
+// AttributeFilter turns attr.<key>=a,b and attr.<key>.min / attr.<key>.max
+// query parameters into a product filter, typed by the category schema.
+func AttributeFilter(cat models.Category, query url.Values) (bson.M, error) {
+	filter := bson.M{}
+	for param, values := range query {
+		if !strings.HasPrefix(param, "attr.") || len(values) == 0 {
+			continue
+		}
+		key, op := strings.TrimPrefix(param, "attr."), ""
+		if i := strings.LastIndex(key, "."); i > 0 && (key[i+1:] == "min" || key[i+1:] == "max") {
+			key, op = key[:i], key[i+1:]
+		}
+		def, ok := cat.Attribute(key)
+		if !ok {
+			return nil, fmt.Errorf("unknown attribute %q", key)
+		}
+
+		field := "attributes." + key
+		cond, _ := filter[field].(bson.M)
+		if cond == nil {
+			cond = bson.M{}
+		}
+		switch {
+		case op != "":
+			if def.Type != models.AttrNumber {
+				return nil, fmt.Errorf("attribute %q is not a number", key)
+			}
+			n, err := strconv.ParseFloat(values[0], 64)
+			if err != nil {
+				return nil, fmt.Errorf("attribute %q: %w", key, err)
+			}
+			if op == "min" {
+				cond["$gte"] = n
+			} else {
+				cond["$lte"] = n
+			}
+		case def.Type == models.AttrNumber:
+			var in bson.A
+			for _, v := range strings.Split(values[0], ",") {
+				n, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return nil, fmt.Errorf("attribute %q: %w", key, err)
+				}
+				in = append(in, n)
+			}
+			cond["$in"] = in
+		case def.Type == models.AttrBool:
+			b, err := strconv.ParseBool(values[0])
+			if err != nil {
+				return nil, fmt.Errorf("attribute %q: %w", key, err)
+			}
+			cond["$eq"] = b
+		default:
+			var in bson.A
+			for _, v := range strings.Split(values[0], ",") {
+				in = append(in, v)
+			}
+			cond["$in"] = in
+		}
+		filter[field] = cond
+	}
+	return filter, nil
+}
+
+// HasAttributeFilter reports whether the query carries any attr.* parameter.
+func HasAttributeFilter(query url.Values) bool {
+	for param := range query {
+		if strings.HasPrefix(param, "attr.") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrEmptyCart   = errors.New("cart is empty")
+	ErrCartChanged = errors.New("cart changed since it was filled, confirm to continue")
+)
+
+// ReviewCart reprices every line from products. Lines whose product was
+// removed or has no price any more are set aside as unavailable.
+func ReviewCart(ctx context.Context, products *mongo.Collection, items []models.UserProd) (models.CartReview, error) {
+	review := models.CartReview{
+		Items:        make([]models.UserProd, 0, len(items)),
+		PriceChanges: make([]models.PriceNotice, 0),
+		Unavailable:  make([]models.UserProd, 0),
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(items))
+	for _, line := range items {
+		ids = append(ids, line.ID)
+	}
+	var found []models.Product
+	cur, err := products.Find(ctx, bson.M{"id": bson.M{"$in": ids}})
+	if err == nil {
+		err = cur.All(ctx, &found)
+	}
+	if err != nil {
+		log.Println(err)
+		return review, ErrInvalidCart
+	}
+	byID := map[primitive.ObjectID]models.Product{}
+	for _, p := range found {
+		byID[p.ID] = p
+	}
+
+	for _, line := range items {
+		p, ok := byID[line.ID]
+		if !ok || p.Price == nil {
+			review.Unavailable = append(review.Unavailable, line)
+			continue
+		}
+		current := snapshot(p)
+		current.Variant = line.Variant
+		current.Quantity = line.Units()
+		if current.Price != line.Price {
+			review.PriceChanges = append(review.PriceChanges, models.PriceNotice{
+				ID:       line.ID,
+				Name:     current.Name,
+				Variant:  line.Variant,
+				OldPrice: line.Price,
+				NewPrice: current.Price,
+			})
+		}
+		review.Items = append(review.Items, current)
+	}
+
+	if len(review.PriceChanges) > 0 || len(review.Unavailable) > 0 {
+		review.Confirm = fingerprint(review)
+	}
+	return review, nil
+}
+
+// fingerprint sums up what the buyer is agreeing to, so a confirmation only
+// holds while prices and availability stay as they were shown.
+func fingerprint(review models.CartReview) string {
+	h := sha256.New()
+	for _, line := range review.Items {
+		fmt.Fprintf(h, "%s/%s/%d/%d/%s;", line.ID.Hex(), line.Variant, line.Units(), line.Price.Amount, line.Price.Currency)
+	}
+	for _, line := range review.Unavailable {
+		fmt.Fprintf(h, "-%s/%s;", line.ID.Hex(), line.Variant)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
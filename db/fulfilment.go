@@ -0,0 +1,164 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidPack = errors.New("line is not on the order or already packed")
+	ErrNotPackable = errors.New("only paid orders can be packed")
+)
+
+// PackOrder marks lines of a paid order packed, every line not yet packed
+// when lines is empty. Once all of them are, the order moves to fulfilled.
+func PackOrder(ctx context.Context, order models.Order, lines []models.PackedLine, by, note string) (models.Order, error) {
+	if len(order.SubOrderIDs) > 0 {
+		return order, ErrSplitOrder
+	}
+	if order.Status != models.OrderPaid {
+		return order, ErrNotPackable
+	}
+	packed := packedLines(order)
+	if len(lines) == 0 {
+		for _, item := range order.Cart {
+			if !packed[lineKey{item.ID, item.Variant}] {
+				lines = append(lines, models.PackedLine{ID: item.ID, Variant: item.Variant})
+			}
+		}
+	}
+	now := time.Now()
+	taken := bson.A{}
+	for i, l := range lines {
+		key := lineKey{l.ID, l.Variant}
+		found := false
+		for _, item := range order.Cart {
+			if item.ID == l.ID && item.Variant == l.Variant {
+				found = true
+				break
+			}
+		}
+		if !found || packed[key] {
+			return order, ErrInvalidPack
+		}
+		packed[key] = true
+		lines[i].At = now
+		lines[i].By = by
+		// a variant left empty is not stored, so it is matched as missing
+		variant := interface{}(l.Variant)
+		if l.Variant == "" {
+			variant = nil
+		}
+		taken = append(taken, bson.M{"packed": bson.M{"$elemMatch": bson.M{"id": l.ID, "variant": variant}}})
+	}
+
+	// lines packed meanwhile by someone else are not packed twice
+	filter := bson.M{"id": order.ID, "status": models.OrderPaid, "$nor": taken}
+	update := bson.M{"$push": bson.M{"packed": bson.M{"$each": lines}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := Orders.FindOneAndUpdate(ctx, filter, update, opts).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		return order, ErrInvalidPack
+	}
+	if err != nil {
+		return order, err
+	}
+	for _, item := range order.Cart {
+		if !packed[lineKey{item.ID, item.Variant}] {
+			return order, nil
+		}
+	}
+	return AdvanceOrder(ctx, order.ID, nil, models.OrderFulfilled, by, note)
+}
+
+// packedLines is the lines of order packed so far.
+func packedLines(order models.Order) map[lineKey]bool {
+	out := map[lineKey]bool{}
+	for _, p := range order.Packed {
+		out[lineKey{p.ID, p.Variant}] = true
+	}
+	return out
+}
+
+// ShipOrder records how an order was sent and moves it to shipped. A paid
+// order has whatever is left packed first.
+func ShipOrder(ctx context.Context, order models.Order, shipment models.Shipment, by, note string) (models.Order, error) {
+	if order.Status == models.OrderPaid {
+		var err error
+		if order, err = PackOrder(ctx, order, nil, by, ""); err != nil {
+			return order, err
+		}
+	}
+	if order.Status != models.OrderFulfilled {
+		return order, ErrOrderTransition
+	}
+	shipment = models.Shipment{Carrier: shipment.Carrier, Tracking: shipment.Tracking, ShippedAt: time.Now(), Events: make([]models.TrackingEvent, 0)}
+	shipped := order
+	err := Transact(ctx, func(sc mongo.SessionContext) error {
+		res, err := Orders.UpdateOne(sc, bson.M{"id": order.ID, "status": models.OrderFulfilled}, bson.M{"$set": bson.M{"shipment": shipment}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return ErrOrderTransition
+		}
+		shipped, err = AdvanceOrder(sc, order.ID, nil, models.OrderShipped, by, note)
+		return err
+	})
+	return shipped, err
+}
+
+// PickItem is one product and variant to pick off the shelves, summed over
+// the orders waiting for it.
+type PickItem struct {
+	ID       primitive.ObjectID   `json:"id"`
+	Variant  string               `json:"variant,omitempty"`
+	Name     string               `json:"name"`
+	Quantity int64                `json:"quantity"`
+	Orders   []primitive.ObjectID `json:"orders"`
+}
+
+// PickList sums up the lines not packed yet of the seller's paid orders,
+// by product and variant in the order they were first ordered.
+func PickList(ctx context.Context, seller primitive.ObjectID) ([]PickItem, error) {
+	out := make([]PickItem, 0)
+	filter := bson.M{"seller": seller, "status": models.OrderPaid}
+	cur, err := Orders.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "orderTime", Value: 1}}))
+	if err != nil {
+		return out, err
+	}
+	var orders []models.Order
+	if err := cur.All(ctx, &orders); err != nil {
+		return out, err
+	}
+	at := map[lineKey]int{}
+	for _, order := range orders {
+		packed := packedLines(order)
+		for _, item := range order.Cart {
+			key := lineKey{item.ID, item.Variant}
+			if packed[key] {
+				continue
+			}
+			i, ok := at[key]
+			if !ok {
+				name := item.ID.Hex()
+				if item.Name != nil {
+					name = *item.Name
+				}
+				i = len(out)
+				at[key] = i
+				out = append(out, PickItem{ID: item.ID, Variant: item.Variant, Name: name})
+			}
+			out[i].Quantity += item.Units()
+			out[i].Orders = append(out[i].Orders, order.ID)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// IdempotencyTTL is how long a key is remembered after its first use.
+const IdempotencyTTL = 24 * time.Hour
+
+// IdempotencyLock is how long a request holds its key. A request that has
+// not finished by then is taken to have died, and a repeat may run again.
+const IdempotencyLock = 2 * time.Minute
+
+var (
+	ErrKeyReused   = errors.New("idempotency key was already used for a different request")
+	ErrKeyInFlight = errors.New("a request with this idempotency key is still in progress")
+)
+
+// ClaimKey reserves key for the user's request with fingerprint. It returns
+// true when the caller should run the request, and false with the finished
+// record when the request already ran and its response should be replayed.
+func ClaimKey(ctx context.Context, uid, key, fingerprint string) (models.IdempotencyKey, bool, error) {
+	now := time.Now()
+	rec := models.IdempotencyKey{
+		ID:          primitive.NewObjectID(),
+		UID:         uid,
+		Key:         key,
+		Fingerprint: fingerprint,
+		LockedAt:    now,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(IdempotencyTTL),
+	}
+	_, err := IdempotencyKeys.InsertOne(ctx, rec)
+	if err == nil {
+		return rec, true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return rec, false, err
+	}
+
+	var found models.IdempotencyKey
+	if err := IdempotencyKeys.FindOne(ctx, bson.M{"uid": uid, "key": key}).Decode(&found); err != nil {
+		return rec, false, err
+	}
+	if found.Fingerprint != fingerprint {
+		return found, false, ErrKeyReused
+	}
+	if found.Done {
+		return found, false, nil
+	}
+	stale := bson.M{"id": found.ID, "done": false, "lockedAt": bson.M{"$lt": now.Add(-IdempotencyLock)}}
+	res, err := IdempotencyKeys.UpdateOne(ctx, stale, bson.M{"$set": bson.M{"lockedAt": now}})
+	if err != nil {
+		return found, false, err
+	}
+	if res.ModifiedCount == 0 {
+		return found, false, ErrKeyInFlight
+	}
+	return found, true, nil
+}
+
+// FinishKey stores the response of the request holding the key.
+func FinishKey(ctx context.Context, id primitive.ObjectID, status int, contentType string, body []byte) error {
+	set := bson.M{"done": true, "status": status, "contentType": contentType, "body": body}
+	_, err := IdempotencyKeys.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": set})
+	return err
+}
+
+// ReleaseKey forgets a key whose request failed, so it can be tried again.
+func ReleaseKey(ctx context.Context, id primitive.ObjectID) error {
+	_, err := IdempotencyKeys.DeleteOne(ctx, bson.M{"id": id, "done": false})
+	return err
+}
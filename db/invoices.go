@@ -0,0 +1,249 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrNotInvoiceable = errors.New("order has not been paid yet")
+
+// InvoiceIssuer is who orders without a seller are invoiced from.
+var InvoiceIssuer = models.Party{Name: "Go Market"}
+
+// userParty names a user on an invoice.
+func userParty(ctx context.Context, uid primitive.ObjectID) models.Party {
+	var user models.User
+	if err := CollectionDB(Client, "users").FindOne(ctx, bson.M{"id": uid}).Decode(&user); err != nil {
+		log.Println("invoice party:", err)
+		return models.Party{Name: uid.Hex()}
+	}
+	p := models.Party{Name: uid.Hex()}
+	if user.FirstName != nil && user.LastName != nil {
+		p.Name = strings.TrimSpace(*user.FirstName + " " + *user.LastName)
+	}
+	if user.Email != nil {
+		p.Email = *user.Email
+	}
+	return p
+}
+
+// nextNumber takes the next number in the sequence of kind for seller, the
+// marketplace when nil. It must run in the transaction that issues the
+// document, so an aborted issue gives its number back and the sequence
+// stays without gaps.
+func nextNumber(sc mongo.SessionContext, kind string, seller *primitive.ObjectID) (string, error) {
+	prefix, key := "INV", kind+":marketplace"
+	if kind == models.KindCreditNote {
+		prefix = "CN"
+	}
+	if seller != nil {
+		prefix += "-" + strings.ToUpper(seller.Hex())
+		key = kind + ":" + seller.Hex()
+	}
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := InvoiceCounters.FindOneAndUpdate(sc, bson.M{"id": key}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&counter)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%06d", prefix, counter.Seq), nil
+}
+
+// issue numbers and stores a document. Another issue of the same document
+// that got there first wins, and is what filter finds.
+func issue(ctx context.Context, inv models.Invoice, filter bson.M) (models.Invoice, error) {
+	err := Transact(ctx, func(sc mongo.SessionContext) error {
+		number, err := nextNumber(sc, inv.Kind, inv.Seller)
+		if err != nil {
+			return err
+		}
+		inv.Number = number
+		inv.IssuedAt = time.Now()
+		_, err = Invoices.InsertOne(sc, inv)
+		return err
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		err = Invoices.FindOne(ctx, filter).Decode(&inv)
+	}
+	return inv, err
+}
+
+// IssueInvoice returns the invoice of a paid order, issuing it the first
+// time it is asked for. Orders are invoiced when they are paid, so this
+// only issues those paid before invoices existed. A split order has no
+// invoice of its own; each sub-order is invoiced by its seller.
+func IssueInvoice(ctx context.Context, order models.Order) (models.Invoice, error) {
+	var inv models.Invoice
+	if len(order.SubOrderIDs) > 0 {
+		return inv, ErrSplitOrder
+	}
+	filter := bson.M{"orderId": order.ID, "kind": models.KindInvoice}
+	err := Invoices.FindOne(ctx, filter).Decode(&inv)
+	if err != mongo.ErrNoDocuments {
+		return inv, err
+	}
+	if !wasPaid(order) {
+		return inv, ErrNotInvoiceable
+	}
+
+	to := order.Price.Currency
+	inv = models.Invoice{
+		ID:        primitive.NewObjectID(),
+		Kind:      models.KindInvoice,
+		Seller:    order.Seller,
+		OrderID:   order.ID,
+		UID:       order.UID,
+		From:      InvoiceIssuer,
+		To:        userParty(ctx, order.UID),
+		ShipTo:    order.ShipTo,
+		Lines:     make([]models.InvoiceLine, 0, len(order.Cart)),
+		Subtotal:  order.Subtotal,
+		Discounts: order.Promotions,
+		Shipping:  order.Shipping,
+		TaxTotal:  models.Money{Currency: to},
+		Total:     order.Price,
+		OrderTime: order.OrderTime,
+	}
+	if order.Seller != nil {
+		inv.From = userParty(ctx, *order.Seller)
+	}
+	inv.To.Address = order.ShipTo
+	if order.BillTo != nil {
+		inv.To.Address = order.BillTo
+	}
+	if len(inv.Discounts) == 0 && order.DC != nil && order.DC.Amount > 0 {
+		inv.Discounts = []models.AppliedDiscount{{Name: "Discount", Amount: *order.DC}}
+	}
+	if order.TaxTotal != nil {
+		inv.TaxTotal = *order.TaxTotal
+	}
+
+	for _, item := range order.Cart {
+		unit, err := currency.Convert(item.Price, to)
+		if err != nil {
+			return inv, err
+		}
+		desc := item.ID.Hex()
+		if item.Name != nil {
+			desc = *item.Name
+		}
+		inv.Lines = append(inv.Lines, models.InvoiceLine{ID: item.ID, Variant: item.Variant, Description: desc, Quantity: item.Units(), UnitPrice: &unit, Total: unit.Mul(item.Units())})
+	}
+	// one tax line per rate rather than per order line
+	for _, t := range order.Tax {
+		amount, err := currency.Convert(t.Tax, to)
+		if err != nil {
+			return inv, err
+		}
+		merged := false
+		for i := range inv.Tax {
+			if inv.Tax[i].Name == t.Name && inv.Tax[i].Rate == t.Rate && inv.Tax[i].Inclusive == t.Inclusive {
+				inv.Tax[i].Amount.Amount += amount.Amount
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			inv.Tax = append(inv.Tax, models.InvoiceTax{Name: t.Name, Rate: t.Rate, Inclusive: t.Inclusive, Amount: amount})
+		}
+	}
+	return issue(ctx, inv, filter)
+}
+
+// IssueCreditNote returns the credit note for a refund that went through,
+// issuing it, and the order's invoice if need be, the first time. Its tax
+// is the invoice's, in the share of the total that was refunded.
+func IssueCreditNote(ctx context.Context, order models.Order, refund models.Refund) (models.Invoice, error) {
+	var note models.Invoice
+	filter := bson.M{"refundId": refund.ID, "kind": models.KindCreditNote}
+	err := Invoices.FindOne(ctx, filter).Decode(&note)
+	if err != mongo.ErrNoDocuments {
+		return note, err
+	}
+	if refund.Status != models.RefundSucceeded {
+		return note, ErrInvalidRefund
+	}
+	inv, err := IssueInvoice(ctx, order)
+	if err != nil {
+		return note, err
+	}
+
+	note = models.Invoice{
+		ID:        primitive.NewObjectID(),
+		Kind:      models.KindCreditNote,
+		Seller:    inv.Seller,
+		OrderID:   order.ID,
+		RefundID:  &refund.ID,
+		Credits:   inv.Number,
+		UID:       inv.UID,
+		From:      inv.From,
+		To:        inv.To,
+		Lines:     make([]models.InvoiceLine, 0, len(refund.Lines)+1),
+		Subtotal:  refund.Amount,
+		TaxTotal:  models.Money{Currency: refund.Amount.Currency},
+		Total:     refund.Amount,
+		Reason:    refund.Reason,
+		OrderTime: inv.OrderTime,
+	}
+	lines := int64(0)
+	for _, l := range refund.Lines {
+		desc := l.ID.Hex()
+		if l.Name != nil {
+			desc = *l.Name
+		}
+		note.Lines = append(note.Lines, models.InvoiceLine{ID: l.ID, Variant: l.Variant, Description: desc, Quantity: l.Quantity, Total: l.Amount})
+		lines += l.Amount.Amount
+	}
+	if rest := refund.Amount.Amount - lines; rest > 0 {
+		note.Lines = append(note.Lines, models.InvoiceLine{Description: "Shipping and adjustments", Quantity: 1, Total: models.Money{Amount: rest, Currency: refund.Amount.Currency}})
+	}
+	if inv.Total.Amount > 0 {
+		for _, t := range inv.Tax {
+			v := new(big.Rat).SetFrac64(t.Amount.Amount, inv.Total.Amount)
+			v.Mul(v, new(big.Rat).SetInt64(refund.Amount.Amount))
+			t.Amount.Amount = currency.Round(v, currency.Rule{Mode: currency.Down})
+			note.Tax = append(note.Tax, t)
+			note.TaxTotal.Amount += t.Amount.Amount
+		}
+	}
+	return issue(ctx, note, filter)
+}
+
+// CreditNotes lists the credit notes of an order, oldest first, issuing
+// any missing for refunds made before credit notes existed.
+func CreditNotes(ctx context.Context, order models.Order) ([]models.Invoice, error) {
+	out := make([]models.Invoice, 0)
+	cur, err := Refunds.Find(ctx, bson.M{"orderId": order.ID, "status": models.RefundSucceeded})
+	if err != nil {
+		return out, err
+	}
+	var refunds []models.Refund
+	if err := cur.All(ctx, &refunds); err != nil {
+		return out, err
+	}
+	for _, r := range refunds {
+		if _, err := IssueCreditNote(ctx, order, r); err != nil {
+			return out, err
+		}
+	}
+	cur, err = Invoices.Find(ctx, bson.M{"orderId": order.ID, "kind": models.KindCreditNote}, options.Find().SetSort(bson.D{{Key: "issuedAt", Value: 1}}))
+	if err != nil {
+		return out, err
+	}
+	err = cur.All(ctx, &out)
+	return out, err
+}
@@ -0,0 +1,301 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// toMoney builds an aggregation expression turning a legacy float price at
+// path into {amount, currency}. Documents that were already migrated pass
+// through unchanged, so every migration here is safe to run on each start.
+func toMoney(path string) bson.M {
+	return bson.M{"$cond": bson.A{
+		bson.M{"$isNumber": path},
+		bson.M{
+			"amount":   bson.M{"$toLong": bson.M{"$round": bson.A{bson.M{"$multiply": bson.A{path, 100}}, 0}}},
+			"currency": models.DefaultCurrency,
+		},
+		path,
+	}}
+}
+
+func mapPrices(array string, item string) bson.M {
+	set := bson.M{"price": toMoney("$$" + item + ".price")}
+	return bson.M{"$map": bson.M{
+		"input": bson.M{"$ifNull": bson.A{array, bson.A{}}},
+		"as":    item,
+		"in":    bson.M{"$mergeObjects": bson.A{"$$" + item, set}},
+	}}
+}
+
+// MigrateMoney converts float prices written before prices became
+// models.Money on products, carts, orders and the price history.
+func MigrateMoney(client *mongo.Client, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	database := client.Database(name)
+	number := bson.M{"$type": "number"}
+
+	res, err := database.Collection("products").UpdateMany(ctx,
+		bson.M{"price": number},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"price": toMoney("$price")}}}})
+	if err != nil {
+		return err
+	}
+	log.Println("money migration: products", res.ModifiedCount)
+
+	orders := bson.M{"$map": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$status", bson.A{}}},
+		"as":    "o",
+		"in": bson.M{"$mergeObjects": bson.A{"$$o", bson.M{
+			"price": toMoney("$$o.price"),
+			"cart":  mapPrices("$$o.cart", "c"),
+		}}},
+	}}
+	res, err = database.Collection("users").UpdateMany(ctx,
+		bson.M{"$or": bson.A{bson.M{"cart.price": number}, bson.M{"status.price": number}, bson.M{"status.cart.price": number}}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"cart": mapPrices("$cart", "c"), "status": orders}}}})
+	if err != nil {
+		return err
+	}
+	log.Println("money migration: users", res.ModifiedCount)
+
+	res, err = database.Collection("priceHistory").UpdateMany(ctx,
+		bson.M{"$or": bson.A{bson.M{"oldPrice": number}, bson.M{"newPrice": number}}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"oldPrice": toMoney("$oldPrice"), "newPrice": toMoney("$newPrice")}}}})
+	if err != nil {
+		return err
+	}
+	log.Println("money migration: price history", res.ModifiedCount)
+
+	res, err = database.Collection("priceSchedules").UpdateMany(ctx,
+		bson.M{"$or": bson.A{bson.M{"price": number}, bson.M{"regular": number}}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"price": toMoney("$price"), "regular": toMoney("$regular")}}}})
+	if err != nil {
+		return err
+	}
+	log.Println("money migration: price schedules", res.ModifiedCount)
+
+	return nil
+}
+
+// MigrateCartQuantities folds the copies carts used to hold for each unit
+// into one line per product with a quantity, and gives order lines and
+// saved items an explicit quantity and variant.
+func MigrateCartQuantities(client *mongo.Client, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	database := client.Database(name)
+	users := database.Collection("users")
+	legacy := bson.M{"$elemMatch": bson.M{"quantity": bson.M{"$exists": false}}}
+
+	cur, err := users.Find(ctx, bson.M{"cart": legacy}, options.Find().SetProjection(bson.M{"id": 1, "cart": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	var merged int
+	for cur.Next(ctx) {
+		var user struct {
+			ID   primitive.ObjectID `bson:"id"`
+			Cart []models.UserProd  `bson:"cart"`
+		}
+		if err := cur.Decode(&user); err != nil {
+			return err
+		}
+		_, err := users.UpdateOne(ctx, bson.M{"id": user.ID}, bson.M{"$set": bson.M{"cart": MergeLines(user.Cart)}})
+		if err != nil {
+			return err
+		}
+		merged++
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	log.Println("quantity migration: carts", merged)
+
+	line := func(item string) bson.M {
+		return bson.M{"$mergeObjects": bson.A{"$$" + item, bson.M{
+			"quantity": bson.M{"$ifNull": bson.A{"$$" + item + ".quantity", 1}},
+			"variant":  bson.M{"$ifNull": bson.A{"$$" + item + ".variant", ""}},
+		}}}
+	}
+	lines := func(array string, item string) bson.M {
+		return bson.M{"$map": bson.M{"input": bson.M{"$ifNull": bson.A{array, bson.A{}}}, "as": item, "in": line(item)}}
+	}
+
+	orders := bson.M{"$map": bson.M{
+		"input": "$status",
+		"as":    "o",
+		"in":    bson.M{"$mergeObjects": bson.A{"$$o", bson.M{"cart": lines("$$o.cart", "c")}}},
+	}}
+	res, err := users.UpdateMany(ctx, bson.M{"status.cart": legacy}, mongo.Pipeline{{{Key: "$set", Value: bson.M{"status": orders}}}})
+	if err != nil {
+		return err
+	}
+	log.Println("quantity migration: orders", res.ModifiedCount)
+
+	res, err = database.Collection("wishlists").UpdateMany(ctx, bson.M{"items": legacy}, mongo.Pipeline{{{Key: "$set", Value: bson.M{"items": lines("$items", "i")}}}})
+	if err != nil {
+		return err
+	}
+	log.Println("quantity migration: wishlists", res.ModifiedCount)
+
+	return nil
+}
+
+// MigrateCarts moves carts out of the user documents into the carts
+// collection, folding them into any cart the user already has there.
+func MigrateCarts(client *mongo.Client, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	database := client.Database(name)
+	users := database.Collection("users")
+	carts := database.Collection("carts")
+
+	cur, err := users.Find(ctx, bson.M{"cart": bson.M{"$exists": true}}, options.Find().SetProjection(bson.M{"id": 1, "cart": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	var moved int
+	for cur.Next(ctx) {
+		var user struct {
+			ID   primitive.ObjectID `bson:"id"`
+			Cart []models.UserProd  `bson:"cart"`
+		}
+		if err := cur.Decode(&user); err != nil {
+			return err
+		}
+		if len(user.Cart) > 0 {
+			var existing models.Cart
+			_ = carts.FindOne(ctx, bson.M{"uid": user.ID}).Decode(&existing)
+			update := bson.M{
+				"$set":         bson.M{"items": MergeLines(existing.Items, user.Cart), "updatedAt": time.Now()},
+				"$setOnInsert": bson.M{"id": primitive.NewObjectID()},
+			}
+			_, err := carts.UpdateOne(ctx, bson.M{"uid": user.ID}, update, options.Update().SetUpsert(true))
+			if err != nil {
+				return err
+			}
+			moved++
+		}
+		_, err := users.UpdateOne(ctx, bson.M{"id": user.ID}, bson.M{"$unset": bson.M{"cart": ""}})
+		if err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	log.Println("cart migration: carts", moved)
+
+	return nil
+}
+
+// MigrateOrders moves the orders embedded in users.status into the orders
+// collection, stamping each with its buyer. Orders already moved are left
+// alone, so a run cut short can simply be repeated. Orders from before the
+// lifecycle start out awaiting payment.
+func MigrateOrders(client *mongo.Client, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	database := client.Database(name)
+	users := database.Collection("users")
+	orders := database.Collection("orders")
+
+	cur, err := users.Find(ctx, bson.M{"status": bson.M{"$exists": true}}, options.Find().SetProjection(bson.M{"id": 1, "status": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	var moved int
+	for cur.Next(ctx) {
+		var user struct {
+			ID     primitive.ObjectID `bson:"id"`
+			Status []bson.M           `bson:"status"`
+		}
+		if err := cur.Decode(&user); err != nil {
+			return err
+		}
+		for _, order := range user.Status {
+			id, ok := order["id"].(primitive.ObjectID)
+			if !ok {
+				id = primitive.NewObjectID()
+				order["id"] = id
+			}
+			order["uid"] = user.ID
+			if order["cart"] == nil {
+				order["cart"] = bson.A{}
+			}
+			if _, ok := order["subtotal"]; !ok {
+				order["subtotal"] = order["price"]
+			}
+			_, err := orders.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$setOnInsert": order}, options.Update().SetUpsert(true))
+			if err != nil {
+				return err
+			}
+			moved++
+		}
+		_, err := users.UpdateOne(ctx, bson.M{"id": user.ID}, bson.M{"$unset": bson.M{"status": ""}})
+		if err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	log.Println("order migration: orders", moved)
+
+	opened := bson.A{bson.M{"to": models.OrderPendingPayment, "at": "$orderTime", "by": "migration"}}
+	set := bson.M{"status": models.OrderPendingPayment, "history": opened}
+	res, err := orders.UpdateMany(ctx, bson.M{"status": bson.M{"$exists": false}}, mongo.Pipeline{{{Key: "$set", Value: set}}})
+	if err != nil {
+		return err
+	}
+	log.Println("order migration: lifecycle", res.ModifiedCount)
+
+	return nil
+}
+
+// MigrateAddresses labels the addresses stored while there could only be a
+// home and a work address, in that order, and makes the first one the
+// default for shipping and billing. Users with any labeled address are
+// left alone.
+func MigrateAddresses(client *mongo.Client, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	users := client.Database(name).Collection("users")
+	first := bson.M{"$eq": bson.A{"$$i", 0}}
+	addrs := bson.M{"$map": bson.M{
+		"input": bson.M{"$range": bson.A{0, bson.M{"$size": "$addressInfo"}}},
+		"as":    "i",
+		"in": bson.M{"$mergeObjects": bson.A{bson.M{"$arrayElemAt": bson.A{"$addressInfo", "$$i"}}, bson.M{
+			"label":           bson.M{"$cond": bson.A{first, "home", bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$$i", 1}}, "work", ""}}}},
+			"name":            "",
+			"phone":           "",
+			"defaultShipping": first,
+			"defaultBilling":  first,
+		}}},
+	}}
+	filter := bson.M{"addressInfo.0": bson.M{"$exists": true}, "addressInfo.label": bson.M{"$exists": false}}
+	res, err := users.UpdateMany(ctx, filter, mongo.Pipeline{{{Key: "$set", Value: bson.M{"addressInfo": addrs}}}})
+	if err != nil {
+		return err
+	}
+	log.Println("address migration: users", res.ModifiedCount)
+
+	return nil
+}
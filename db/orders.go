@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidOrder    = errors.New("order not found")
+	ErrOrderTransition = errors.New("order can not move to that state")
+)
+
+// openOrder starts a new order's lifecycle awaiting payment.
+func openOrder(order *models.Order, by string) {
+	order.Status = models.OrderPendingPayment
+	order.History = []models.OrderTransition{{To: models.OrderPendingPayment, At: order.OrderTime, By: by}}
+}
+
+// AdvanceOrder moves an order to state to, recording who moved it in its
+// history. With seller set, only that seller's orders are found. The move
+// only applies if the order is still in the state it was read in, so two
+// concurrent moves can not both succeed; the loser gets ErrOrderTransition
+// with the order as it is now. A split order is only ever moved to paid
+// here, which pays its sub-orders too; the rest of the way it follows its
+// sub-orders, which can not be paid on their own.
+func AdvanceOrder(ctx context.Context, oid primitive.ObjectID, seller *primitive.ObjectID, to, by, note string) (models.Order, error) {
+	filter := bson.M{"id": oid}
+	if seller != nil {
+		filter["seller"] = *seller
+	}
+	var order models.Order
+	if err := Orders.FindOne(ctx, filter).Decode(&order); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return order, ErrInvalidOrder
+		}
+		return order, err
+	}
+	if (len(order.SubOrderIDs) > 0 && to != models.OrderPaid) || (order.ParentID != nil && to == models.OrderPaid) {
+		return order, ErrSplitOrder
+	}
+	return moveOrder(ctx, order, filter, to, by, note)
+}
+
+// moveOrder makes the move AdvanceOrder checked, on the order found by
+// filter.
+func moveOrder(ctx context.Context, order models.Order, filter bson.M, to, by, note string) (models.Order, error) {
+	if err := models.CanMove(order.Status, to); err != nil {
+		return order, ErrOrderTransition
+	}
+
+	step := models.OrderTransition{From: order.Status, To: to, At: time.Now(), By: by, Note: note}
+	filter["status"] = order.Status
+	update := bson.M{"$set": bson.M{"status": to}, "$push": bson.M{"history": step}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := Orders.FindOneAndUpdate(ctx, filter, update, opts).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		if err := Orders.FindOne(ctx, bson.M{"id": order.ID}).Decode(&order); err != nil {
+			log.Println(err)
+		}
+		return order, ErrOrderTransition
+	}
+	if err != nil {
+		return order, err
+	}
+	switch {
+	case len(order.SubOrderIDs) > 0:
+		payChildren(ctx, order, by)
+	case to == models.OrderPaid:
+		// paid orders are invoiced right away, so invoice numbers follow
+		// the order they were paid in
+		if _, err := IssueInvoice(ctx, order); err != nil {
+			log.Println("issue invoice:", err)
+		}
+	}
+	if order.ParentID != nil {
+		if err := rollUp(ctx, *order.ParentID); err != nil {
+			log.Println("roll up order:", err)
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,270 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"github.com/cyzhang39/go_market/payment"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrOrderNotPayable = errors.New("order is not awaiting payment")
+	ErrPaymentDeclined = errors.New("payment declined")
+	ErrInvalidIntent   = errors.New("payment not found")
+)
+
+// payFrom lists the states a payment intent may be in for an event to move
+// it to a state. Events that arrive late, or repeat, leave it alone.
+var payFrom = map[string][]string{
+	models.PayAuthorized: {models.PayCreated, models.PayRequiresAction},
+	models.PayCaptured:   {models.PayCreated, models.PayRequiresAction, models.PayAuthorized},
+	models.PayDeclined:   {models.PayCreated, models.PayRequiresAction},
+	models.PayVoided:     {models.PayCreated, models.PayRequiresAction, models.PayAuthorized},
+	models.PayRefunded:   {models.PayCaptured, models.PayRefunded},
+}
+
+var eventStatus = map[string]string{
+	payment.EventAuthorized: models.PayAuthorized,
+	payment.EventCaptured:   models.PayCaptured,
+	payment.EventFailed:     models.PayDeclined,
+	payment.EventVoided:     models.PayVoided,
+	payment.EventRefunded:   models.PayRefunded,
+}
+
+// saveResult records what the provider answered on the intent.
+func saveResult(ctx context.Context, intent *models.PaymentIntent, res payment.Result) error {
+	intent.Ref = res.Ref
+	intent.Status = res.Status
+	intent.Action = res.Action
+	intent.Reason = res.Reason
+	intent.UpdatedAt = time.Now()
+	set := bson.M{"ref": intent.Ref, "status": intent.Status, "action": intent.Action, "reason": intent.Reason, "updatedAt": intent.UpdatedAt}
+	_, err := PaymentIntents.UpdateOne(ctx, bson.M{"id": intent.ID}, bson.M{"$set": set})
+	return err
+}
+
+// PayOrder pays for an order awaiting payment with method, through the
+// default provider. An authorized payment is captured right away; the order
+// only turns paid once the provider confirms the capture on its webhook. A
+// payment that needs a challenge comes back requires_action with the URL to
+// send the buyer to.
+func PayOrder(ctx context.Context, order models.Order, method string) (models.PaymentIntent, error) {
+	var intent models.PaymentIntent
+	if order.Status != models.OrderPendingPayment || order.ParentID != nil {
+		return intent, ErrOrderNotPayable
+	}
+	settled := bson.M{"orderId": order.ID, "status": bson.M{"$in": bson.A{models.PayAuthorized, models.PayCaptured}}}
+	n, err := PaymentIntents.CountDocuments(ctx, settled)
+	if err != nil {
+		return intent, err
+	}
+	if n > 0 {
+		return intent, ErrOrderNotPayable
+	}
+	p, err := payment.Default()
+	if err != nil {
+		return intent, err
+	}
+
+	now := time.Now()
+	intent = models.PaymentIntent{
+		ID:        primitive.NewObjectID(),
+		OrderID:   order.ID,
+		UID:       order.UID,
+		Provider:  p.Name(),
+		Amount:    order.Price,
+		Refunded:  models.Money{Currency: order.Price.Currency},
+		Status:    models.PayCreated,
+		Events:    make([]string, 0),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	// only one payment can take over from the order's current one, so two
+	// attempts at once can not both go through
+	claim := bson.M{"id": order.ID, "status": models.OrderPendingPayment, "payment.intentId": order.Payment.IntentID}
+	if order.Payment.IntentID == nil {
+		claim["payment.intentId"] = bson.M{"$exists": false}
+	}
+	pay := models.Payment{Online: true, Provider: p.Name(), IntentID: &intent.ID}
+	res, err := Orders.UpdateOne(ctx, claim, bson.M{"$set": bson.M{"payment": pay}})
+	if err != nil {
+		return intent, err
+	}
+	if res.MatchedCount == 0 {
+		return intent, ErrOrderNotPayable
+	}
+	if _, err := PaymentIntents.InsertOne(ctx, intent); err != nil {
+		return intent, err
+	}
+
+	result, err := p.Authorize(ctx, payment.Request{Reference: intent.ID.Hex(), Amount: intent.Amount, Method: method})
+	if err != nil {
+		log.Println(err)
+		_ = saveResult(ctx, &intent, payment.Result{Status: models.PayDeclined, Reason: "payment provider unavailable"})
+		return intent, err
+	}
+	if err := saveResult(ctx, &intent, result); err != nil {
+		return intent, err
+	}
+	if result.Status == models.PayAuthorized {
+		result, err = p.Capture(ctx, result.Ref, intent.Amount)
+		if err != nil {
+			log.Println(err)
+			return intent, err
+		}
+		if err := saveResult(ctx, &intent, result); err != nil {
+			return intent, err
+		}
+	}
+	if intent.Status == models.PayDeclined {
+		return intent, ErrPaymentDeclined
+	}
+	return intent, nil
+}
+
+// ApplyPaymentEvent applies a verified webhook event of provider to its
+// payment intent. Each event is applied once however often it is delivered.
+// A payment authorized after a challenge is captured, and a captured one
+// moves its order to paid.
+func ApplyPaymentEvent(ctx context.Context, provider string, ev payment.Event) error {
+	status, ok := eventStatus[ev.Type]
+	if !ok {
+		// not an event we act on
+		return nil
+	}
+	filter := bson.M{"provider": provider, "ref": ev.Ref}
+	if id, err := primitive.ObjectIDFromHex(ev.Reference); err == nil {
+		filter = bson.M{"provider": provider, "id": id}
+	}
+	var intent models.PaymentIntent
+	if err := PaymentIntents.FindOne(ctx, filter).Decode(&intent); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrInvalidIntent
+		}
+		return err
+	}
+	for _, seen := range intent.Events {
+		if seen == ev.ID {
+			return nil
+		}
+	}
+
+	set := bson.M{"updatedAt": time.Now()}
+	if ev.Ref != "" {
+		set["ref"] = ev.Ref
+	}
+	moved := allowed(payFrom[status], intent.Status)
+	if moved {
+		set["status"] = status
+		set["action"] = ""
+		if ev.Reason != "" {
+			set["reason"] = ev.Reason
+		}
+	} else {
+		status = intent.Status
+	}
+	if ev.Type == payment.EventRefunded && status == models.PayRefunded {
+		refunded, err := intent.Refunded.Add(ev.Amount)
+		if err != nil {
+			return err
+		}
+		set["refunded"] = refunded
+		if refunded.Amount < intent.Amount.Amount {
+			// partly refunded payments stay captured
+			set["status"] = models.PayCaptured
+		}
+	}
+	// the event id and the state read above guard against a concurrent
+	// delivery of the same or another event
+	guard := bson.M{"id": intent.ID, "status": intent.Status, "events": bson.M{"$ne": ev.ID}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := PaymentIntents.FindOneAndUpdate(ctx, guard, bson.M{"$set": set, "$push": bson.M{"events": ev.ID}}, opts).Decode(&intent)
+	if err == mongo.ErrNoDocuments {
+		return ApplyPaymentEvent(ctx, provider, ev)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case ev.Type == payment.EventAuthorized && moved && intent.Status == models.PayAuthorized:
+		p, err := payment.Get(provider)
+		if err != nil {
+			return err
+		}
+		var order models.Order
+		if err := Orders.FindOne(ctx, bson.M{"id": intent.OrderID}).Decode(&order); err != nil {
+			return err
+		}
+		if order.Status != models.OrderPendingPayment {
+			return release(ctx, p, &intent)
+		}
+		res, err := p.Capture(ctx, intent.Ref, intent.Amount)
+		if err != nil {
+			return err
+		}
+		return saveResult(ctx, &intent, res)
+	case ev.Type == payment.EventCaptured && moved:
+		_, err := AdvanceOrder(ctx, intent.OrderID, nil, models.OrderPaid, "payment:"+provider, "")
+		if err != ErrOrderTransition {
+			return err
+		}
+		log.Println("payment captured for order not awaiting payment:", intent.OrderID.Hex())
+		p, err := payment.Get(provider)
+		if err != nil {
+			return err
+		}
+		return release(ctx, p, &intent)
+	}
+	return nil
+}
+
+// release gives back a payment settled for an order that no longer awaits
+// it, such as one cancelled while the buyer was still passing a challenge:
+// voided while only authorized, refunded in full once captured. The outcome
+// is kept on the intent, a failure in its reason for someone to settle by
+// hand, since the provider does not send the event again.
+func release(ctx context.Context, p payment.Provider, intent *models.PaymentIntent) error {
+	var res payment.Result
+	var err error
+	if intent.Status == models.PayCaptured {
+		res, err = p.Refund(ctx, intent.Ref, intent.Amount)
+	} else {
+		res, err = p.Void(ctx, intent.Ref)
+	}
+	if err != nil {
+		log.Println("release payment:", intent.ID.Hex(), err)
+		set := bson.M{"reason": "order not awaiting payment, release failed: " + err.Error(), "updatedAt": time.Now()}
+		_, err = PaymentIntents.UpdateOne(ctx, bson.M{"id": intent.ID}, bson.M{"$set": set})
+		return err
+	}
+	res.Reason = "order not awaiting payment"
+	return saveResult(ctx, intent, res)
+}
+
+func allowed(states []string, state string) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderPayments lists the payment attempts for an order, newest first.
+func OrderPayments(ctx context.Context, oid primitive.ObjectID) ([]models.PaymentIntent, error) {
+	out := make([]models.PaymentIntent, 0)
+	cur, err := PaymentIntents.Find(ctx, bson.M{"orderId": oid}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		return out, err
+	}
+	err = cur.All(ctx, &out)
+	return out, err
+}
@@ -0,0 +1,197 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	SchedulePending   = "pending"
+	ScheduleActive    = "active"
+	ScheduleDone      = "done"
+	ScheduleCancelled = "cancelled"
+)
+
+const (
+	PriceListed    = "listed"
+	PriceEdit      = "edit"
+	PriceScheduled = "scheduled"
+	PriceSaleStart = "sale_start"
+	PriceSaleEnd   = "sale_end"
+)
+
+var (
+	ErrScheduleOverlap = errors.New("sale overlaps an existing sale")
+	ErrScheduleInvalid = errors.New("schedule not found or already applied")
+)
+
+func RecordPrice(ctx context.Context, pid primitive.ObjectID, old models.Money, price models.Money, reason string, by *primitive.ObjectID) error {
+	change := models.PriceChange{
+		ID:        primitive.NewObjectID(),
+		PID:       pid,
+		OldPrice:  old,
+		NewPrice:  price,
+		Reason:    reason,
+		ChangedBy: by,
+		ChangedAt: time.Now(),
+	}
+	_, err := PriceHistory.InsertOne(ctx, change)
+	return err
+}
+
+// swapPrice sets the price of the product matched by filter and records the
+// change. It reports false when nothing matched.
+func swapPrice(ctx context.Context, products *mongo.Collection, filter bson.M, price models.Money, reason string, by *primitive.ObjectID) (bool, error) {
+	var prev models.Product
+	update := bson.M{"$set": bson.M{"price": price}}
+	err := products.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&prev)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	old := models.Money{Currency: price.Currency}
+	if prev.Price != nil {
+		old = *prev.Price
+	}
+	if old == price {
+		return true, nil
+	}
+	return true, RecordPrice(ctx, prev.ID, old, price, reason, by)
+}
+
+func SetPrice(ctx context.Context, products *mongo.Collection, pid primitive.ObjectID, price models.Money, reason string, by *primitive.ObjectID) error {
+	ok, err := swapPrice(ctx, products, bson.M{"id": pid}, price, reason, by)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if !ok {
+		return ErrInvalidProduct
+	}
+	return nil
+}
+
+func SchedulePrice(ctx context.Context, s models.PriceSchedule) error {
+	if s.EndAt != nil {
+		overlap := bson.M{
+			"pid":     s.PID,
+			"status":  bson.M{"$in": []string{SchedulePending, ScheduleActive}},
+			"endAt":   bson.M{"$gt": s.StartAt},
+			"startAt": bson.M{"$lt": *s.EndAt},
+		}
+		cnt, err := PriceSchedules.CountDocuments(ctx, overlap)
+		if err != nil {
+			return err
+		}
+		if cnt > 0 {
+			return ErrScheduleOverlap
+		}
+	}
+	_, err := PriceSchedules.InsertOne(ctx, s)
+	return err
+}
+
+func CancelSchedule(ctx context.Context, pid primitive.ObjectID, sid primitive.ObjectID) error {
+	idx := bson.M{"id": sid, "pid": pid, "status": SchedulePending}
+	update := bson.M{"$set": bson.M{"status": ScheduleCancelled}}
+	res, err := PriceSchedules.UpdateOne(ctx, idx, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrScheduleInvalid
+	}
+	return nil
+}
+
+// ApplySchedules starts every schedule that is due and reverts sales whose
+// window has closed. A sale is only reverted while the product still carries
+// the sale price, so a manual edit made during the sale wins.
+func ApplySchedules(ctx context.Context, products *mongo.Collection, now time.Time) error {
+	due, err := PriceSchedules.Find(ctx, bson.M{"status": SchedulePending, "startAt": bson.M{"$lte": now}}, options.Find().SetSort(bson.D{{Key: "startAt", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var starts []models.PriceSchedule
+	if err := due.All(ctx, &starts); err != nil {
+		return err
+	}
+
+	for _, s := range starts {
+		if s.EndAt != nil && !s.EndAt.After(now) {
+			// the whole sale window passed while nothing was running
+			_, _ = PriceSchedules.UpdateOne(ctx, bson.M{"id": s.ID}, bson.M{"$set": bson.M{"status": ScheduleDone}})
+			continue
+		}
+
+		var prod models.Product
+		if err := products.FindOne(ctx, bson.M{"id": s.PID}).Decode(&prod); err != nil {
+			log.Println("price schedule", s.ID.Hex(), err)
+			_, _ = PriceSchedules.UpdateOne(ctx, bson.M{"id": s.ID}, bson.M{"$set": bson.M{"status": ScheduleCancelled}})
+			continue
+		}
+		regular := models.Money{Currency: s.Price.Currency}
+		if prod.Price != nil {
+			regular = *prod.Price
+		}
+
+		reason, next := PriceScheduled, ScheduleDone
+		if s.EndAt != nil {
+			reason, next = PriceSaleStart, ScheduleActive
+		}
+		if err := SetPrice(ctx, products, s.PID, s.Price, reason, &s.CreatedBy); err != nil {
+			log.Println("price schedule", s.ID.Hex(), err)
+			continue
+		}
+		_, err = PriceSchedules.UpdateOne(ctx, bson.M{"id": s.ID}, bson.M{"$set": bson.M{"status": next, "regular": regular}})
+		if err != nil {
+			log.Println("price schedule", s.ID.Hex(), err)
+		}
+	}
+
+	ended, err := PriceSchedules.Find(ctx, bson.M{"status": ScheduleActive, "endAt": bson.M{"$lte": now}})
+	if err != nil {
+		return err
+	}
+	var ends []models.PriceSchedule
+	if err := ended.All(ctx, &ends); err != nil {
+		return err
+	}
+
+	for _, s := range ends {
+		_, err := swapPrice(ctx, products, bson.M{"id": s.PID, "price": s.Price}, s.Regular, PriceSaleEnd, &s.CreatedBy)
+		if err != nil {
+			log.Println("price schedule", s.ID.Hex(), err)
+			continue
+		}
+		_, err = PriceSchedules.UpdateOne(ctx, bson.M{"id": s.ID}, bson.M{"$set": bson.M{"status": ScheduleDone}})
+		if err != nil {
+			log.Println("price schedule", s.ID.Hex(), err)
+		}
+	}
+	return nil
+}
+
+func PriceScheduler(products *mongo.Collection, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := ApplySchedules(ctx, products, time.Now()); err != nil {
+			log.Println("price scheduler:", err)
+		}
+		cancel()
+		<-tick.C
+	}
+}
@@ -0,0 +1,220 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"github.com/cyzhang39/go_market/promo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidCoupon      = errors.New("unknown coupon code")
+	ErrCouponUsedUp       = errors.New("coupon has reached its usage limit")
+	ErrCouponNotStackable = errors.New("coupon can not be combined with the coupons already applied")
+)
+
+func CouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// usable returns why a promotion can not be used by the user any more, or
+// "" while it is within both its usage limits.
+func usable(ctx context.Context, p models.Promotion, uid primitive.ObjectID) string {
+	if p.UsageLimit > 0 && p.Used >= p.UsageLimit {
+		return ErrCouponUsedUp.Error()
+	}
+	if p.PerUserLimit > 0 {
+		n, err := PromotionUses.CountDocuments(ctx, bson.M{"promoId": p.ID, "uid": uid})
+		if err != nil {
+			log.Println(err)
+			return "coupon could not be checked"
+		}
+		if n >= p.PerUserLimit {
+			return "coupon already used the maximum number of times"
+		}
+	}
+	return ""
+}
+
+// ApplyCoupon puts a coupon code on the user's cart after checking it can
+// be used now. A coupon that does not stack can not share the cart.
+func ApplyCoupon(ctx context.Context, uid primitive.ObjectID, code string) (models.Promotion, error) {
+	code = CouponCode(code)
+	var p models.Promotion
+	if err := Promotions.FindOne(ctx, bson.M{"code": code}).Decode(&p); err != nil {
+		return p, ErrInvalidCoupon
+	}
+	if err := p.Live(time.Now()); err != nil {
+		return p, err
+	}
+	if reason := usable(ctx, p, uid); reason != "" {
+		return p, errors.New(reason)
+	}
+
+	key := CartKey{UID: uid}
+	cart, err := GetCart(ctx, key)
+	if err != nil {
+		return p, err
+	}
+	others := make([]string, 0)
+	for _, c := range cart.Coupons {
+		if c != code {
+			others = append(others, c)
+		}
+	}
+	if len(others) > 0 {
+		if !p.Stackable {
+			return p, ErrCouponNotStackable
+		}
+		n, err := Promotions.CountDocuments(ctx, bson.M{"code": bson.M{"$in": others}, "stackable": false})
+		if err != nil {
+			log.Println(err)
+			return p, ErrInvalidCart
+		}
+		if n > 0 {
+			return p, ErrCouponNotStackable
+		}
+	}
+
+	if err := ensureCart(ctx, key); err != nil {
+		return p, err
+	}
+	update := bson.M{"$addToSet": bson.M{"coupons": code}, "$set": bson.M{"updatedAt": time.Now()}}
+	if _, err := Carts.UpdateOne(ctx, key.filter(), update); err != nil {
+		log.Println(err)
+		return p, ErrInvalidCart
+	}
+	return p, nil
+}
+
+func RemoveCoupon(ctx context.Context, uid primitive.ObjectID, code string) error {
+	key := CartKey{UID: uid}
+	update := bson.M{"$pull": bson.M{"coupons": CouponCode(code)}, "$set": bson.M{"updatedAt": time.Now()}}
+	if _, err := Carts.UpdateOne(ctx, key.filter(), update); err != nil {
+		log.Println(err)
+		return ErrInvalidCart
+	}
+	return nil
+}
+
+// CartDiscounts prices a user's cart lines with the automatic promotions
+// and the coupons on the cart, totals in to.
+func CartDiscounts(ctx context.Context, uid primitive.ObjectID, items []models.UserProd, coupons []string, to string) (models.Discounts, error) {
+	now := time.Now()
+	filter := bson.M{"active": true, "code": bson.M{"$exists": false}}
+	if len(coupons) > 0 {
+		filter = bson.M{"$or": bson.A{filter, bson.M{"code": bson.M{"$in": coupons}}}}
+	}
+	cur, err := Promotions.Find(ctx, filter)
+	if err != nil {
+		log.Println(err)
+		return models.Discounts{}, ErrInvalidCart
+	}
+	var found []models.Promotion
+	if err := cur.All(ctx, &found); err != nil {
+		log.Println(err)
+		return models.Discounts{}, ErrInvalidCart
+	}
+
+	promos := make([]models.Promotion, 0, len(found))
+	rejected := make([]models.RejectedCoupon, 0)
+	seen := map[string]bool{}
+	for _, p := range found {
+		if reason := usable(ctx, p, uid); reason != "" {
+			if p.Code != "" {
+				rejected = append(rejected, models.RejectedCoupon{Code: p.Code, Reason: reason})
+			}
+			continue
+		}
+		seen[p.Code] = true
+		promos = append(promos, p)
+	}
+	for _, code := range coupons {
+		if !seen[code] && !rejectedCode(rejected, code) {
+			rejected = append(rejected, models.RejectedCoupon{Code: code, Reason: ErrInvalidCoupon.Error()})
+		}
+	}
+
+	out, err := promo.Evaluate(promos, items, to, now)
+	if err != nil {
+		log.Println(err)
+		return out, ErrInvalidCart
+	}
+	out.Rejected = append(rejected, out.Rejected...)
+	return out, nil
+}
+
+func rejectedCode(rejected []models.RejectedCoupon, code string) bool {
+	for _, r := range rejected {
+		if r.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// RedeemPromotions counts the promotions an order used against their limits
+// and records each use. It runs inside the checkout transaction, so if one
+// ran out in the meantime nothing it did is kept.
+func RedeemPromotions(ctx context.Context, uid primitive.ObjectID, orderID primitive.ObjectID, applied []models.AppliedDiscount) error {
+	now := time.Now()
+	for _, a := range applied {
+		idx := bson.M{"id": a.PromoID, "$or": bson.A{
+			bson.M{"usageLimit": 0},
+			bson.M{"$expr": bson.M{"$lt": bson.A{"$used", "$usageLimit"}}},
+		}}
+		var p models.Promotion
+		err := Promotions.FindOneAndUpdate(ctx, idx, bson.M{"$inc": bson.M{"used": 1}}).Decode(&p)
+		if err == mongo.ErrNoDocuments {
+			return ErrCouponUsedUp
+		}
+		if err != nil {
+			return err
+		}
+		if p.PerUserLimit > 0 {
+			if err := redeemForUser(ctx, p, uid); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, a := range applied {
+		use := models.PromotionUse{ID: primitive.NewObjectID(), PromoID: a.PromoID, UID: uid, OrderID: orderID, UsedAt: now}
+		if _, err := PromotionUses.InsertOne(ctx, use); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redeemForUser counts one more use of p by the user against its per user
+// limit. The count lives in a document of its own per promotion and user,
+// started from the uses recorded so far, so two checkouts by the same user
+// at once write the same document and one of them is retried.
+func redeemForUser(ctx context.Context, p models.Promotion, uid primitive.ObjectID) error {
+	n, err := PromotionUses.CountDocuments(ctx, bson.M{"promoId": p.ID, "uid": uid})
+	if err != nil {
+		return err
+	}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{"used": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$used", n}}, 1}}}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var counter struct {
+		Used int64 `bson:"used"`
+	}
+	err = PromotionUsers.FindOneAndUpdate(ctx, bson.M{"promoId": p.ID, "uid": uid}, update, opts).Decode(&counter)
+	if err != nil {
+		return err
+	}
+	if counter.Used > p.PerUserLimit {
+		return ErrCouponUsedUp
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/models"
+	"github.com/cyzhang39/go_market/payment"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrNotCancellable = errors.New("order can no longer be cancelled")
+	ErrNothingPaid    = errors.New("order has not been paid")
+	ErrInvalidRefund  = errors.New("refund is more than is left on the order")
+	ErrRefundFailed   = errors.New("payment provider refused the refund")
+)
+
+type lineKey struct {
+	id      primitive.ObjectID
+	variant string
+}
+
+// putStock gives the units of items back to the products that track stock.
+func putStock(ctx context.Context, products *mongo.Collection, items []models.UserProd) error {
+	for _, item := range items {
+		filter := bson.M{"id": item.ID, "stock": bson.M{"$type": "number"}}
+		if _, err := products.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"stock": item.Units()}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refundedUnits counts the units of each order line refunded so far, all of
+// them or only those put back into stock.
+func refundedUnits(ctx context.Context, oid primitive.ObjectID, restocked bool) (map[lineKey]int64, error) {
+	out := map[lineKey]int64{}
+	filter := bson.M{"orderId": oid, "status": bson.M{"$ne": models.RefundFailed}}
+	if restocked {
+		filter["restock"] = true
+	}
+	cur, err := Refunds.Find(ctx, filter)
+	if err != nil {
+		return out, err
+	}
+	var refunds []models.Refund
+	if err := cur.All(ctx, &refunds); err != nil {
+		return out, err
+	}
+	for _, r := range refunds {
+		for _, l := range r.Lines {
+			out[lineKey{l.ID, l.Variant}] += l.Quantity
+		}
+	}
+	return out, nil
+}
+
+// wasPaid reports whether the order ever reached paid.
+func wasPaid(order models.Order) bool {
+	for _, step := range order.History {
+		if step.To == models.OrderPaid {
+			return true
+		}
+	}
+	return false
+}
+
+// lineRefund works out what qty units of line get back: their share of what
+// the order charged for its items, which already has discounts taken off
+// and tax added. Shipping is only refunded with the last of the items.
+func lineRefund(order models.Order, line models.UserProd, qty int64) (models.Money, error) {
+	charged := order.Price
+	if order.Shipping != nil {
+		charged.Amount -= order.Shipping.Cost.Amount
+	}
+	items, err := currency.Total(order.Cart, charged.Currency)
+	if err != nil {
+		return models.Money{}, err
+	}
+	part, err := currency.Convert(line.Price.Mul(qty), charged.Currency)
+	if err != nil {
+		return models.Money{}, err
+	}
+	if items.Amount <= 0 {
+		return models.Money{Currency: charged.Currency}, nil
+	}
+	v := new(big.Rat).SetFrac64(charged.Amount, items.Amount)
+	v.Mul(v, new(big.Rat).SetInt64(part.Amount))
+	return models.Money{Amount: currency.Round(v, currency.Rule{Mode: currency.Down}), Currency: charged.Currency}, nil
+}
+
+// RefundOrder gives back the lines asked for, or everything left on the
+// order when full is set, through the payment the order was paid with.
+// Cash orders are refunded by hand and the refund only records it. Once
+// nothing is left the order moves to refunded, unless it was cancelled.
+func RefundOrder(ctx context.Context, products *mongo.Collection, order models.Order, lines []models.RefundLine, full bool, reason string, restock bool, by string) (models.Refund, error) {
+	var refund models.Refund
+	if len(order.SubOrderIDs) > 0 {
+		return refund, ErrSplitOrder
+	}
+	if !wasPaid(order) {
+		return refund, ErrNothingPaid
+	}
+	refunded := models.Money{Currency: order.Price.Currency}
+	if order.Refunded != nil {
+		refunded = *order.Refunded
+	}
+	left := order.Price.Amount - refunded.Amount
+	done, err := refundedUnits(ctx, order.ID, false)
+	if err != nil {
+		return refund, err
+	}
+
+	if full {
+		lines = lines[:0]
+		for _, item := range order.Cart {
+			if n := item.Units() - done[lineKey{item.ID, item.Variant}]; n > 0 {
+				lines = append(lines, models.RefundLine{ID: item.ID, Variant: item.Variant, Quantity: n})
+			}
+		}
+	}
+	amount := models.Money{Currency: order.Price.Currency}
+	remaining := int64(0)
+	for _, item := range order.Cart {
+		remaining += item.Units() - done[lineKey{item.ID, item.Variant}]
+	}
+	back := make([]models.UserProd, 0, len(lines))
+	for i, l := range lines {
+		var item *models.UserProd
+		for j := range order.Cart {
+			if order.Cart[j].ID == l.ID && order.Cart[j].Variant == l.Variant {
+				item = &order.Cart[j]
+				break
+			}
+		}
+		key := lineKey{l.ID, l.Variant}
+		if item == nil || l.Quantity < 1 || l.Quantity > item.Units()-done[key] {
+			return refund, ErrInvalidRefund
+		}
+		done[key] += l.Quantity
+		remaining -= l.Quantity
+		share, err := lineRefund(order, *item, l.Quantity)
+		if err != nil {
+			return refund, err
+		}
+		lines[i].Name = item.Name
+		lines[i].Amount = share
+		amount.Amount += share.Amount
+		unit := *item
+		unit.Quantity = l.Quantity
+		back = append(back, unit)
+	}
+	if full || remaining == 0 {
+		// the last items take shipping and the rounding left over with them
+		amount.Amount = left
+	}
+	if amount.Amount <= 0 || amount.Amount > left {
+		return refund, ErrInvalidRefund
+	}
+
+	total := refunded
+	total.Amount += amount.Amount
+	status := models.RefundPartial
+	if total.Amount >= order.Price.Amount {
+		status = models.RefundFull
+	}
+	refund = models.Refund{
+		ID:        primitive.NewObjectID(),
+		OrderID:   order.ID,
+		UID:       order.UID,
+		IntentID:  order.Payment.IntentID,
+		Lines:     lines,
+		Amount:    amount,
+		Reason:    reason,
+		Restock:   restock,
+		Status:    models.RefundPending,
+		By:        by,
+		CreatedAt: time.Now(),
+	}
+	// the refunded total read above must still hold, so two refunds at
+	// once can not give back more than was paid
+	guard := bson.M{"id": order.ID, "refunded": order.Refunded}
+	if order.Refunded == nil {
+		guard["refunded"] = bson.M{"$exists": false}
+	}
+	err = Transact(ctx, func(sc mongo.SessionContext) error {
+		res, err := Orders.UpdateOne(sc, guard, bson.M{"$set": bson.M{"refunded": total, "refundStatus": status}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return ErrInvalidRefund
+		}
+		_, err = Refunds.InsertOne(sc, refund)
+		return err
+	})
+	if err != nil {
+		return refund, err
+	}
+
+	if err := payOut(ctx, refund); err != nil {
+		log.Println("refund:", err)
+		refund.Status = models.RefundFailed
+		// only this refund's share is taken back, as other refunds may have
+		// been reserved since; what stays refunded can only be part of the
+		// order
+		left := bson.M{"$subtract": bson.A{"$refunded.amount", amount.Amount}}
+		some := bson.M{"$gt": bson.A{left, 0}}
+		undo := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"refunded":     bson.M{"$cond": bson.A{some, bson.M{"amount": left, "currency": "$refunded.currency"}, "$$REMOVE"}},
+			"refundStatus": bson.M{"$cond": bson.A{some, models.RefundPartial, "$$REMOVE"}},
+		}}}}
+		err := Transact(ctx, func(sc mongo.SessionContext) error {
+			if _, err := Refunds.UpdateOne(sc, bson.M{"id": refund.ID}, bson.M{"$set": bson.M{"status": refund.Status}}); err != nil {
+				return err
+			}
+			_, err := Orders.UpdateOne(sc, bson.M{"id": order.ID, "refunded.amount": bson.M{"$gte": amount.Amount}}, undo)
+			return err
+		})
+		if err != nil {
+			log.Println("refund:", err)
+		}
+		return refund, ErrRefundFailed
+	}
+
+	refund.Status = models.RefundSucceeded
+	err = Transact(ctx, func(sc mongo.SessionContext) error {
+		if _, err := Refunds.UpdateOne(sc, bson.M{"id": refund.ID}, bson.M{"$set": bson.M{"status": refund.Status}}); err != nil {
+			return err
+		}
+		if restock {
+			if err := putStock(sc, products, back); err != nil {
+				return err
+			}
+		}
+		if status != models.RefundFull {
+			return nil
+		}
+		if _, err := Orders.UpdateOne(sc, bson.M{"id": order.ID}, bson.M{"$unset": bson.M{"refundError": ""}}); err != nil {
+			return err
+		}
+		if models.CanMove(order.Status, models.OrderRefunded) == nil {
+			_, err := AdvanceOrder(sc, order.ID, nil, models.OrderRefunded, by, reason)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return refund, err
+	}
+	if _, err := IssueCreditNote(ctx, order, refund); err != nil {
+		log.Println("issue credit note:", err)
+	}
+	return refund, nil
+}
+
+// payOut sends a refund through the payment it belongs to. Cash refunds are
+// paid by hand.
+func payOut(ctx context.Context, refund models.Refund) error {
+	if refund.IntentID == nil {
+		return nil
+	}
+	var intent models.PaymentIntent
+	if err := PaymentIntents.FindOne(ctx, bson.M{"id": *refund.IntentID}).Decode(&intent); err != nil {
+		return err
+	}
+	p, err := payment.Get(intent.Provider)
+	if err != nil {
+		return err
+	}
+	_, err = p.Refund(ctx, intent.Ref, refund.Amount)
+	return err
+}
+
+// CancelOrder cancels an order and puts what it took back into stock. A
+// payment still being authorized is voided and a captured one refunded in
+// full. Buyers can only cancel before the order is fulfilled. Cancelling a
+// split order cancels every sub-order still going; a sub-order on its own
+// can only be cancelled once it is paid for. Cancelling an order again
+// retries a refund that failed the first time.
+func CancelOrder(ctx context.Context, products *mongo.Collection, order models.Order, buyer bool, by, note string) (models.Order, error) {
+	if order.Status == models.OrderCancelled && len(order.SubOrderIDs) > 0 {
+		return cancelParent(ctx, products, order, buyer, by, note)
+	}
+	if order.Status == models.OrderCancelled && order.RefundError != "" {
+		return refundCancelled(ctx, products, order, by)
+	}
+	if buyer && order.Status != models.OrderPendingPayment && order.Status != models.OrderPaid {
+		return order, ErrNotCancellable
+	}
+	if models.CanMove(order.Status, models.OrderCancelled) != nil {
+		return order, ErrNotCancellable
+	}
+	if len(order.SubOrderIDs) > 0 {
+		return cancelParent(ctx, products, order, buyer, by, note)
+	}
+	if order.ParentID != nil && order.Status == models.OrderPendingPayment {
+		return order, ErrSplitOrder
+	}
+	return cancelOne(ctx, products, order, by, note)
+}
+
+// cancelParent cancels the sub-orders of a split order still going, then
+// voids the payment of the whole if it is still being authorized. The
+// parent follows its sub-orders to cancelled.
+func cancelParent(ctx context.Context, products *mongo.Collection, order models.Order, buyer bool, by, note string) (models.Order, error) {
+	children, err := SubOrders(ctx, order)
+	if err != nil {
+		return order, err
+	}
+	for _, child := range children {
+		if buyer && stage(child.Status) > stage(models.OrderPaid) {
+			return order, ErrNotCancellable
+		}
+	}
+	for _, child := range children {
+		switch {
+		case child.Status == models.OrderCancelled && child.RefundError != "":
+			_, err = refundCancelled(ctx, products, child, by)
+		case stage(child.Status) < 0:
+			continue
+		default:
+			_, err = cancelOne(ctx, products, child, by, note)
+		}
+		if err != nil && err != ErrNotCancellable {
+			return order, err
+		}
+	}
+	voidIntent(ctx, order)
+	err = Orders.FindOne(ctx, bson.M{"id": order.ID}).Decode(&order)
+	return order, err
+}
+
+// voidIntent voids the payment of an order if it is still being
+// authorized.
+func voidIntent(ctx context.Context, order models.Order) {
+	if order.Payment.IntentID == nil {
+		return
+	}
+	var intent models.PaymentIntent
+	if err := PaymentIntents.FindOne(ctx, bson.M{"id": *order.Payment.IntentID}).Decode(&intent); err != nil {
+		log.Println("cancel:", err)
+		return
+	}
+	if intent.Status != models.PayAuthorized && intent.Status != models.PayRequiresAction {
+		return
+	}
+	p, err := payment.Get(intent.Provider)
+	if err == nil {
+		_, err = p.Void(ctx, intent.Ref)
+	}
+	if err != nil {
+		log.Println("cancel: void payment:", err)
+	}
+}
+
+// cancelOne cancels an order that is not split.
+func cancelOne(ctx context.Context, products *mongo.Collection, order models.Order, by, note string) (models.Order, error) {
+	restocked, err := refundedUnits(ctx, order.ID, true)
+	if err != nil {
+		return order, err
+	}
+	back := make([]models.UserProd, 0, len(order.Cart))
+	for _, item := range order.Cart {
+		if n := item.Units() - restocked[lineKey{item.ID, item.Variant}]; n > 0 {
+			item.Quantity = n
+			back = append(back, item)
+		}
+	}
+
+	cancelled := order
+	err = Transact(ctx, func(sc mongo.SessionContext) error {
+		var err error
+		cancelled, err = AdvanceOrder(sc, order.ID, nil, models.OrderCancelled, by, note)
+		if err != nil {
+			return err
+		}
+		if err := putStock(sc, products, back); err != nil {
+			return err
+		}
+		if !owesRefund(cancelled) {
+			return nil
+		}
+		// marked until the refund goes through, so it is never lost
+		cancelled.RefundError = "refund pending"
+		_, err = Orders.UpdateOne(sc, bson.M{"id": order.ID}, bson.M{"$set": bson.M{"refundError": cancelled.RefundError}})
+		return err
+	})
+	if err != nil {
+		if err == ErrOrderTransition {
+			return cancelled, ErrNotCancellable
+		}
+		return cancelled, err
+	}
+
+	if !wasPaid(cancelled) {
+		voidIntent(ctx, order)
+	}
+	return refundCancelled(ctx, products, cancelled, by)
+}
+
+// owesRefund tells whether a paid order has not been refunded in full.
+func owesRefund(order models.Order) bool {
+	return wasPaid(order) && (order.Refunded == nil || order.Refunded.Amount < order.Price.Amount)
+}
+
+// refundCancelled refunds what is left of a cancelled order. A refund that
+// fails is kept on the order as its RefundError, for cancelling again to
+// retry.
+func refundCancelled(ctx context.Context, products *mongo.Collection, order models.Order, by string) (models.Order, error) {
+	var refundErr error
+	if owesRefund(order) {
+		_, refundErr = RefundOrder(ctx, products, order, nil, true, "order cancelled", false, by)
+	}
+	if refundErr != nil {
+		log.Println("cancel: refund:", refundErr)
+		if _, err := Orders.UpdateOne(ctx, bson.M{"id": order.ID}, bson.M{"$set": bson.M{"refundError": refundErr.Error()}}); err != nil {
+			log.Println("cancel:", err)
+		}
+	} else if order.RefundError != "" {
+		if _, err := Orders.UpdateOne(ctx, bson.M{"id": order.ID}, bson.M{"$unset": bson.M{"refundError": ""}}); err != nil {
+			return order, err
+		}
+	}
+	if err := Orders.FindOne(ctx, bson.M{"id": order.ID}).Decode(&order); err != nil {
+		return order, err
+	}
+	return order, refundErr
+}
+
+// OrderRefunds lists the refunds of an order, newest first.
+func OrderRefunds(ctx context.Context, oid primitive.ObjectID) ([]models.Refund, error) {
+	out := make([]models.Refund, 0)
+	cur, err := Refunds.Find(ctx, bson.M{"orderId": oid}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		return out, err
+	}
+	err = cur.All(ctx, &out)
+	return out, err
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func oid() primitive.ObjectID {
+	return primitive.NewObjectID()
+}
+
+func usd(amount int64) models.Money {
+	return models.Money{Amount: amount, Currency: "USD"}
+}
+
+func line(price, qty int64, seller *primitive.ObjectID) models.UserProd {
+	return models.UserProd{ID: oid(), Price: usd(price), Quantity: qty, Seller: seller}
+}
+
+func cartOf(lines ...models.UserProd) []models.UserProd {
+	return lines
+}
+
+func TestLineRefund(t *testing.T) {
+	cart := cartOf(line(1000, 2, nil), line(500, 1, nil))
+	thirds := cartOf(line(100, 3, nil))
+	shipped := func(price, shipping int64) models.Order {
+		return models.Order{Cart: cart, Price: usd(price), Shipping: &models.ShippingQuote{Cost: usd(shipping)}}
+	}
+	tests := []struct {
+		name  string
+		order models.Order
+		line  models.UserProd
+		qty   int64
+		want  int64
+	}{
+		{"as charged", models.Order{Cart: cart, Price: usd(2500)}, cart[0], 1, 1000},
+		{"every unit", models.Order{Cart: cart, Price: usd(2500)}, cart[0], 2, 2000},
+		{"discount shared", models.Order{Cart: cart, Price: usd(2000)}, cart[0], 1, 800},
+		{"discount on the other line", models.Order{Cart: cart, Price: usd(2000)}, cart[1], 1, 400},
+		{"tax included", models.Order{Cart: cart, Price: usd(2825)}, cart[0], 1, 1130},
+		{"shipping left out", shipped(3000, 500), cart[0], 1, 1000},
+		{"rounds down", models.Order{Cart: thirds, Price: usd(200)}, thirds[0], 1, 66},
+		{"nothing charged", models.Order{Cart: cart, Price: usd(0)}, cart[0], 1, 0},
+	}
+	for _, tt := range tests {
+		got, err := lineRefund(tt.order, tt.line, tt.qty)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != usd(tt.want) {
+			t.Errorf("%s: lineRefund = %v, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const RelatedPerProduct = 20
+
+type pair struct {
+	a, b primitive.ObjectID
+}
+
+// BuildRelated mines every past order for products bought together and
+// stores, per product, the others ranked by cosine similarity
+// co(a,b) / sqrt(orders(a) * orders(b)). Sub-orders are left out, as their
+// items are counted with the order they were split from.
+func BuildRelated(ctx context.Context, orders *mongo.Collection) error {
+	start := time.Now()
+	cur, err := orders.Find(ctx, bson.M{"cart.id": bson.M{"$exists": true}, "parentId": bson.M{"$exists": false}}, options.Find().SetProjection(bson.M{"cart.id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	freq := map[primitive.ObjectID]int64{}
+	co := map[pair]int64{}
+	for cur.Next(ctx) {
+		var order struct {
+			Cart []struct {
+				ID primitive.ObjectID `bson:"id"`
+			} `bson:"cart"`
+		}
+		if err := cur.Decode(&order); err != nil {
+			log.Println("related:", err)
+			continue
+		}
+		seen := map[primitive.ObjectID]bool{}
+		var ids []primitive.ObjectID
+		for _, item := range order.Cart {
+			if !seen[item.ID] {
+				seen[item.ID] = true
+				ids = append(ids, item.ID)
+			}
+		}
+		for i, a := range ids {
+			freq[a]++
+			for _, b := range ids[i+1:] {
+				co[pair{a, b}]++
+				co[pair{b, a}]++
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	byProduct := map[primitive.ObjectID][]models.RelatedItem{}
+	for p, n := range co {
+		score := float64(n) / math.Sqrt(float64(freq[p.a]*freq[p.b]))
+		byProduct[p.a] = append(byProduct[p.a], models.RelatedItem{PID: p.b, Score: score, Count: n})
+	}
+
+	for pid, items := range byProduct {
+		sort.Slice(items, func(i, j int) bool {
+			if items[i].Score != items[j].Score {
+				return items[i].Score > items[j].Score
+			}
+			return items[i].Count > items[j].Count
+		})
+		if len(items) > RelatedPerProduct {
+			items = items[:RelatedPerProduct]
+		}
+		doc := models.Related{PID: pid, Items: items, UpdatedAt: start}
+		_, err := Related.ReplaceOne(ctx, bson.M{"pid": pid}, doc, options.Replace().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+
+	// products no longer bought with anything
+	_, err = Related.DeleteMany(ctx, bson.M{"updatedAt": bson.M{"$lt": start}})
+	return err
+}
+
+func RelatedBuilder(orders *mongo.Collection, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := BuildRelated(ctx, orders); err != nil {
+			log.Println("related builder:", err)
+		}
+		cancel()
+		<-tick.C
+	}
+}
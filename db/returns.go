@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidReturn    = errors.New("return not found")
+	ErrReturnTransition = errors.New("return can not move to that state")
+	ErrNotReturnable    = errors.New("only delivered orders can be returned")
+	ErrReturnTooLarge   = errors.New("more units than are left to return")
+)
+
+// returningUnits counts the units of each order line in returns still
+// under way.
+func returningUnits(ctx context.Context, oid primitive.ObjectID) (map[lineKey]int64, error) {
+	out := map[lineKey]int64{}
+	open := bson.A{models.ReturnRequested, models.ReturnApproved, models.ReturnShipped, models.ReturnReceived}
+	cur, err := Returns.Find(ctx, bson.M{"orderId": oid, "status": bson.M{"$in": open}})
+	if err != nil {
+		return out, err
+	}
+	var returns []models.Return
+	if err := cur.All(ctx, &returns); err != nil {
+		return out, err
+	}
+	for _, r := range returns {
+		for _, l := range r.Lines {
+			out[lineKey{l.ID, l.Variant}] += l.Quantity
+		}
+	}
+	return out, nil
+}
+
+// OpenReturn requests a return of lines of a delivered order. Units already
+// refunded or in another return can not be returned again; the check and
+// the return are written in one transaction.
+func OpenReturn(ctx context.Context, order models.Order, lines []models.ReturnLine, photos []string) (models.Return, error) {
+	var ret models.Return
+	if len(order.SubOrderIDs) > 0 {
+		return ret, ErrSplitOrder
+	}
+	if order.Status != models.OrderDelivered {
+		return ret, ErrNotReturnable
+	}
+	if photos == nil {
+		photos = make([]string, 0)
+	}
+	now := time.Now()
+	ret = models.Return{
+		ID:        primitive.NewObjectID(),
+		OrderID:   order.ID,
+		UID:       order.UID,
+		Seller:    order.Seller,
+		Lines:     lines,
+		Photos:    photos,
+		Status:    models.ReturnRequested,
+		History:   []models.OrderTransition{{To: models.ReturnRequested, At: now, By: "buyer:" + order.UID.Hex()}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err := Transact(ctx, func(sc mongo.SessionContext) error {
+		// counting the return on the order first makes returns and refunds
+		// of the same order at once conflict, so the one retried sees the
+		// units the other took
+		res, err := Orders.UpdateOne(sc, bson.M{"id": order.ID, "status": models.OrderDelivered}, bson.M{"$inc": bson.M{"returnCount": 1}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return ErrNotReturnable
+		}
+		refunded, err := refundedUnits(sc, order.ID, false)
+		if err != nil {
+			return err
+		}
+		taken, err := returningUnits(sc, order.ID)
+		if err != nil {
+			return err
+		}
+		for i, l := range lines {
+			var item *models.UserProd
+			for j := range order.Cart {
+				if order.Cart[j].ID == l.ID && order.Cart[j].Variant == l.Variant {
+					item = &order.Cart[j]
+					break
+				}
+			}
+			key := lineKey{l.ID, l.Variant}
+			if item == nil || l.Quantity > item.Units()-refunded[key]-taken[key] {
+				return ErrReturnTooLarge
+			}
+			taken[key] += l.Quantity
+			lines[i].Name = item.Name
+		}
+		_, err = Returns.InsertOne(sc, ret)
+		return err
+	})
+	return ret, err
+}
+
+// AdvanceReturn moves the return matching filter to state to, setting the
+// fields in set along with it. Like AdvanceOrder, the move only applies if
+// the return is still in the state it was read in; otherwise it fails with
+// ErrReturnTransition and the return as it is now.
+func AdvanceReturn(ctx context.Context, filter bson.M, to, by, note string, set bson.M) (models.Return, error) {
+	var ret models.Return
+	if err := Returns.FindOne(ctx, filter).Decode(&ret); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ret, ErrInvalidReturn
+		}
+		return ret, err
+	}
+	if err := models.CanMoveReturn(ret.Status, to); err != nil {
+		return ret, ErrReturnTransition
+	}
+
+	now := time.Now()
+	step := models.OrderTransition{From: ret.Status, To: to, At: now, By: by, Note: note}
+	fields := bson.M{"status": to, "updatedAt": now}
+	for k, v := range set {
+		fields[k] = v
+	}
+	guard := bson.M{"id": ret.ID, "status": ret.Status}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := Returns.FindOneAndUpdate(ctx, guard, bson.M{"$set": fields, "$push": bson.M{"history": step}}, opts).Decode(&ret)
+	if err == mongo.ErrNoDocuments {
+		if err := Returns.FindOne(ctx, bson.M{"id": ret.ID}).Decode(&ret); err != nil {
+			log.Println(err)
+		}
+		return ret, ErrReturnTransition
+	}
+	return ret, err
+}
+
+// ReceiveReturn marks the return matching filter as received and refunds
+// its lines, putting them back into stock with restock. A return received
+// earlier whose refund failed is refunded again.
+func ReceiveReturn(ctx context.Context, products *mongo.Collection, filter bson.M, restock bool, by, note string) (models.Return, error) {
+	ret, err := AdvanceReturn(ctx, filter, models.ReturnReceived, by, note, bson.M{"restock": restock})
+	if err == ErrReturnTransition && ret.Status == models.ReturnReceived {
+		ret.Restock = restock
+		_, err = Returns.UpdateOne(ctx, bson.M{"id": ret.ID}, bson.M{"$set": bson.M{"restock": restock}})
+	}
+	if err != nil {
+		return ret, err
+	}
+
+	var order models.Order
+	if err := Orders.FindOne(ctx, bson.M{"id": ret.OrderID}).Decode(&order); err != nil {
+		return ret, err
+	}
+	lines := make([]models.RefundLine, 0, len(ret.Lines))
+	for _, l := range ret.Lines {
+		lines = append(lines, models.RefundLine{ID: l.ID, Variant: l.Variant, Quantity: l.Quantity})
+	}
+	refund, err := RefundOrder(ctx, products, order, lines, false, "return "+ret.ID.Hex(), ret.Restock, by)
+	if err != nil {
+		ret.RefundError = err.Error()
+		if _, err := Returns.UpdateOne(ctx, bson.M{"id": ret.ID}, bson.M{"$set": bson.M{"refundError": ret.RefundError, "updatedAt": time.Now()}}); err != nil {
+			log.Println(err)
+		}
+		return ret, err
+	}
+	return AdvanceReturn(ctx, bson.M{"id": ret.ID}, models.ReturnRefunded, by, "", bson.M{"refundId": refund.ID, "refundError": ""})
+}
@@ -22,7 +22,7 @@ func MongoDatabase() *mongo.Client {
 		log.Fatal(err)
 	}
 
-	err = client.Ping(context.TODO(), nil)
+	err = client.Ping(ctx, nil)
 	if err != nil {
 		log.Println("Failed to connect to mongodb")
 		return nil
@@ -75,4 +75,329 @@ func InitReviews(client *mongo.Client, name string) error {
 	_, _ = Reviews.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "pid", Value: 1},	{Key: "updatedAt", Value: -1},}})
 
 	return nil
-}
\ No newline at end of file
+}
+var PriceHistory *mongo.Collection
+var PriceSchedules *mongo.Collection
+
+func InitPrices(client *mongo.Client, name string) error {
+	PriceHistory = client.Database(name).Collection("priceHistory")
+	PriceSchedules = client.Database(name).Collection("priceSchedules")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := PriceHistory.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "pid", Value: 1}, {Key: "changedAt", Value: -1}}})
+	if err != nil {
+		log.Println("create price history index:", err)
+	}
+	_, err = PriceSchedules.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "status", Value: 1}, {Key: "startAt", Value: 1}}})
+	if err != nil {
+		log.Println("create price schedule index:", err)
+	}
+	_, _ = PriceSchedules.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "pid", Value: 1}, {Key: "startAt", Value: -1}}})
+
+	return nil
+}
+
+var Categories *mongo.Collection
+
+func InitCategories(client *mongo.Client, name string) error {
+	Categories = client.Database(name).Collection("categories")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := Categories.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create categories unique index:", err)
+	}
+	_, _ = client.Database(name).Collection("products").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "category", Value: 1}}})
+
+	return nil
+}
+
+var Related *mongo.Collection
+
+func InitRelated(client *mongo.Client, name string) error {
+	Related = client.Database(name).Collection("related")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := Related.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "pid", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create related unique index:", err)
+	}
+	_, _ = client.Database(name).Collection("products").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "category", Value: 1}, {Key: "ratingAvg", Value: -1}}})
+
+	return nil
+}
+
+var Wishlists *mongo.Collection
+
+func InitWishlists(client *mongo.Client, name string) error {
+	Wishlists = client.Database(name).Collection("wishlists")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := Wishlists.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "uid", Value: 1}, {Key: "kind", Value: 1}}})
+	if err != nil {
+		log.Println("create wishlists index:", err)
+	}
+	_, err = Wishlists.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "shareToken", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)})
+	if err != nil {
+		log.Println("create wishlists share index:", err)
+	}
+
+	return nil
+}
+
+var Carts *mongo.Collection
+
+func InitCarts(client *mongo.Client, name string) error {
+	Carts = client.Database(name).Collection("carts")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := Carts.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "uid", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)})
+	if err != nil {
+		log.Println("create carts user index:", err)
+	}
+	_, err = Carts.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "token", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)})
+	if err != nil {
+		log.Println("create carts token index:", err)
+	}
+	_, err = Carts.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)})
+	if err != nil {
+		log.Println("create carts expiry index:", err)
+	}
+
+	return nil
+}
+
+var Promotions *mongo.Collection
+var PromotionUses *mongo.Collection
+var PromotionUsers *mongo.Collection
+
+func InitPromotions(client *mongo.Client, name string) error {
+	Promotions = client.Database(name).Collection("promotions")
+	PromotionUses = client.Database(name).Collection("promotionUses")
+	PromotionUsers = client.Database(name).Collection("promotionUsers")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := Promotions.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "code", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)})
+	if err != nil {
+		log.Println("create promotions code index:", err)
+	}
+	_, err = PromotionUses.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "promoId", Value: 1}, {Key: "uid", Value: 1}}})
+	if err != nil {
+		log.Println("create promotion uses index:", err)
+	}
+	_, err = PromotionUsers.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "promoId", Value: 1}, {Key: "uid", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create promotion users index:", err)
+	}
+
+	return nil
+}
+
+var TaxRates *mongo.Collection
+
+func InitTax(client *mongo.Client, name string) error {
+	TaxRates = client.Database(name).Collection("taxRates")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := TaxRates.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "region", Value: 1}, {Key: "postalPrefix", Value: 1}, {Key: "taxClass", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create tax rates unique index:", err)
+	}
+
+	return nil
+}
+
+var ShippingZones *mongo.Collection
+var ShippingMethods *mongo.Collection
+
+func InitShipping(client *mongo.Client, name string) error {
+	ShippingZones = client.Database(name).Collection("shippingZones")
+	ShippingMethods = client.Database(name).Collection("shippingMethods")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := ShippingZones.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create shipping zones unique index:", err)
+	}
+	_, err = ShippingMethods.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "active", Value: 1}}})
+	if err != nil {
+		log.Println("create shipping methods index:", err)
+	}
+
+	return nil
+}
+
+var Orders *mongo.Collection
+
+func InitOrders(client *mongo.Client, name string) error {
+	Orders = client.Database(name).Collection("orders")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := Orders.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create orders unique index:", err)
+	}
+	_, err = Orders.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "uid", Value: 1}, {Key: "orderTime", Value: -1}}})
+	if err != nil {
+		log.Println("create orders buyer index:", err)
+	}
+	_, err = Orders.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "cart.id", Value: 1}}})
+	if err != nil {
+		log.Println("create orders product index:", err)
+	}
+	_, err = Orders.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "seller", Value: 1}, {Key: "status", Value: 1}}})
+	if err != nil {
+		log.Println("create orders seller index:", err)
+	}
+	_, err = Orders.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "parentId", Value: 1}}, Options: options.Index().SetSparse(true)})
+	if err != nil {
+		log.Println("create orders parent index:", err)
+	}
+	_, err = Orders.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "shipment.tracking", Value: 1}}, Options: options.Index().SetSparse(true)})
+	if err != nil {
+		log.Println("create orders tracking index:", err)
+	}
+
+	return nil
+}
+
+var IdempotencyKeys *mongo.Collection
+
+func InitIdempotency(client *mongo.Client, name string) error {
+	IdempotencyKeys = client.Database(name).Collection("idempotencyKeys")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := IdempotencyKeys.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "uid", Value: 1}, {Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create idempotency keys unique index:", err)
+	}
+	_, err = IdempotencyKeys.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)})
+	if err != nil {
+		log.Println("create idempotency keys expiry index:", err)
+	}
+
+	return nil
+}
+
+var PaymentIntents *mongo.Collection
+
+func InitPayments(client *mongo.Client, name string) error {
+	PaymentIntents = client.Database(name).Collection("paymentIntents")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := PaymentIntents.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create payment intents unique index:", err)
+	}
+	_, err = PaymentIntents.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "provider", Value: 1}, {Key: "ref", Value: 1}}})
+	if err != nil {
+		log.Println("create payment intents ref index:", err)
+	}
+	_, err = PaymentIntents.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "orderId", Value: 1}, {Key: "createdAt", Value: -1}}})
+	if err != nil {
+		log.Println("create payment intents order index:", err)
+	}
+
+	return nil
+}
+
+var Refunds *mongo.Collection
+
+func InitRefunds(client *mongo.Client, name string) error {
+	Refunds = client.Database(name).Collection("refunds")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := Refunds.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create refunds unique index:", err)
+	}
+	_, err = Refunds.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "orderId", Value: 1}, {Key: "createdAt", Value: -1}}})
+	if err != nil {
+		log.Println("create refunds order index:", err)
+	}
+
+	return nil
+}
+
+var Returns *mongo.Collection
+
+func InitReturns(client *mongo.Client, name string) error {
+	Returns = client.Database(name).Collection("returns")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := Returns.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create returns unique index:", err)
+	}
+	_, err = Returns.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "orderId", Value: 1}}})
+	if err != nil {
+		log.Println("create returns order index:", err)
+	}
+	_, err = Returns.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "uid", Value: 1}, {Key: "createdAt", Value: -1}}})
+	if err != nil {
+		log.Println("create returns buyer index:", err)
+	}
+	_, err = Returns.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "seller", Value: 1}, {Key: "status", Value: 1}}})
+	if err != nil {
+		log.Println("create returns seller index:", err)
+	}
+
+	return nil
+}
+
+var Invoices *mongo.Collection
+var InvoiceCounters *mongo.Collection
+
+func InitInvoices(client *mongo.Client, name string) error {
+	Invoices = client.Database(name).Collection("invoices")
+	InvoiceCounters = client.Database(name).Collection("invoiceCounters")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+
+	_, err := Invoices.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create invoices unique index:", err)
+	}
+	_, err = Invoices.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "number", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create invoices number index:", err)
+	}
+	// one invoice per order and one credit note per refund
+	_, err = Invoices.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "orderId", Value: 1}, {Key: "kind", Value: 1}, {Key: "refundId", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create invoices order index:", err)
+	}
+	_, err = InvoiceCounters.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Println("create invoice counters unique index:", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/cyzhang39/go_market/models"
+	"github.com/cyzhang39/go_market/shipping"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var ErrShippingMethod = errors.New("shipping method not available for this order")
+
+// ShippingQuotes prices the active shipping methods for the items going to
+// addr. subtotal is the cart total after discounts.
+func ShippingQuotes(ctx context.Context, items []models.UserProd, subtotal models.Money, addr models.Address, free bool, to string) ([]models.ShippingQuote, error) {
+	var zones []models.ShippingZone
+	cur, err := ShippingZones.Find(ctx, bson.M{})
+	if err == nil {
+		err = cur.All(ctx, &zones)
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInvalidCart
+	}
+	var methods []models.ShippingMethod
+	cur, err = ShippingMethods.Find(ctx, bson.M{"active": true})
+	if err == nil {
+		err = cur.All(ctx, &methods)
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInvalidCart
+	}
+
+	out, err := shipping.Quote(methods, zones, items, subtotal, addr, free, to)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInvalidCart
+	}
+	return out, nil
+}
+
+// PickShipping finds the chosen method among the quotes. An order ships
+// without a method only while none are set up; once there are, an address
+// none of them reaches is ErrInvalidAddress.
+func PickShipping(ctx context.Context, quotes []models.ShippingQuote, method string) (*models.ShippingQuote, error) {
+	for i := range quotes {
+		if quotes[i].MethodID.Hex() == method {
+			return &quotes[i], nil
+		}
+	}
+	if len(quotes) > 0 {
+		return nil, ErrShippingMethod
+	}
+	n, err := ShippingMethods.CountDocuments(ctx, bson.M{"active": true})
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInvalidCart
+	}
+	if n > 0 {
+		return nil, ErrInvalidAddress
+	}
+	if method != "" {
+		return nil, ErrShippingMethod
+	}
+	return nil, nil
+}
@@ -0,0 +1,268 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrSplitOrder = errors.New("split orders are paid and cancelled as a whole and fulfilled per sub-order")
+
+// sellerGroup is the cart lines of one seller, by their index in the cart.
+type sellerGroup struct {
+	seller *primitive.ObjectID
+	lines  []int
+}
+
+// groupBySeller groups cart lines by seller in the order the sellers first
+// appear. Lines without a seller are the marketplace's and group together.
+func groupBySeller(items []models.UserProd) []sellerGroup {
+	var groups []sellerGroup
+	for i, item := range items {
+		found := false
+		for g := range groups {
+			a, b := groups[g].seller, item.Seller
+			if (a == nil && b == nil) || (a != nil && b != nil && *a == *b) {
+				groups[g].lines = append(groups[g].lines, i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, sellerGroup{seller: item.Seller, lines: []int{i}})
+		}
+	}
+	return groups
+}
+
+// subOrders splits a checkout across sellers. Each sub-order gets its
+// seller's lines, their share of the discount and their own tax and
+// shipping. The discount is shared by what each seller's lines came to
+// after line promotions, the last seller taking the rounding. parent gets
+// the links, and the sums of shipping and price, as that is what the buyer
+// pays.
+func subOrders(ctx context.Context, parent *models.Order, groups []sellerGroup, discounts models.Discounts, addr models.Address, method string) ([]models.Order, error) {
+	to := discounts.Total.Currency
+	lineTotal := func(i int) (models.Money, error) {
+		if i < len(discounts.Lines) {
+			return currency.Convert(discounts.Lines[i].Total, to)
+		}
+		return currency.Convert(parent.Cart[i].LineTotal(), to)
+	}
+	shares := make([]int64, len(groups))
+	for g, group := range groups {
+		for _, i := range group.lines {
+			t, err := lineTotal(i)
+			if err != nil {
+				return nil, err
+			}
+			shares[g] += t.Amount
+		}
+	}
+	totals := splitAmount(discounts.Total.Amount, shares)
+
+	children := make([]models.Order, 0, len(groups))
+	parent.Price = models.Money{Currency: to}
+	shipping := models.Money{Currency: to}
+	for g, group := range groups {
+		child := models.Order{
+			ID:        primitive.NewObjectID(),
+			UID:       parent.UID,
+			ParentID:  &parent.ID,
+			Seller:    group.seller,
+			OrderTime: parent.OrderTime,
+			Cart:      make([]models.UserProd, 0, len(group.lines)),
+			Subtotal:  models.Money{Currency: to},
+			ShipTo:    parent.ShipTo,
+			BillTo:    parent.BillTo,
+			Payment:   parent.Payment,
+		}
+		openOrder(&child, "checkout")
+
+		keys := map[lineKey]bool{}
+		for _, i := range group.lines {
+			item := parent.Cart[i]
+			child.Cart = append(child.Cart, item)
+			keys[lineKey{item.ID, item.Variant}] = true
+			sub := item.LineTotal()
+			if i < len(discounts.Lines) {
+				sub = discounts.Lines[i].Subtotal
+			}
+			sub, err := currency.Convert(sub, to)
+			if err != nil {
+				return nil, err
+			}
+			child.Subtotal.Amount += sub.Amount
+		}
+		total := models.Money{Amount: totals[g], Currency: to}
+		if dc := child.Subtotal.Amount - total.Amount; dc > 0 {
+			child.DC = &models.Money{Amount: dc, Currency: to}
+		}
+
+		added := models.Money{Currency: to}
+		taxTotal := models.Money{Currency: to}
+		for _, t := range parent.Tax {
+			if !keys[lineKey{t.ID, t.Variant}] {
+				continue
+			}
+			child.Tax = append(child.Tax, t)
+			amount, err := currency.Convert(t.Tax, to)
+			if err != nil {
+				return nil, err
+			}
+			taxTotal.Amount += amount.Amount
+			if !t.Inclusive {
+				added.Amount += amount.Amount
+			}
+		}
+		if taxTotal.Amount > 0 {
+			child.TaxTotal = &taxTotal
+		}
+
+		quotes, err := ShippingQuotes(ctx, child.Cart, total, addr, discounts.FreeShipping, to)
+		if err != nil {
+			return nil, err
+		}
+		child.Shipping, err = PickShipping(ctx, quotes, method)
+		if err != nil {
+			return nil, err
+		}
+		child.Price = models.Money{Amount: total.Amount + added.Amount, Currency: to}
+		if child.Shipping != nil {
+			child.Price, err = child.Price.Add(child.Shipping.Cost)
+			if err != nil {
+				return nil, err
+			}
+			shipping.Amount += child.Shipping.Cost.Amount
+		}
+
+		parent.Price.Amount += child.Price.Amount
+		parent.SubOrderIDs = append(parent.SubOrderIDs, child.ID)
+		children = append(children, child)
+	}
+	if parent.Shipping != nil {
+		quote := *parent.Shipping
+		quote.Cost = shipping
+		parent.Shipping = &quote
+	}
+	return children, nil
+}
+
+// splitAmount shares amount out in proportion to weights, rounding each
+// share down. The last share takes what the rounding left over.
+func splitAmount(amount int64, weights []int64) []int64 {
+	all := int64(0)
+	for _, w := range weights {
+		all += w
+	}
+	out := make([]int64, len(weights))
+	left := amount
+	for i, w := range weights {
+		if i == len(weights)-1 {
+			out[i] = left
+			break
+		}
+		if all > 0 {
+			v := new(big.Rat).SetFrac64(amount, all)
+			v.Mul(v, new(big.Rat).SetInt64(w))
+			out[i] = currency.Round(v, currency.Rule{Mode: currency.Down})
+		}
+		left -= out[i]
+	}
+	return out
+}
+
+// fulfilment is the states a sub-order goes through while it is being
+// fulfilled, in order. The parent is as far along as its least advanced
+// sub-order.
+var fulfilment = []string{models.OrderPendingPayment, models.OrderPaid, models.OrderFulfilled, models.OrderShipped, models.OrderDelivered}
+
+// stage is where status lies in fulfilment, -1 once the order is over.
+func stage(status string) int {
+	for i, s := range fulfilment {
+		if s == status {
+			return i
+		}
+	}
+	return -1
+}
+
+// SubOrders loads the sub-orders of a split order.
+func SubOrders(ctx context.Context, parent models.Order) ([]models.Order, error) {
+	out := make([]models.Order, 0, len(parent.SubOrderIDs))
+	if len(parent.SubOrderIDs) == 0 {
+		return out, nil
+	}
+	cur, err := Orders.Find(ctx, bson.M{"parentId": parent.ID})
+	if err != nil {
+		return out, err
+	}
+	err = cur.All(ctx, &out)
+	return out, err
+}
+
+// rollUp moves a split order along with its sub-orders: to the state of
+// the least advanced one still going, or once none are, to refunded if any
+// was refunded and cancelled otherwise. It never moves the parent back.
+func rollUp(ctx context.Context, pid primitive.ObjectID) error {
+	var parent models.Order
+	if err := Orders.FindOne(ctx, bson.M{"id": pid}).Decode(&parent); err != nil {
+		return err
+	}
+	children, err := SubOrders(ctx, parent)
+	if err != nil {
+		return err
+	}
+	least, refunded := -1, false
+	for _, child := range children {
+		n := stage(child.Status)
+		if n < 0 {
+			refunded = refunded || child.Status == models.OrderRefunded
+			continue
+		}
+		if least < 0 || n < least {
+			least = n
+		}
+	}
+	status := models.OrderCancelled
+	switch {
+	case least >= 0:
+		status = fulfilment[least]
+	case refunded:
+		status = models.OrderRefunded
+	}
+	if status == parent.Status || stage(parent.Status) < 0 || (least >= 0 && least < stage(parent.Status)) {
+		return nil
+	}
+
+	step := models.OrderTransition{From: parent.Status, To: status, At: time.Now(), By: "suborders"}
+	filter := bson.M{"id": pid, "status": parent.Status}
+	_, err = Orders.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"status": status}, "$push": bson.M{"history": step}})
+	return err
+}
+
+// payChildren passes the payment of a split order on to its sub-orders, so
+// each seller sees their part paid.
+func payChildren(ctx context.Context, parent models.Order, by string) {
+	if _, err := Orders.UpdateMany(ctx, bson.M{"parentId": parent.ID}, bson.M{"$set": bson.M{"payment": parent.Payment}}); err != nil {
+		log.Println("pay sub-orders:", err)
+		return
+	}
+	children, err := SubOrders(ctx, parent)
+	if err != nil {
+		log.Println("pay sub-orders:", err)
+		return
+	}
+	for _, child := range children {
+		if _, err := moveOrder(ctx, child, bson.M{"id": child.ID}, models.OrderPaid, by, ""); err != nil && err != ErrOrderTransition {
+			log.Println("pay sub-order:", err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitAmount(t *testing.T) {
+	tests := []struct {
+		amount  int64
+		weights []int64
+		want    []int64
+	}{
+		{1000, []int64{1}, []int64{1000}},
+		{1000, []int64{500, 500}, []int64{500, 500}},
+		{900, []int64{2000, 1000}, []int64{600, 300}},
+		// the last share takes the rounding
+		{100, []int64{1, 1, 1}, []int64{33, 33, 34}},
+		{1001, []int64{300, 700}, []int64{300, 701}},
+		{0, []int64{300, 700}, []int64{0, 0}},
+		{500, []int64{0, 0}, []int64{0, 500}},
+		{500, []int64{}, []int64{}},
+	}
+	for _, tt := range tests {
+		got := splitAmount(tt.amount, tt.weights)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitAmount(%d, %v) = %v, want %v", tt.amount, tt.weights, got, tt.want)
+		}
+		var sum int64
+		for _, v := range got {
+			sum += v
+		}
+		if len(got) > 0 && sum != tt.amount {
+			t.Errorf("splitAmount(%d, %v) shares add up to %d", tt.amount, tt.weights, sum)
+		}
+	}
+}
+
+func TestGroupBySeller(t *testing.T) {
+	a, b := oid(), oid()
+	items := cartOf(line(1000, 1, &a), line(500, 1, nil), line(200, 2, &b), line(300, 1, &a), line(100, 1, nil))
+	groups := groupBySeller(items)
+	want := [][]int{{0, 3}, {1, 4}, {2}}
+	if len(groups) != len(want) {
+		t.Fatalf("got %d groups, want %d", len(groups), len(want))
+	}
+	for g := range want {
+		if !reflect.DeepEqual(groups[g].lines, want[g]) {
+			t.Errorf("group %d holds lines %v, want %v", g, groups[g].lines, want[g])
+		}
+	}
+	if *groups[0].seller != a || groups[1].seller != nil || *groups[2].seller != b {
+		t.Error("groups are not in the order their sellers first appear")
+	}
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/cyzhang39/go_market/models"
+	"github.com/cyzhang39/go_market/tax"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrInvalidAddress = errors.New("invalid Address")
+
+// TaxCalculator loads the tax table into a rule based calculator.
+func TaxCalculator(ctx context.Context) (tax.Calculator, error) {
+	cur, err := TaxRates.Find(ctx, bson.M{})
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	var rates []models.TaxRate
+	if err := cur.All(ctx, &rates); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return tax.Rules(rates), nil
+}
+
+// UserAddress finds one of the user's addresses, their default shipping
+// address when aid is empty. A user without addresses gets an empty
+// address.
+func UserAddress(ctx context.Context, users *mongo.Collection, uid primitive.ObjectID, aid string) (models.Address, error) {
+	var user models.User
+	if err := users.FindOne(ctx, bson.M{"id": uid}).Decode(&user); err != nil {
+		return models.Address{}, ErrInvalidUser
+	}
+	if aid == "" {
+		for _, addr := range user.AddressInfo {
+			if addr.DefaultShipping {
+				return addr, nil
+			}
+		}
+		if len(user.AddressInfo) == 0 {
+			return models.Address{}, nil
+		}
+		return user.AddressInfo[0], nil
+	}
+	aHex, err := primitive.ObjectIDFromHex(aid)
+	if err != nil {
+		return models.Address{}, ErrInvalidAddress
+	}
+	for _, addr := range user.AddressInfo {
+		if addr.ID == aHex {
+			return addr, nil
+		}
+	}
+	return models.Address{}, ErrInvalidAddress
+}
+
+// CartTax works out the tax on cart lines after their discounts.
+func CartTax(ctx context.Context, items []models.UserProd, discounts models.Discounts, addr models.Address, to string) (models.TaxSummary, error) {
+	calc, err := TaxCalculator(ctx)
+	if err != nil {
+		return models.TaxSummary{}, ErrInvalidCart
+	}
+	taxed := make([]tax.Item, 0, len(items))
+	for i, item := range items {
+		taxable := item.LineTotal()
+		if i < len(discounts.Lines) {
+			taxable = discounts.Lines[i].Total
+		}
+		taxed = append(taxed, tax.Item{Line: item, Taxable: taxable})
+	}
+	out, err := calc.Calculate(taxed, tax.To(addr), to)
+	if err != nil {
+		log.Println(err)
+		return out, ErrInvalidCart
+	}
+	return out, nil
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cyzhang39/go_market/carrier"
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrUnknownShipment = errors.New("no shipped order with that tracking number")
+
+// ApplyTracking adds the events of order's shipment that are new to its
+// timeline. Once the carrier reports the parcel delivered, a shipped order
+// moves to delivered.
+func ApplyTracking(ctx context.Context, order models.Order, events []models.TrackingEvent, by string) (models.Order, error) {
+	if order.Shipment == nil {
+		return order, ErrUnknownShipment
+	}
+	seen := map[string]bool{}
+	for _, ev := range order.Shipment.Events {
+		seen[ev.ID] = true
+	}
+	fresh := make([]models.TrackingEvent, 0, len(events))
+	ids := bson.A{}
+	for _, ev := range events {
+		if ev.ID == "" {
+			// carriers without event ids report each scan once per state
+			ev.ID = ev.Status + "@" + ev.At.UTC().Format(time.RFC3339Nano)
+		}
+		if seen[ev.ID] {
+			continue
+		}
+		seen[ev.ID] = true
+		fresh = append(fresh, ev)
+		ids = append(ids, ev.ID)
+	}
+
+	now := time.Now()
+	set := bson.M{"shipment.checkedAt": now}
+	update := bson.M{"$set": set}
+	filter := bson.M{"id": order.ID}
+	if len(fresh) > 0 {
+		all := append(append([]models.TrackingEvent{}, order.Shipment.Events...), fresh...)
+		sort.SliceStable(all, func(i, j int) bool { return all[i].At.Before(all[j].At) })
+		set["shipment.status"] = all[len(all)-1].Status
+		update["$push"] = bson.M{"shipment.events": bson.M{"$each": fresh, "$sort": bson.M{"at": 1}}}
+		// events a concurrent update already added are not added twice
+		filter["shipment.events.id"] = bson.M{"$nin": ids}
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := Orders.FindOneAndUpdate(ctx, filter, update, opts).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		if err := Orders.FindOne(ctx, bson.M{"id": order.ID}).Decode(&order); err != nil {
+			return order, err
+		}
+		return ApplyTracking(ctx, order, events, by)
+	}
+	if err != nil {
+		return order, err
+	}
+
+	if order.Status != models.OrderShipped {
+		return order, nil
+	}
+	for _, ev := range order.Shipment.Events {
+		if ev.Status == models.TrackDelivered {
+			moved, err := AdvanceOrder(ctx, order.ID, nil, models.OrderDelivered, by, ev.Description)
+			if err == ErrOrderTransition {
+				return moved, nil
+			}
+			return moved, err
+		}
+	}
+	return order, nil
+}
+
+// ApplyCarrierUpdate applies a verified webhook update of a carrier to the
+// shipped order with its tracking number.
+func ApplyCarrierUpdate(ctx context.Context, name string, up carrier.Update) error {
+	cur, err := Orders.Find(ctx, bson.M{"shipment.tracking": up.Tracking})
+	if err != nil {
+		return err
+	}
+	var orders []models.Order
+	if err := cur.All(ctx, &orders); err != nil {
+		return err
+	}
+	for _, order := range orders {
+		if strings.EqualFold(order.Shipment.Carrier, name) {
+			_, err := ApplyTracking(ctx, order, up.Events, "carrier:"+name)
+			return err
+		}
+	}
+	return ErrUnknownShipment
+}
+
+// PollTracking asks the carriers of every shipped order for news of its
+// parcel. Orders sent with a carrier we have no tracker for are skipped.
+func PollTracking(ctx context.Context) error {
+	cur, err := Orders.Find(ctx, bson.M{"status": models.OrderShipped, "shipment": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	var orders []models.Order
+	if err := cur.All(ctx, &orders); err != nil {
+		return err
+	}
+	for _, order := range orders {
+		t, err := carrier.Get(order.Shipment.Carrier)
+		if err != nil {
+			continue
+		}
+		events, err := t.Track(ctx, order.Shipment.Tracking)
+		if err != nil {
+			log.Println("track order", order.ID.Hex(), err)
+			continue
+		}
+		if _, err := ApplyTracking(ctx, order, events, "carrier:"+t.Name()); err != nil {
+			log.Println("track order", order.ID.Hex(), err)
+		}
+	}
+	return nil
+}
+
+func TrackingPoller(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := PollTracking(ctx); err != nil {
+			log.Println("tracking poller:", err)
+		}
+		cancel()
+		<-tick.C
+	}
+}
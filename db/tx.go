@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+
+	"github.com/cyzhang39/go_market/models"
+)
+
+var ErrOutOfStock = errors.New("not enough stock")
+
+// Transact runs fn in a multi-document transaction on a session of its own.
+// The driver runs fn again on transient errors such as write conflicts, and
+// retries the commit when its outcome is unknown, until ctx is done. fn must
+// make every database call with sc and must not have other side effects.
+// Transactions need MongoDB to run as a replica set.
+func Transact(ctx context.Context, fn func(sc mongo.SessionContext) error) error {
+	session, err := Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	opts := options.Transaction().SetReadConcern(readconcern.Snapshot()).SetWriteConcern(writeconcern.Majority())
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	}, opts)
+	return err
+}
+
+// takeStock takes the ordered quantities off the stock of every product
+// that tracks it. Products without a stock level are never out of stock.
+func takeStock(ctx context.Context, products *mongo.Collection, items []models.UserProd) error {
+	qty := map[primitive.ObjectID]int64{}
+	order := make([]primitive.ObjectID, 0, len(items))
+	for _, item := range items {
+		if _, ok := qty[item.ID]; !ok {
+			order = append(order, item.ID)
+		}
+		qty[item.ID] += item.Units()
+	}
+	for _, pid := range order {
+		res, err := products.UpdateOne(ctx, bson.M{"id": pid, "stock": bson.M{"$gte": qty[pid]}}, bson.M{"$inc": bson.M{"stock": -qty[pid]}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount > 0 {
+			continue
+		}
+		tracked, err := products.CountDocuments(ctx, bson.M{"id": pid, "stock": bson.M{"$type": "number"}})
+		if err != nil {
+			return err
+		}
+		if tracked > 0 {
+			return ErrOutOfStock
+		}
+	}
+	return nil
+}
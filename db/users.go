@@ -0,0 +1,26 @@
+package db
+
+import (
+	"context"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UserCurrency returns the user's preferred display currency, or "" if they
+// have not chosen one.
+func UserCurrency(ctx context.Context, users *mongo.Collection, uid string) string {
+	uHex, err := primitive.ObjectIDFromHex(uid)
+	if err != nil {
+		return ""
+	}
+	var user models.User
+	err = users.FindOne(ctx, bson.M{"id": uHex}, options.FindOne().SetProjection(bson.M{"currency": 1})).Decode(&user)
+	if err != nil {
+		return ""
+	}
+	return user.Currency
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	KindWishlist = "wishlist"
+	KindSaved    = "saved"
+	SavedName    = "Saved for later"
+)
+
+var (
+	ErrInvalidWishlist = errors.New("invalid Wishlist")
+	ErrNotInCart       = errors.New("item not in cart")
+)
+
+func WishlistAdd(ctx context.Context, products *mongo.Collection, wid primitive.ObjectID, uid primitive.ObjectID, pid primitive.ObjectID) error {
+	var prod models.Product
+	err := products.FindOne(ctx, bson.M{"id": pid}).Decode(&prod)
+	if err != nil {
+		log.Println(err)
+		return ErrInvalidProduct
+	}
+
+	item := models.WishItem{UserProd: snapshot(prod), AddedAt: time.Now()}
+	idx := bson.M{"id": wid, "uid": uid}
+	if err := Wishlists.FindOne(ctx, idx).Err(); err != nil {
+		return ErrInvalidWishlist
+	}
+
+	// already on the list is not an error
+	idx["items"] = bson.M{"$not": bson.M{"$elemMatch": lineMatch(pid, "")}}
+	update := bson.M{"$push": bson.M{"items": item}, "$set": bson.M{"updatedAt": time.Now()}}
+	_, err = Wishlists.UpdateOne(ctx, idx, update)
+	return err
+}
+
+// WishlistRemove takes one variant of a product off a list. Other variants
+// saved for later stay where they are.
+func WishlistRemove(ctx context.Context, wid primitive.ObjectID, uid primitive.ObjectID, pid primitive.ObjectID, variant string) error {
+	idx := bson.M{"id": wid, "uid": uid}
+	update := bson.M{"$pull": bson.M{"items": lineMatch(pid, variant)}, "$set": bson.M{"updatedAt": time.Now()}}
+	res, err := Wishlists.UpdateOne(ctx, idx, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrInvalidWishlist
+	}
+	return nil
+}
+
+// MoveToCart puts a saved item, one variant of a product, back into the
+// cart with the price and quantity it was saved with and takes it off the
+// list, both in one transaction.
+func MoveToCart(ctx context.Context, products *mongo.Collection, wid primitive.ObjectID, uid primitive.ObjectID, pid primitive.ObjectID, variant string) error {
+	var list models.Wishlist
+	err := Wishlists.FindOne(ctx, bson.M{"id": wid, "uid": uid}).Decode(&list)
+	if err != nil {
+		return ErrInvalidWishlist
+	}
+	var item *models.WishItem
+	for i := range list.Items {
+		if list.Items[i].ID == pid && list.Items[i].Variant == variant {
+			item = &list.Items[i]
+			break
+		}
+	}
+	if item == nil {
+		return ErrInvalidProduct
+	}
+
+	limit := int64(MaxLineQuantity)
+	var prod models.Product
+	if err := products.FindOne(ctx, bson.M{"id": pid}).Decode(&prod); err == nil {
+		limit = lineLimit(prod)
+	}
+	return Transact(ctx, func(sc mongo.SessionContext) error {
+		if err := addLine(sc, CartKey{UID: uid}, item.UserProd, limit); err != nil {
+			return err
+		}
+		// moved meanwhile by another request, which added it already
+		idx := bson.M{"id": wid, "uid": uid, "items": bson.M{"$elemMatch": lineMatch(pid, variant)}}
+		update := bson.M{"$pull": bson.M{"items": lineMatch(pid, variant)}, "$set": bson.M{"updatedAt": time.Now()}}
+		res, err := Wishlists.UpdateOne(sc, idx, update)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return ErrInvalidProduct
+		}
+		return nil
+	})
+}
+
+// SaveForLater moves a cart line into the user's saved list, creating the
+// list on first use. The line keeps the price it was added to the cart at.
+// Taking it out of the cart and saving it happen in one transaction.
+func SaveForLater(ctx context.Context, pid primitive.ObjectID, variant string, uid string) error {
+	key, err := UserCart(uid)
+	if err != nil {
+		return err
+	}
+	return Transact(ctx, func(sc mongo.SessionContext) error {
+		cart, err := GetCart(sc, key)
+		if err != nil {
+			return err
+		}
+		var line *models.UserProd
+		for i := range cart.Items {
+			if cart.Items[i].ID == pid && cart.Items[i].Variant == variant {
+				line = &cart.Items[i]
+				break
+			}
+		}
+		if line == nil {
+			return ErrNotInCart
+		}
+
+		now := time.Now()
+		saved := bson.M{"uid": key.UID, "kind": KindSaved}
+		_, err = Wishlists.UpdateOne(sc, saved, bson.M{"$pull": bson.M{"items": lineMatch(pid, variant)}})
+		if err != nil {
+			return err
+		}
+		update := bson.M{
+			"$push":        bson.M{"items": models.WishItem{UserProd: *line, AddedAt: now}},
+			"$set":         bson.M{"updatedAt": now},
+			"$setOnInsert": bson.M{"id": primitive.NewObjectID(), "name": SavedName, "public": false, "createdAt": now},
+		}
+		_, err = Wishlists.UpdateOne(sc, saved, update, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+
+		return pullLines(sc, key, lineMatch(pid, variant))
+	})
+}
@@ -0,0 +1,53 @@
+package invoice
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/cyzhang39/go_market/models"
+)
+
+var page = template.Must(template.New("invoice").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} {{index .Meta 0}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 14px; margin: 40px; color: #222; }
+h1 { font-size: 28px; margin: 0 0 16px; }
+.parties { display: flex; gap: 48px; margin: 24px 0; }
+.parties h2 { font-size: 12px; text-transform: uppercase; color: #666; margin: 0 0 4px; }
+table { width: 100%; border-collapse: collapse; }
+th, td { padding: 6px 4px; text-align: left; }
+th { border-bottom: 2px solid #222; }
+td.n, th.n { text-align: right; }
+tr.line td { border-bottom: 1px solid #ddd; }
+tr.strong td { font-weight: bold; border-top: 2px solid #222; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Meta}}<div>{{.}}</div>
+{{end}}<div class="parties">
+<div><h2>From</h2>{{range .From}}<div>{{.}}</div>{{end}}</div>
+<div><h2>Bill to</h2>{{range .To}}<div>{{.}}</div>{{end}}</div>
+{{if .ShipTo}}<div><h2>Ship to</h2>{{range .ShipTo}}<div>{{.}}</div>{{end}}</div>{{end}}
+</div>
+<table>
+<tr><th>Description</th><th class="n">Qty</th><th class="n">Unit price</th><th class="n">Amount</th></tr>
+{{range .Lines}}<tr class="line"><td>{{.Label}}</td><td class="n">{{.Quantity}}</td><td class="n">{{.Unit}}</td><td class="n">{{.Amount}}</td></tr>
+{{end}}{{range .Totals}}<tr{{if .Strong}} class="strong"{{end}}><td colspan="3" class="n">{{.Label}}</td><td class="n">{{.Amount}}</td></tr>
+{{end}}</table>
+{{if .Note}}<p>{{.Note}}</p>{{end}}
+</body>
+</html>
+`))
+
+// HTML renders an invoice or credit note as a standalone HTML page.
+func HTML(inv models.Invoice) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := page.Execute(&buf, build(inv)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
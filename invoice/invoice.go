@@ -0,0 +1,126 @@
+package invoice
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/cyzhang39/go_market/models"
+)
+
+// row is one line of the items table, or of the totals under it when only
+// Label and Amount are set.
+type row struct {
+	Label    string
+	Quantity string
+	Unit     string
+	Amount   string
+	Strong   bool
+}
+
+// view is what both renderings show, worked out once from the invoice.
+type view struct {
+	Title  string
+	Meta   []string
+	From   []string
+	To     []string
+	ShipTo []string
+	Lines  []row
+	Totals []row
+	Note   string
+}
+
+func money(m models.Money) string {
+	return m.String() + " " + m.Currency
+}
+
+func address(a *models.Address) []string {
+	if a == nil {
+		return nil
+	}
+	var out []string
+	street := strings.TrimSpace(deref(a.House) + " " + deref(a.Street))
+	city := strings.TrimSpace(deref(a.City) + " " + deref(a.Postal))
+	for _, s := range []string{street, city, deref(a.Region)} {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func party(p models.Party) []string {
+	out := []string{p.Name}
+	if p.Email != "" {
+		out = append(out, p.Email)
+	}
+	return append(out, address(p.Address)...)
+}
+
+func build(inv models.Invoice) view {
+	v := view{
+		Title: "Invoice",
+		Meta: []string{
+			"Number: " + inv.Number,
+			"Issued: " + inv.IssuedAt.UTC().Format("2006-01-02"),
+			"Order: " + inv.OrderID.Hex(),
+			"Ordered: " + inv.OrderTime.UTC().Format("2006-01-02"),
+		},
+		From:   party(inv.From),
+		To:     party(inv.To),
+		ShipTo: address(inv.ShipTo),
+	}
+	if inv.Kind == models.KindCreditNote {
+		v.Title = "Credit note"
+		v.Meta = append(v.Meta, "Credits invoice: "+inv.Credits)
+		if inv.Reason != "" {
+			v.Meta = append(v.Meta, "Reason: "+inv.Reason)
+		}
+		v.Note = "Line amounts include tax."
+	}
+
+	for _, l := range inv.Lines {
+		label := l.Description
+		if l.Variant != "" {
+			label += " (" + l.Variant + ")"
+		}
+		r := row{Label: label, Quantity: strconv.FormatInt(l.Quantity, 10), Amount: money(l.Total)}
+		if l.UnitPrice != nil {
+			r.Unit = money(*l.UnitPrice)
+		}
+		v.Lines = append(v.Lines, r)
+	}
+
+	if inv.Kind == models.KindInvoice {
+		v.Totals = append(v.Totals, row{Label: "Subtotal", Amount: money(inv.Subtotal)})
+		for _, d := range inv.Discounts {
+			label := "Discount: " + d.Name
+			if d.Code != "" {
+				label += " (" + d.Code + ")"
+			}
+			v.Totals = append(v.Totals, row{Label: label, Amount: "-" + money(d.Amount)})
+		}
+		if inv.Shipping != nil {
+			v.Totals = append(v.Totals, row{Label: "Shipping: " + inv.Shipping.Name, Amount: money(inv.Shipping.Cost)})
+		}
+	}
+	for _, t := range inv.Tax {
+		label := t.Name + " " + t.Rate + "%"
+		if t.Inclusive {
+			label += " (included)"
+		}
+		v.Totals = append(v.Totals, row{Label: label, Amount: money(t.Amount)})
+	}
+	total := "Total"
+	if inv.Kind == models.KindCreditNote {
+		total = "Total credited"
+	}
+	v.Totals = append(v.Totals, row{Label: total, Amount: money(inv.Total), Strong: true})
+	return v
+}
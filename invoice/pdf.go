@@ -0,0 +1,251 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/cyzhang39/go_market/models"
+)
+
+// A4 in points, and the margin kept clear on every side.
+const (
+	pageWidth  = 595.0
+	pageHeight = 842.0
+	margin     = 50.0
+)
+
+// Table columns: where descriptions start and where the numbers end.
+const (
+	colQty    = 340.0
+	colUnit   = 440.0
+	colAmount = pageWidth - margin
+	descWidth = 250.0
+)
+
+// helvetica holds the widths of the printable ASCII characters in the
+// standard Helvetica font, in thousandths of the font size. Bold text is
+// measured with them as well, which is close enough for the digits and
+// capitals it is used on.
+var helvetica = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// winAnsi maps the characters outside Latin-1 that the standard fonts'
+// WinAnsiEncoding has.
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+}
+
+// encode turns s into WinAnsi bytes, with ? for what the fonts can not show.
+func encode(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r >= 0x20 && r < 0x7f, r >= 0xa0 && r <= 0xff:
+			out = append(out, byte(r))
+		case winAnsi[r] != 0:
+			out = append(out, winAnsi[r])
+		default:
+			out = append(out, '?')
+		}
+	}
+	return out
+}
+
+func width(s string, size float64) float64 {
+	w := 0
+	for _, b := range encode(s) {
+		if b >= 0x20 && b < 0x7f {
+			w += helvetica[b-0x20]
+		} else {
+			w += 556
+		}
+	}
+	return float64(w) * size / 1000
+}
+
+// fit shortens s with an ellipsis until it is no wider than max.
+func fit(s string, size, max float64) string {
+	if width(s, size) <= max {
+		return s
+	}
+	r := []rune(s)
+	for len(r) > 0 && width(string(r)+"...", size) > max {
+		r = r[:len(r)-1]
+	}
+	return string(r) + "..."
+}
+
+// literal writes s as a PDF string literal.
+func literal(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('(')
+	for _, b := range encode(s) {
+		switch {
+		case b == '(' || b == ')' || b == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(b)
+		case b >= 0x80:
+			fmt.Fprintf(&buf, "\\%03o", b)
+		default:
+			buf.WriteByte(b)
+		}
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// doc lays text out on pages from the top down, starting a new page when
+// the current one is full.
+type doc struct {
+	pages []*bytes.Buffer
+	y     float64
+}
+
+func (d *doc) page() *bytes.Buffer {
+	return d.pages[len(d.pages)-1]
+}
+
+func (d *doc) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pageHeight - margin
+}
+
+// down moves down by h, to a new page if h no longer fits.
+func (d *doc) down(h float64) {
+	if d.y-h < margin {
+		d.newPage()
+	}
+	d.y -= h
+}
+
+func (d *doc) text(x float64, s string, size float64, bold bool) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.page(), "BT /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", font, size, x, d.y, literal(s))
+}
+
+// right writes s so that it ends at x.
+func (d *doc) right(x float64, s string, size float64, bold bool) {
+	d.text(x-width(s, size), s, size, bold)
+}
+
+func (d *doc) rule(from, to, w float64) {
+	fmt.Fprintf(d.page(), "%.1f w %.2f %.2f m %.2f %.2f l S\n", w, from, d.y-4, to, d.y-4)
+}
+
+// PDF renders an invoice or credit note as a PDF document, using only the
+// fonts every PDF reader has.
+func PDF(inv models.Invoice) []byte {
+	v := build(inv)
+	d := &doc{}
+	d.newPage()
+
+	d.down(20)
+	d.text(margin, v.Title, 20, true)
+	d.down(10)
+	for _, m := range v.Meta {
+		d.down(14)
+		d.text(margin, m, 10, false)
+	}
+
+	d.down(30)
+	columns := []struct {
+		title string
+		lines []string
+	}{{"FROM", v.From}, {"BILL TO", v.To}, {"SHIP TO", v.ShipTo}}
+	top, bottom := d.y, d.y
+	for i, col := range columns {
+		if len(col.lines) == 0 {
+			continue
+		}
+		x := margin + float64(i)*180
+		d.y = top
+		d.text(x, col.title, 8, true)
+		for _, l := range col.lines {
+			d.y -= 13
+			d.text(x, fit(l, 10, 170), 10, false)
+		}
+		if d.y < bottom {
+			bottom = d.y
+		}
+	}
+	d.y = bottom
+
+	d.down(34)
+	d.text(margin, "Description", 10, true)
+	d.right(colQty, "Qty", 10, true)
+	d.right(colUnit, "Unit price", 10, true)
+	d.right(colAmount, "Amount", 10, true)
+	d.rule(margin, colAmount, 1)
+	d.down(4)
+	for _, r := range v.Lines {
+		d.down(16)
+		d.text(margin, fit(r.Label, 10, descWidth), 10, false)
+		d.right(colQty, r.Quantity, 10, false)
+		d.right(colUnit, r.Unit, 10, false)
+		d.right(colAmount, r.Amount, 10, false)
+	}
+	d.rule(margin, colAmount, 0.5)
+	d.down(6)
+	for _, r := range v.Totals {
+		if r.Strong {
+			d.down(6)
+			d.rule(colQty, colAmount, 1)
+		}
+		d.down(16)
+		d.right(colUnit, fit(r.Label, 10, colUnit-margin), 10, r.Strong)
+		d.right(colAmount, r.Amount, 10, r.Strong)
+	}
+	if v.Note != "" {
+		d.down(28)
+		d.text(margin, v.Note, 9, false)
+	}
+
+	for i, p := range d.pages {
+		footer := inv.Number + "    Page " + strconv.Itoa(i+1) + " of " + strconv.Itoa(len(d.pages))
+		fmt.Fprintf(p, "BT /F1 8.0 Tf %.2f %.2f Td %s Tj ET\n", margin, margin/2, literal(footer))
+	}
+	return assemble(d.pages)
+}
+
+// assemble writes the pages out as a PDF file: catalog, page tree and the
+// two fonts first, then each page followed by its content.
+func assemble(pages []*bytes.Buffer) []byte {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	kids := ""
+	for i := range pages {
+		kids += fmt.Sprintf("%d 0 R ", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids, len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, p := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.Len(), p.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"log"
 	"os"
+	"time"
 
+	"github.com/cyzhang39/go_market/carrier"
+	"github.com/cyzhang39/go_market/currency"
 	"github.com/cyzhang39/go_market/db"
 	"github.com/cyzhang39/go_market/middleware"
+	"github.com/cyzhang39/go_market/payment"
 	"github.com/cyzhang39/go_market/routes"
 	"github.com/cyzhang39/go_market/src"
 	"github.com/gin-gonic/gin"
@@ -17,8 +23,38 @@ func main() {
 		port = "8000"
 	}
 
+	err := db.MigrateMoney(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Money migration failed: %v", err)
+	}
+	err = db.MigrateCartQuantities(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Cart quantity migration failed: %v", err)
+	}
+	err = db.MigrateCarts(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Cart migration failed: %v", err)
+	}
+	err = db.MigrateOrders(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Order migration failed: %v", err)
+	}
+	err = db.MigrateAddresses(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Address migration failed: %v", err)
+	}
+
+	rates := os.Getenv("RATES_FILE")
+	if rates == "" {
+		rates = "rates.json"
+	}
+	err = currency.Load(rates)
+	if err != nil {
+		log.Println("Exchange rates not loaded, prices stay in their listing currency:", err)
+	}
+
 	server := src.NewApp(db.CollectionDB(db.Client, "products"), db.CollectionDB(db.Client, "users"))
-	err := db.InitChats(db.Client, "goMarket")
+	err = db.InitChats(db.Client, "goMarket")
 	if err != nil {
 		log.Fatalf("Chat initialization failed: %v", err)
 	}
@@ -26,22 +62,143 @@ func main() {
 	if err != nil {
 		log.Fatalf("Chat initialization failed: %v", err)
 	}
+	err = db.InitPrices(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Price initialization failed: %v", err)
+	}
+	err = db.InitCategories(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Category initialization failed: %v", err)
+	}
+	err = db.InitRelated(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Related products initialization failed: %v", err)
+	}
+	err = db.InitWishlists(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Wishlist initialization failed: %v", err)
+	}
+	err = db.InitCarts(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Cart initialization failed: %v", err)
+	}
+	err = db.InitPromotions(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Promotion initialization failed: %v", err)
+	}
+	err = db.InitTax(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Tax initialization failed: %v", err)
+	}
+	err = db.InitShipping(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Shipping initialization failed: %v", err)
+	}
+	err = db.InitOrders(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Orders initialization failed: %v", err)
+	}
+	err = db.InitIdempotency(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Idempotency initialization failed: %v", err)
+	}
+	err = db.InitPayments(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Payments initialization failed: %v", err)
+	}
+	err = db.InitRefunds(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Refunds initialization failed: %v", err)
+	}
+	err = db.InitReturns(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Returns initialization failed: %v", err)
+	}
+	err = db.InitInvoices(db.Client, "goMarket")
+	if err != nil {
+		log.Fatalf("Invoices initialization failed: %v", err)
+	}
+	if name := os.Getenv("INVOICE_ISSUER_NAME"); name != "" {
+		db.InvoiceIssuer.Name = name
+	}
+	db.InvoiceIssuer.Email = os.Getenv("INVOICE_ISSUER_EMAIL")
+
+	// the mock provider approves payments without taking money, so it is
+	// only there when asked for
+	if os.Getenv("PAYMENT_MOCK") == "1" {
+		secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+		if secret == "" {
+			b := make([]byte, 32)
+			_, _ = rand.Read(b)
+			secret = hex.EncodeToString(b)
+			log.Println("PAYMENT_WEBHOOK_SECRET not set, mock payment webhooks use a random secret")
+		}
+		hook := os.Getenv("PAYMENT_WEBHOOK_URL")
+		if hook == "" {
+			hook = "http://localhost:" + port + "/payments/webhook/mock"
+		}
+		payment.Register(payment.NewMock([]byte(secret), hook))
+	}
+	// the fake carrier makes up deliveries, so it is only there when asked for
+	if os.Getenv("CARRIER_FAKE") == "1" {
+		carrierSecret := os.Getenv("CARRIER_WEBHOOK_SECRET")
+		if carrierSecret == "" {
+			b := make([]byte, 32)
+			_, _ = rand.Read(b)
+			carrierSecret = hex.EncodeToString(b)
+			log.Println("CARRIER_WEBHOOK_SECRET not set, fake carrier webhooks use a random secret")
+		}
+		carrier.Register(carrier.NewFake([]byte(carrierSecret)))
+	}
+	go db.PriceScheduler(db.CollectionDB(db.Client, "products"), time.Minute)
+	go db.RelatedBuilder(db.Orders, time.Hour)
+	go db.TrackingPoller(10 * time.Minute)
 
 	router := gin.New()
 	router.Use(gin.Logger())
 	routes.Routes(router)
+	routes.PaymentHooks(router)
+	routes.TrackingHooks(router)
+	router.POST("/guest/cart", src.NewGuestCart())
+	guest := router.Group("/guest", middleware.GuestCart())
+	guest.GET("/add", server.CartAdd())
+	guest.POST("/cart/increment", server.CartAdd())
+	guest.POST("/cart/decrement", server.CartDecrement())
+	guest.PUT("/cart/quantity", server.CartQuantity())
+	guest.GET("/remove", server.CartRemove())
+	guest.GET("/list", src.CartGet())
 	router.Use(middleware.Authenticate())
+	router.Use(middleware.Currency())
 	router.GET("/add", server.CartAdd())
+	router.POST("/cart/increment", server.CartAdd())
+	router.POST("/cart/decrement", server.CartDecrement())
+	router.PUT("/cart/quantity", server.CartQuantity())
 	router.GET("/remove", server.CartRemove())
 	router.GET("/list", src.CartGet())
-	router.GET("/checkout", server.CartBuy())
-	router.GET("/buy", server.Buy())
-	router.POST("/addressadd", src.AddressAdd())
-	router.PUT("/addresshomeedit", src.HomeEdit())
-	router.PUT("/addressworkedit", src.WorkEdit())
-	router.GET("/addressdel", src.AddressDelete())
+	router.POST("/checkout", middleware.Idempotent(), server.CartBuy())
+	router.POST("/buy", middleware.Idempotent(), server.Buy())
+	router.POST("/saveforlater", server.SaveForLater())
+	router.GET("/addresses", src.AddressList())
+	router.POST("/addresses", src.AddressAdd())
+	router.PATCH("/addresses/:aid", src.AddressEdit())
+	router.DELETE("/addresses/:aid", src.AddressDelete())
 	routes.ChatRoutes(router)
 	routes.ReviewRoutes(router)
+	routes.PriceRoutes(router)
+	routes.CurrencyRoutes(router)
+	routes.CategoryRoutes(router)
+	routes.RelatedRoutes(router)
+	routes.WishlistRoutes(router)
+	routes.PromotionRoutes(router)
+	routes.TaxRoutes(router)
+	routes.ShippingRoutes(router)
+	routes.OrderRoutes(router)
+	routes.PaymentRoutes(router)
+	routes.RefundRoutes(router)
+	routes.ReturnRoutes(router)
+	routes.InvoiceRoutes(router)
+	routes.FulfilmentRoutes(router)
+	routes.TrackingRoutes(router)
 
 
 	log.Fatal(router.Run(":" + port))
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CartTokenHeader carries the token of a guest cart, on guest cart requests
+// and on login to merge the guest cart into the user's.
+const CartTokenHeader = "Cart-Token"
+
+// GuestCart lets visitors who have not signed in use the cart routes with
+// the token of their guest cart instead of a user id.
+func GuestCart() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token := ctx.GetHeader(CartTokenHeader)
+		if token == "" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "No cart token provided"})
+			ctx.Abort()
+			return
+		}
+		ctx.Set("cartToken", token)
+		ctx.Next()
+	}
+}
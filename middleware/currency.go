@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/db"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var users *mongo.Collection = db.CollectionDB(db.Client, "users")
+
+// Currency lets currency.Display fall back on the user's saved preference
+// for authenticated requests. The Accept-Currency header still wins, and the
+// user is only loaded when a handler shows a price.
+func Currency() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		uid := ctx.GetString("uid")
+		currency.Prefer(ctx, func() string {
+			c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return db.UserCurrency(c, users, uid)
+		})
+		ctx.Next()
+	}
+}
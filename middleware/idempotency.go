@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cyzhang39/go_market/db"
+	"github.com/gin-gonic/gin"
+)
+
+// IdempotencyHeader carries a client chosen key that makes repeats of a
+// request safe: the first one runs, later ones get its response back.
+const IdempotencyHeader = "Idempotency-Key"
+
+// ReplayedHeader marks a response replayed for a repeated key.
+const ReplayedHeader = "Idempotent-Replayed"
+
+// recorder keeps a copy of the response written through it.
+type recorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// final tells whether a response settles a request for good. Conflicts,
+// such as a cart that changed or ran out of stock, and unprocessable
+// requests may go through when sent again, like server errors.
+func final(status int) bool {
+	return status < http.StatusInternalServerError && status != http.StatusConflict && status != http.StatusUnprocessableEntity
+}
+
+// fingerprint identifies a request by its method, path, query and body.
+func fingerprint(ctx *gin.Context, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(ctx.Request.Method + " " + ctx.Request.URL.Path + "?" + ctx.Request.URL.Query().Encode() + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Idempotent runs a request sent with an Idempotency-Key header only once
+// per user and key. Repeats get the stored response back, a different
+// request under the same key is rejected, and a repeat while the first is
+// still running is told to wait. Only final responses are stored; after
+// a conflict or a server error the key is free again for a retry. Requests
+// without the header run as usual. It must run after Authenticate.
+func Idempotent() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.GetHeader(IdempotencyHeader)
+		if key == "" {
+			ctx.Next()
+			return
+		}
+		if len(key) > 255 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			ctx.Abort()
+			return
+		}
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "could not read request body"})
+			ctx.Abort()
+			return
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		rec, run, err := db.ClaimKey(c, ctx.GetString("uid"), key, fingerprint(ctx, body))
+		cancel()
+		switch {
+		case err == db.ErrKeyReused:
+			ctx.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			ctx.Abort()
+			return
+		case err == db.ErrKeyInFlight:
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			ctx.Abort()
+			return
+		case err != nil:
+			log.Println(err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "could not check idempotency key"})
+			ctx.Abort()
+			return
+		case !run:
+			ctx.Header(ReplayedHeader, "true")
+			ctx.Data(rec.Status, rec.ContentType, rec.Body)
+			ctx.Abort()
+			return
+		}
+
+		w := &recorder{ResponseWriter: ctx.Writer}
+		ctx.Writer = w
+		finished := false
+		defer func() {
+			if finished {
+				return
+			}
+			c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := db.ReleaseKey(c, rec.ID); err != nil {
+				log.Println(err)
+			}
+		}()
+
+		ctx.Next()
+
+		if !final(w.Status()) {
+			return
+		}
+		// the request took effect, so the key stays taken even if storing
+		// its response fails
+		finished = true
+		c, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := db.FinishKey(c, rec.ID, w.Status(), w.Header().Get("Content-Type"), w.body.Bytes()); err != nil {
+			log.Println(err)
+		}
+	}
+}
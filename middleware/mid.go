@@ -2,6 +2,8 @@ package middleware
 
 import (
 	"net/http"
+	"os"
+	"strings"
 
 	token "github.com/cyzhang39/go_market/auth"
 	"github.com/gin-gonic/gin"
@@ -26,3 +28,28 @@ func Authenticate() gin.HandlerFunc {
 		ctx.Next()
 	}
 }
+
+// Admin only lets through users whose email is listed in ADMIN_EMAILS. It
+// must run after Authenticate.
+func Admin() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !IsAdmin(ctx.GetString("email")) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "admin only"})
+			ctx.Abort()
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func IsAdmin(email string) bool {
+	if email == "" {
+		return false
+	}
+	for _, admin := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if strings.EqualFold(strings.TrimSpace(admin), email) {
+			return true
+		}
+	}
+	return false
+}
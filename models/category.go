@@ -0,0 +1,124 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	AttrString = "string"
+	AttrNumber = "number"
+	AttrBool   = "bool"
+	AttrEnum   = "enum"
+)
+
+var attrKey = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+type Category struct {
+	ID         primitive.ObjectID `json:"id" bson:"id"`
+	Name       string             `json:"name" bson:"name" validate:"required,min=1,max=100"`
+	Attributes []AttributeDef     `json:"attributes" bson:"attributes" validate:"dive"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt  time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+// AttributeDef describes one spec products in a category can carry, such as
+// weight in kg or a material picked from a fixed list.
+type AttributeDef struct {
+	Key      string   `json:"key" bson:"key" validate:"required"`
+	Label    string   `json:"label" bson:"label"`
+	Type     string   `json:"type" bson:"type" validate:"required,oneof=string number bool enum"`
+	Unit     string   `json:"unit" bson:"unit"`
+	Allowed  []string `json:"allowed" bson:"allowed"`
+	Required bool     `json:"required" bson:"required"`
+}
+
+// Check rejects schemas that could not be validated against, like duplicate
+// keys or an enum without values.
+func (c Category) Check() error {
+	seen := map[string]bool{}
+	for _, def := range c.Attributes {
+		if !attrKey.MatchString(def.Key) {
+			return fmt.Errorf("attribute key %q must be lower case letters, digits or _", def.Key)
+		}
+		if seen[def.Key] {
+			return fmt.Errorf("duplicate attribute %q", def.Key)
+		}
+		seen[def.Key] = true
+		if def.Type == AttrEnum && len(def.Allowed) == 0 {
+			return fmt.Errorf("enum attribute %q needs allowed values", def.Key)
+		}
+	}
+	return nil
+}
+
+func (c Category) Attribute(key string) (AttributeDef, bool) {
+	for _, def := range c.Attributes {
+		if def.Key == key {
+			return def, true
+		}
+	}
+	return AttributeDef{}, false
+}
+
+// Validate checks a product's attributes against the category schema and
+// returns them with only known keys kept.
+func (c Category) Validate(attrs map[string]interface{}) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	for key := range attrs {
+		if _, ok := c.Attribute(key); !ok {
+			return nil, fmt.Errorf("unknown attribute %q for category %s", key, c.Name)
+		}
+	}
+	for _, def := range c.Attributes {
+		v, ok := attrs[def.Key]
+		if !ok || v == nil {
+			if def.Required {
+				return nil, fmt.Errorf("attribute %q is required", def.Key)
+			}
+			continue
+		}
+		if err := def.check(v); err != nil {
+			return nil, err
+		}
+		out[def.Key] = v
+	}
+	return out, nil
+}
+
+func (def AttributeDef) check(v interface{}) error {
+	switch def.Type {
+	case AttrNumber:
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("attribute %q must be a number", def.Key)
+		}
+	case AttrBool:
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("attribute %q must be true or false", def.Key)
+		}
+	case AttrString, AttrEnum:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("attribute %q must be a string", def.Key)
+		}
+		if def.Type == AttrEnum && !def.allows(s) {
+			return fmt.Errorf("attribute %q must be one of %v", def.Key, def.Allowed)
+		}
+	default:
+		return errors.New("unknown attribute type " + def.Type)
+	}
+	return nil
+}
+
+func (def AttributeDef) allows(s string) bool {
+	for _, a := range def.Allowed {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
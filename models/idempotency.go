@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// IdempotencyKey remembers a request made with an Idempotency-Key header and,
+// once it finished, the response to replay for repeats of it. Fingerprint
+// identifies the request so the key can not be reused for a different one.
+type IdempotencyKey struct {
+	ID          primitive.ObjectID `json:"id" bson:"id"`
+	UID         string             `json:"uid" bson:"uid"`
+	Key         string             `json:"key" bson:"key"`
+	Fingerprint string             `json:"fingerprint" bson:"fingerprint"`
+	Done        bool               `json:"done" bson:"done"`
+	Status      int                `json:"status,omitempty" bson:"status,omitempty"`
+	ContentType string             `json:"contentType,omitempty" bson:"contentType,omitempty"`
+	Body        []byte             `json:"-" bson:"body,omitempty"`
+	LockedAt    time.Time          `json:"lockedAt" bson:"lockedAt"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt   time.Time          `json:"expiresAt" bson:"expiresAt"`
+}
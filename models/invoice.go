@@ -0,0 +1,67 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	KindInvoice    = "invoice"
+	KindCreditNote = "credit_note"
+)
+
+// Party is who an invoice is from or made out to.
+type Party struct {
+	Name    string   `json:"name" bson:"name"`
+	Email   string   `json:"email,omitempty" bson:"email,omitempty"`
+	Address *Address `json:"address,omitempty" bson:"address,omitempty"`
+}
+
+// InvoiceLine is one line of an invoice. On credit notes Total is what the
+// line was refunded, tax included.
+type InvoiceLine struct {
+	ID          primitive.ObjectID `json:"id" bson:"id"`
+	Variant     string             `json:"variant,omitempty" bson:"variant,omitempty"`
+	Description string             `json:"description" bson:"description"`
+	Quantity    int64              `json:"quantity" bson:"quantity"`
+	UnitPrice   *Money             `json:"unitPrice,omitempty" bson:"unitPrice,omitempty"`
+	Total       Money              `json:"total" bson:"total"`
+}
+
+// InvoiceTax is the tax of one rate on an invoice.
+type InvoiceTax struct {
+	Name      string `json:"name" bson:"name"`
+	Rate      string `json:"rate" bson:"rate"`
+	Inclusive bool   `json:"inclusive" bson:"inclusive"`
+	Amount    Money  `json:"amount" bson:"amount"`
+}
+
+// Invoice is an invoice for an order, or a credit note for one of its
+// refunds. Both are numbered in sequence per seller, or for the marketplace
+// when Seller is not set, and never change once issued. Credits is the
+// number of the invoice a credit note corrects. All amounts are in the
+// order's currency.
+type Invoice struct {
+	ID        primitive.ObjectID  `json:"id" bson:"id"`
+	Kind      string              `json:"kind" bson:"kind"`
+	Number    string              `json:"number" bson:"number"`
+	Seller    *primitive.ObjectID `json:"seller,omitempty" bson:"seller,omitempty"`
+	OrderID   primitive.ObjectID  `json:"orderId" bson:"orderId"`
+	RefundID  *primitive.ObjectID `json:"refundId,omitempty" bson:"refundId,omitempty"`
+	Credits   string              `json:"credits,omitempty" bson:"credits,omitempty"`
+	UID       primitive.ObjectID  `json:"uid" bson:"uid"`
+	From      Party               `json:"from" bson:"from"`
+	To        Party               `json:"to" bson:"to"`
+	ShipTo    *Address            `json:"shipTo,omitempty" bson:"shipTo,omitempty"`
+	Lines     []InvoiceLine       `json:"lines" bson:"lines"`
+	Subtotal  Money               `json:"subtotal" bson:"subtotal"`
+	Discounts []AppliedDiscount   `json:"discounts,omitempty" bson:"discounts,omitempty"`
+	Shipping  *ShippingQuote      `json:"shipping,omitempty" bson:"shipping,omitempty"`
+	Tax       []InvoiceTax        `json:"tax,omitempty" bson:"tax,omitempty"`
+	TaxTotal  Money               `json:"taxTotal" bson:"taxTotal"`
+	Total     Money               `json:"total" bson:"total"`
+	Reason    string              `json:"reason,omitempty" bson:"reason,omitempty"`
+	OrderTime time.Time           `json:"orderTime" bson:"orderTime"`
+	IssuedAt  time.Time           `json:"issuedAt" bson:"issuedAt"`
+}
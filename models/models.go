@@ -20,9 +20,8 @@ type User struct {
 	CreateTime  time.Time          `json:"createTime"`
 	UpdateTime  time.Time          `json:"updateTime"`
 	UID         string             `json:"uid"`
-	Cart        []UserProd         `json:"cart" bson:"cart"`
+	Currency    string             `json:"currency" bson:"currency"`
 	AddressInfo []Address          `json:"addressInfo" bson:"addressInfo"`
-	Status      []Order            `json:"status" bson:"status"`
 }
 
 type Verification struct {
@@ -31,44 +30,155 @@ type Verification struct {
 }
 
 type Product struct {
-	ID          primitive.ObjectID `bson:"id"`
-	Name        *string            `json:"name"`
-	Price       *float64           `json:"price" validate:"gte=0"`
-	Img         *string            `json:"img"`
-	Description *string            `json:"description" bson:"description"`
-	RatingAvg   float32            `json:"ratingAvg" bson:"ratingAvg"`
-	RatingCnt   int64              `json:"ratingCnt" bson:"ratingCnt"`
-	RatingSum   float64            `json:"ratingSum" bson:"ratingSum"`
+	ID           primitive.ObjectID     `bson:"id"`
+	Name         *string                `json:"name"`
+	Price        *Money                 `json:"price" validate:"required"`
+	DisplayPrice *Money                 `json:"displayPrice,omitempty" bson:"-"`
+	Img          *string                `json:"img"`
+	Description  *string                `json:"description" bson:"description"`
+	RatingAvg    float32                `json:"ratingAvg" bson:"ratingAvg"`
+	RatingCnt    int64                  `json:"ratingCnt" bson:"ratingCnt"`
+	RatingSum    float64                `json:"ratingSum" bson:"ratingSum"`
+	MaxPerOrder  int64                  `json:"maxPerOrder" bson:"maxPerOrder" validate:"gte=0"`
+	Category     *primitive.ObjectID    `json:"category" bson:"category"`
+	Attributes   map[string]interface{} `json:"attributes" bson:"attributes"`
+	TaxClass     string                 `json:"taxClass" bson:"taxClass" validate:"max=50"`
+	Weight       int64                  `json:"weight" bson:"weight" validate:"gte=0"`
+	Stock        *int64                 `json:"stock,omitempty" bson:"stock,omitempty" validate:"omitempty,gte=0"`
+	Seller       *primitive.ObjectID    `json:"seller,omitempty" bson:"seller,omitempty"`
 }
 
 type UserProd struct {
-	ID     primitive.ObjectID `bson:"id"`
-	Name   *string            `json:"name" bson:"name"`
-	Price  float64            `json:"price" bson:"price"`
-	Rating *float32           `json:"rating" bson:"rating"`
-	Img    *string            `json:"img" bson:"img"`
+	ID           primitive.ObjectID  `bson:"id"`
+	Name         *string             `json:"name" bson:"name"`
+	Price        Money               `json:"price" bson:"price"`
+	DisplayPrice *Money              `json:"displayPrice,omitempty" bson:"-"`
+	Rating       *float32            `json:"rating" bson:"rating"`
+	Img          *string             `json:"img" bson:"img"`
+	Variant      string              `json:"variant,omitempty" bson:"variant"`
+	Quantity     int64               `json:"quantity" bson:"quantity"`
+	TaxClass     string              `json:"taxClass,omitempty" bson:"taxClass,omitempty"`
+	Weight       int64               `json:"weight,omitempty" bson:"weight,omitempty"`
+	Seller       *primitive.ObjectID `json:"seller,omitempty" bson:"seller,omitempty"`
 }
 
+// Units is the line quantity, counting lines stored before quantities
+// existed as one.
+func (p UserProd) Units() int64 {
+	if p.Quantity < 1 {
+		return 1
+	}
+	return p.Quantity
+}
+
+// LineTotal is the unit price times the quantity.
+func (p UserProd) LineTotal() Money {
+	return p.Price.Mul(p.Units())
+}
+
+// Cart belongs either to a signed in user, keyed by UID, or to a guest,
+// keyed by the token handed out when it was created. Guest carts are
+// removed by the database once ExpiresAt passes.
+type Cart struct {
+	ID        primitive.ObjectID  `json:"id" bson:"id"`
+	UID       *primitive.ObjectID `json:"uid,omitempty" bson:"uid,omitempty"`
+	Token     string              `json:"-" bson:"token,omitempty"`
+	Items     []UserProd          `json:"items" bson:"items"`
+	Coupons   []string            `json:"coupons" bson:"coupons"`
+	UpdatedAt time.Time           `json:"updatedAt" bson:"updatedAt"`
+	ExpiresAt *time.Time          `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+}
+
+// PriceNotice tells the buyer a cart line now costs something else than
+// when it was added.
+type PriceNotice struct {
+	ID       primitive.ObjectID `json:"id"`
+	Name     *string            `json:"name"`
+	Variant  string             `json:"variant,omitempty"`
+	OldPrice Money              `json:"oldPrice"`
+	NewPrice Money              `json:"newPrice"`
+}
+
+// CartReview is a cart checked against the current catalogue: the lines
+// that can be bought at today's prices, what changed, and what is gone.
+// Confirm is set when the buyer has to agree to the changes first.
+type CartReview struct {
+	Items        []UserProd    `json:"items"`
+	PriceChanges []PriceNotice `json:"priceChanges"`
+	Unavailable  []UserProd    `json:"unavailable"`
+	Confirm      string        `json:"confirm,omitempty"`
+}
+
+// Address is one of a user's addresses. Label is the user's own name for
+// it, such as "home" or "office", and Name and Phone are who takes the
+// parcel. DefaultShipping and DefaultBilling mark the address orders use
+// when they name none; each is set on at most one address.
 type Address struct {
-	ID     primitive.ObjectID `bson:"id"`
-	House  *string            `json:"house" bson:"house"`
-	Street *string            `json:"street" bson:"street"`
-	City   *string            `json:"city" bson:"city"`
-	Postal *string            `json:"postal" bson:"postal"`
+	ID              primitive.ObjectID `json:"id" bson:"id"`
+	Label           string             `json:"label" bson:"label" validate:"max=50"`
+	Name            string             `json:"name" bson:"name" validate:"max=100"`
+	Phone           string             `json:"phone" bson:"phone" validate:"max=30"`
+	House           *string            `json:"house" bson:"house"`
+	Street          *string            `json:"street" bson:"street"`
+	City            *string            `json:"city" bson:"city"`
+	Postal          *string            `json:"postal" bson:"postal"`
+	Region          *string            `json:"region" bson:"region"`
+	DefaultShipping bool               `json:"defaultShipping" bson:"defaultShipping"`
+	DefaultBilling  bool               `json:"defaultBilling" bson:"defaultBilling"`
 }
 
+// Order is a placed order in the orders collection. Subtotal is the lines
+// at their prices; Price is what the buyer pays after discounts, with tax
+// and shipping. Seller is whose items the order holds. Status follows the
+// lifecycle in order.go and History records every move. Refunded is what
+// was given back so far, and RefundStatus says whether that is part or all
+// of Price. RefundError is set while a cancelled order still waits for its
+// refund, with why the last attempt failed, and cancelling it again retries
+// the refund. ShipTo is where the order goes and BillTo who it is billed to.
+// Packed lists the lines the seller has packed so far, and Shipment how the
+// order was sent once it ships. ReturnCount counts the returns requested
+// for it.
+// A checkout with items from several sellers is split: the parent order
+// holds the whole cart and is what the buyer pays, and each seller gets a
+// sub-order with its own items, totals, shipping and fulfilment, linked by
+// ParentID and SubOrderIDs. SubOrders carries them along when shown.
 type Order struct {
-	ID        primitive.ObjectID `bson:"id"`
-	Cart      []UserProd         `json:"cart" bson:"cart"`
-	OrderTime time.Time          `json:"orderTime" bson:"orderTime"`
-	Price     float64            `json:"price" bson:"price"`
-	DC        *float32           `json:"dc" bson:"dc"`
-	Payment   Payment            `json:"payment" bson:"payment"`
+	ID           primitive.ObjectID   `json:"id" bson:"id"`
+	UID          primitive.ObjectID   `json:"uid" bson:"uid"`
+	Seller       *primitive.ObjectID  `json:"seller,omitempty" bson:"seller,omitempty"`
+	Cart         []UserProd           `json:"cart" bson:"cart"`
+	OrderTime    time.Time            `json:"orderTime" bson:"orderTime"`
+	Subtotal     Money                `json:"subtotal" bson:"subtotal"`
+	Price        Money                `json:"price" bson:"price"`
+	DisplayPrice *Money               `json:"displayPrice,omitempty" bson:"-"`
+	DC           *Money               `json:"dc" bson:"dc"`
+	Promotions   []AppliedDiscount    `json:"promotions,omitempty" bson:"promotions,omitempty"`
+	Tax          []TaxLine            `json:"tax,omitempty" bson:"tax,omitempty"`
+	TaxTotal     *Money               `json:"taxTotal,omitempty" bson:"taxTotal,omitempty"`
+	Shipping     *ShippingQuote       `json:"shipping,omitempty" bson:"shipping,omitempty"`
+	ShipTo       *Address             `json:"shipTo,omitempty" bson:"shipTo,omitempty"`
+	BillTo       *Address             `json:"billTo,omitempty" bson:"billTo,omitempty"`
+	Payment      Payment              `json:"payment" bson:"payment"`
+	Status       string               `json:"status" bson:"status"`
+	History      []OrderTransition    `json:"history" bson:"history"`
+	Refunded     *Money               `json:"refunded,omitempty" bson:"refunded,omitempty"`
+	RefundStatus string               `json:"refundStatus,omitempty" bson:"refundStatus,omitempty"`
+	RefundError  string               `json:"refundError,omitempty" bson:"refundError,omitempty"`
+	Packed       []PackedLine         `json:"packed,omitempty" bson:"packed,omitempty"`
+	Shipment     *Shipment            `json:"shipment,omitempty" bson:"shipment,omitempty"`
+	ReturnCount  int64                `json:"returnCount,omitempty" bson:"returnCount,omitempty"`
+	ParentID     *primitive.ObjectID  `json:"parentId,omitempty" bson:"parentId,omitempty"`
+	SubOrderIDs  []primitive.ObjectID `json:"subOrderIds,omitempty" bson:"subOrders,omitempty"`
+	SubOrders    []Order              `json:"subOrders,omitempty" bson:"-"`
 }
 
+// Payment is how an order is paid: cash on delivery, or online through a
+// provider with the current payment intent.
 type Payment struct {
-	Online bool
-	Cash   bool
+	Online   bool                `json:"online" bson:"online"`
+	Cash     bool                `json:"cash" bson:"cash"`
+	Provider string              `json:"provider,omitempty" bson:"provider,omitempty"`
+	IntentID *primitive.ObjectID `json:"intentId,omitempty" bson:"intentId,omitempty"`
 }
 
 type Chat struct {
@@ -104,3 +214,59 @@ type Review struct {
 	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
 	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
 }
+
+type PriceChange struct {
+	ID        primitive.ObjectID  `json:"id" bson:"id"`
+	PID       primitive.ObjectID  `json:"pid" bson:"pid"`
+	OldPrice  Money               `json:"oldPrice" bson:"oldPrice"`
+	NewPrice  Money               `json:"newPrice" bson:"newPrice"`
+	Reason    string              `json:"reason" bson:"reason"`
+	ChangedBy *primitive.ObjectID `json:"changedBy" bson:"changedBy"`
+	ChangedAt time.Time           `json:"changedAt" bson:"changedAt"`
+}
+
+// PriceSchedule is a future-dated price change. With EndAt set it is a sale
+// and the scheduler restores Regular once the window closes.
+type PriceSchedule struct {
+	ID        primitive.ObjectID `json:"id" bson:"id"`
+	PID       primitive.ObjectID `json:"pid" bson:"pid"`
+	Price     Money              `json:"price" bson:"price"`
+	Regular   Money              `json:"regular" bson:"regular"`
+	StartAt   time.Time          `json:"startAt" bson:"startAt"`
+	EndAt     *time.Time         `json:"endAt" bson:"endAt"`
+	Status    string             `json:"status" bson:"status"`
+	CreatedBy primitive.ObjectID `json:"createdBy" bson:"createdBy"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// Related holds the products most often bought together with PID, best
+// match first.
+type Related struct {
+	PID       primitive.ObjectID `json:"pid" bson:"pid"`
+	Items     []RelatedItem      `json:"items" bson:"items"`
+	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+type RelatedItem struct {
+	PID   primitive.ObjectID `json:"pid" bson:"pid"`
+	Score float64            `json:"score" bson:"score"`
+	Count int64              `json:"count" bson:"count"`
+}
+
+type Wishlist struct {
+	ID         primitive.ObjectID `json:"id" bson:"id"`
+	UID        primitive.ObjectID `json:"uid" bson:"uid"`
+	Name       string             `json:"name" bson:"name" validate:"required,min=1,max=100"`
+	Kind       string             `json:"kind" bson:"kind"`
+	Public     bool               `json:"public" bson:"public"`
+	ShareToken string             `json:"shareToken,omitempty" bson:"shareToken,omitempty"`
+	Items      []WishItem         `json:"items" bson:"items"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt  time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+// WishItem keeps the product as it was when saved, price included.
+type WishItem struct {
+	UserProd `bson:",inline"`
+	AddedAt  time.Time `json:"addedAt" bson:"addedAt"`
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const DefaultCurrency = "USD"
+
+var (
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrUnknownCurrency  = errors.New("unknown currency")
+	ErrInvalidAmount    = errors.New("invalid amount")
+)
+
+// Exponents is the number of minor units per currency, e.g. cents for USD.
+var Exponents = map[string]int{
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"CAD": 2,
+	"AUD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"INR": 2,
+	"MXN": 2,
+	"JPY": 0,
+	"KRW": 0,
+}
+
+// Money is an exact amount in the currency's minor units. It is stored as
+// {amount, currency} in mongo and encoded as a decimal string in JSON so that
+// clients never see a float.
+type Money struct {
+	Amount   int64  `bson:"amount" validate:"gte=0"`
+	Currency string `bson:"currency" validate:"required,len=3"`
+}
+
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+func Exponent(currency string) int {
+	if e, ok := Exponents[currency]; ok {
+		return e
+	}
+	return 2
+}
+
+func KnownCurrency(currency string) bool {
+	_, ok := Exponents[currency]
+	return ok
+}
+
+// ParseMoney reads a decimal string such as "9.99" into minor units. It
+// rejects more decimal places than the currency allows instead of rounding.
+func ParseMoney(s string, currency string) (Money, error) {
+	if !KnownCurrency(currency) {
+		return Money{}, ErrUnknownCurrency
+	}
+	s = strings.TrimSpace(s)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	exp := Exponent(currency)
+	if whole == "" || len(frac) > exp || !digits(whole) || !digits(frac) {
+		return Money{}, ErrInvalidAmount
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	n, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return Money{}, ErrInvalidAmount
+	}
+	if neg {
+		n = -n
+	}
+	return Money{Amount: n, Currency: currency}, nil
+}
+
+// digits reports whether s is made of decimal digits only, so signs are
+// only read once, in front.
+func digits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (m Money) String() string {
+	exp := Exponent(m.Currency)
+	n := m.Amount
+	sign := ""
+	if n < 0 {
+		sign = "-"
+		n = -n
+	}
+	s := strconv.FormatInt(n, 10)
+	if exp == 0 {
+		return sign + s
+	}
+	if len(s) <= exp {
+		s = strings.Repeat("0", exp-len(s)+1) + s
+	}
+	return sign + s[:len(s)-exp] + "." + s[len(s)-exp:]
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// Add sums two amounts. A zero value without a currency takes the other's
+// currency so it can be used as an accumulator.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency == "" {
+		m.Currency = o.Currency
+	}
+	if o.Currency != "" && o.Currency != m.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	m.Amount += o.Amount
+	return m, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	o.Amount = -o.Amount
+	return m.Add(o)
+}
+
+func (m Money) Mul(n int64) Money {
+	m.Amount *= n
+	return m
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.String(), m.Currency})
+}
+
+// UnmarshalJSON accepts {"amount": "9.99", "currency": "USD"} as well as a
+// bare number or string, which is read in DefaultCurrency.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+
+	var obj struct {
+		Amount   json.RawMessage `json:"amount"`
+		Currency string          `json:"currency"`
+	}
+	raw := b
+	currency := DefaultCurrency
+	if len(b) > 0 && b[0] == '{' {
+		if err := json.Unmarshal(b, &obj); err != nil {
+			return err
+		}
+		raw = bytes.TrimSpace(obj.Amount)
+		if obj.Currency != "" {
+			currency = strings.ToUpper(obj.Currency)
+		}
+	}
+
+	var amount string
+	if len(raw) > 0 && raw[0] == '"' {
+		if err := json.Unmarshal(raw, &amount); err != nil {
+			return err
+		}
+	} else {
+		var num json.Number
+		if err := json.Unmarshal(raw, &num); err != nil {
+			return fmt.Errorf("money: %w", ErrInvalidAmount)
+		}
+		amount = num.String()
+	}
+
+	v, err := ParseMoney(amount, currency)
+	if err != nil {
+		return fmt.Errorf("money %q %s: %w", amount, currency, err)
+	}
+	*m = v
+	return nil
+}
@@ -0,0 +1,67 @@
+package models
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		want     int64
+		err      error
+	}{
+		{"9.99", "USD", 999, nil},
+		{"10", "USD", 1000, nil},
+		{"0.5", "EUR", 50, nil},
+		{" 12.30 ", "GBP", 1230, nil},
+		{"-4.25", "USD", -425, nil},
+		{"1500", "JPY", 1500, nil},
+		{"0", "USD", 0, nil},
+		{"9.999", "USD", 0, ErrInvalidAmount},
+		{"1.5", "JPY", 0, ErrInvalidAmount},
+		{".50", "USD", 0, ErrInvalidAmount},
+		{"", "USD", 0, ErrInvalidAmount},
+		{"abc", "USD", 0, ErrInvalidAmount},
+		{"1,00", "USD", 0, ErrInvalidAmount},
+		{"--1", "USD", 0, ErrInvalidAmount},
+		{"+1", "USD", 0, ErrInvalidAmount},
+		{"1.-5", "USD", 0, ErrInvalidAmount},
+		{"1.00", "XYZ", 0, ErrUnknownCurrency},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in, tt.currency)
+		if err != tt.err {
+			t.Errorf("ParseMoney(%q, %s) error = %v, want %v", tt.in, tt.currency, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.Amount != tt.want || got.Currency != tt.currency {
+			t.Errorf("ParseMoney(%q, %s) = %d %s, want %d %s", tt.in, tt.currency, got.Amount, got.Currency, tt.want, tt.currency)
+		}
+	}
+}
+
+func TestMoneyStringRoundTrip(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{Money{999, "USD"}, "9.99"},
+		{Money{5, "USD"}, "0.05"},
+		{Money{-425, "EUR"}, "-4.25"},
+		{Money{1500, "JPY"}, "1500"},
+		{Money{0, "USD"}, "0.00"},
+	}
+	for _, tt := range tests {
+		s := tt.m.String()
+		if s != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.m, s, tt.want)
+			continue
+		}
+		back, err := ParseMoney(s, tt.m.Currency)
+		if err != nil || back != tt.m {
+			t.Errorf("ParseMoney(%q) = %+v, %v, want %+v", s, back, err, tt.m)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	OrderPendingPayment = "pending_payment"
+	OrderPaid           = "paid"
+	OrderFulfilled      = "fulfilled"
+	OrderShipped        = "shipped"
+	OrderDelivered      = "delivered"
+	OrderCancelled      = "cancelled"
+	OrderRefunded       = "refunded"
+)
+
+// orderMoves lists the states an order may move to from each state.
+// Cancelled and refunded orders are final.
+var orderMoves = map[string][]string{
+	OrderPendingPayment: {OrderPaid, OrderCancelled},
+	OrderPaid:           {OrderFulfilled, OrderCancelled, OrderRefunded},
+	OrderFulfilled:      {OrderShipped, OrderCancelled, OrderRefunded},
+	OrderShipped:        {OrderDelivered, OrderRefunded},
+	OrderDelivered:      {OrderRefunded},
+}
+
+// OrderTransition is one step in an order's history. By names who moved it,
+// such as "checkout", "admin:<email>" or "seller:<userID>".
+type OrderTransition struct {
+	From string    `json:"from,omitempty" bson:"from,omitempty"`
+	To   string    `json:"to" bson:"to"`
+	At   time.Time `json:"at" bson:"at"`
+	By   string    `json:"by" bson:"by"`
+	Note string    `json:"note,omitempty" bson:"note,omitempty"`
+}
+
+// OrderNext returns the states an order in state may move to.
+func OrderNext(state string) []string {
+	return append([]string{}, orderMoves[state]...)
+}
+
+// CanMove rejects moving an order from one state to another unless the
+// lifecycle allows it.
+func CanMove(from, to string) error {
+	for _, next := range orderMoves[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("order can not move from %s to %s", from, to)
+}
+
+// PackedLine is an order line the seller has packed.
+type PackedLine struct {
+	ID      primitive.ObjectID `json:"id" bson:"id" validate:"required"`
+	Variant string             `json:"variant,omitempty" bson:"variant,omitempty" validate:"max=100"`
+	At      time.Time          `json:"at" bson:"at"`
+	By      string             `json:"by" bson:"by"`
+}
+
+// States a carrier reports a parcel in.
+const (
+	TrackInTransit      = "in_transit"
+	TrackOutForDelivery = "out_for_delivery"
+	TrackDelivered      = "delivered"
+	TrackException      = "exception"
+)
+
+// Shipment is how the seller sent an order on its way. Status is the latest
+// state the carrier reported, and Events the carrier's timeline, oldest
+// first. CheckedAt is when the carrier was last asked.
+type Shipment struct {
+	Carrier   string          `json:"carrier" bson:"carrier" validate:"required,max=100"`
+	Tracking  string          `json:"tracking" bson:"tracking" validate:"required,max=100"`
+	ShippedAt time.Time       `json:"shippedAt" bson:"shippedAt"`
+	Status    string          `json:"status,omitempty" bson:"status,omitempty"`
+	Events    []TrackingEvent `json:"events" bson:"events"`
+	CheckedAt *time.Time      `json:"checkedAt,omitempty" bson:"checkedAt,omitempty"`
+}
+
+// TrackingEvent is one scan of a parcel. ID is the carrier's, so an event
+// reported again is only recorded once.
+type TrackingEvent struct {
+	ID          string    `json:"id" bson:"id"`
+	Status      string    `json:"status" bson:"status"`
+	Description string    `json:"description,omitempty" bson:"description,omitempty"`
+	Location    string    `json:"location,omitempty" bson:"location,omitempty"`
+	At          time.Time `json:"at" bson:"at"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	PayCreated        = "created"
+	PayRequiresAction = "requires_action"
+	PayAuthorized     = "authorized"
+	PayCaptured       = "captured"
+	PayDeclined       = "declined"
+	PayVoided         = "voided"
+	PayRefunded       = "refunded"
+)
+
+// PaymentIntent is one attempt to pay for an order through a provider. Ref
+// is the provider's id of the payment and Action the challenge the buyer has
+// to pass while it requires_action. Events lists the webhook events already
+// applied, so a repeated delivery changes nothing.
+type PaymentIntent struct {
+	ID        primitive.ObjectID `json:"id" bson:"id"`
+	OrderID   primitive.ObjectID `json:"orderId" bson:"orderId"`
+	UID       primitive.ObjectID `json:"uid" bson:"uid"`
+	Provider  string             `json:"provider" bson:"provider"`
+	Ref       string             `json:"ref,omitempty" bson:"ref,omitempty"`
+	Amount    Money              `json:"amount" bson:"amount"`
+	Refunded  Money              `json:"refunded" bson:"refunded"`
+	Status    string             `json:"status" bson:"status"`
+	Action    string             `json:"action,omitempty" bson:"action,omitempty"`
+	Reason    string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	Events    []string           `json:"-" bson:"events"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
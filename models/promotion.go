@@ -0,0 +1,134 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	PromoPercent      = "percent"
+	PromoFixed        = "fixed"
+	PromoBuyXGetY     = "buy_x_get_y"
+	PromoFreeShipping = "free_shipping"
+)
+
+// Promotion is a discount rule. One without a Code applies to every cart it
+// matches; one with a Code only once that coupon is applied to the cart.
+// Products limits it to those products, empty means the whole catalogue.
+type Promotion struct {
+	ID           primitive.ObjectID   `json:"id" bson:"id"`
+	Code         string               `json:"code,omitempty" bson:"code,omitempty" validate:"omitempty,min=3,max=32,alphanum"`
+	Name         string               `json:"name" bson:"name" validate:"required,min=1,max=100"`
+	Kind         string               `json:"kind" bson:"kind" validate:"required,oneof=percent fixed buy_x_get_y free_shipping"`
+	Percent      int64                `json:"percent,omitempty" bson:"percent" validate:"gte=0,lte=100"`
+	Amount       *Money               `json:"amount,omitempty" bson:"amount"`
+	BuyQty       int64                `json:"buyQty,omitempty" bson:"buyQty" validate:"gte=0"`
+	GetQty       int64                `json:"getQty,omitempty" bson:"getQty" validate:"gte=0"`
+	Products     []primitive.ObjectID `json:"products" bson:"products"`
+	MinSpend     *Money               `json:"minSpend,omitempty" bson:"minSpend"`
+	StartAt      *time.Time           `json:"startAt,omitempty" bson:"startAt"`
+	EndAt        *time.Time           `json:"endAt,omitempty" bson:"endAt"`
+	UsageLimit   int64                `json:"usageLimit" bson:"usageLimit" validate:"gte=0"`
+	PerUserLimit int64                `json:"perUserLimit" bson:"perUserLimit" validate:"gte=0"`
+	Used         int64                `json:"used" bson:"used"`
+	Stackable    bool                 `json:"stackable" bson:"stackable"`
+	Active       bool                 `json:"active" bson:"active"`
+	CreatedAt    time.Time            `json:"createdAt" bson:"createdAt"`
+}
+
+// Check rejects promotions missing what their kind needs to be worked out.
+func (p Promotion) Check() error {
+	switch p.Kind {
+	case PromoPercent:
+		if p.Percent < 1 {
+			return errors.New("percent promotion needs a percent between 1 and 100")
+		}
+	case PromoFixed:
+		if p.Amount == nil || p.Amount.Amount <= 0 {
+			return errors.New("fixed promotion needs a positive amount")
+		}
+	case PromoBuyXGetY:
+		if p.BuyQty < 1 || p.GetQty < 1 {
+			return errors.New("buy x get y promotion needs buyQty and getQty of at least 1")
+		}
+	}
+	if p.StartAt != nil && p.EndAt != nil && !p.EndAt.After(*p.StartAt) {
+		return errors.New("endAt must be after startAt")
+	}
+	if p.MinSpend != nil && p.MinSpend.Amount < 0 {
+		return errors.New("minSpend can not be negative")
+	}
+	return nil
+}
+
+// Live reports whether the promotion is switched on and inside its window.
+func (p Promotion) Live(now time.Time) error {
+	if !p.Active {
+		return errors.New("promotion is not active")
+	}
+	if p.StartAt != nil && now.Before(*p.StartAt) {
+		return fmt.Errorf("promotion starts at %s", p.StartAt.Format(time.RFC3339))
+	}
+	if p.EndAt != nil && !now.Before(*p.EndAt) {
+		return errors.New("promotion has ended")
+	}
+	return nil
+}
+
+func (p Promotion) Covers(pid primitive.ObjectID) bool {
+	if len(p.Products) == 0 {
+		return true
+	}
+	for _, id := range p.Products {
+		if id == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// PromotionUse records one redemption, for per user limits.
+type PromotionUse struct {
+	ID      primitive.ObjectID `json:"id" bson:"id"`
+	PromoID primitive.ObjectID `json:"promoId" bson:"promoId"`
+	UID     primitive.ObjectID `json:"uid" bson:"uid"`
+	OrderID primitive.ObjectID `json:"orderId" bson:"orderId"`
+	UsedAt  time.Time          `json:"usedAt" bson:"usedAt"`
+}
+
+// AppliedDiscount is what one promotion took off, on a line in the line's
+// currency or on the whole cart in the cart's.
+type AppliedDiscount struct {
+	PromoID primitive.ObjectID `json:"promotionId" bson:"promoId"`
+	Code    string             `json:"code,omitempty" bson:"code,omitempty"`
+	Name    string             `json:"name" bson:"name"`
+	Amount  Money              `json:"amount" bson:"amount"`
+}
+
+type LineDiscount struct {
+	ID       primitive.ObjectID `json:"id"`
+	Variant  string             `json:"variant,omitempty"`
+	Subtotal Money              `json:"subtotal"`
+	Discount Money              `json:"discount"`
+	Total    Money              `json:"total"`
+	Applied  []AppliedDiscount  `json:"applied"`
+}
+
+type RejectedCoupon struct {
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// Discounts is the breakdown of promotions on a cart.
+type Discounts struct {
+	Lines        []LineDiscount    `json:"lines"`
+	Promotions   []AppliedDiscount `json:"promotions"`
+	Subtotal     Money             `json:"subtotal"`
+	Discount     Money             `json:"discount"`
+	Total        Money             `json:"total"`
+	FreeShipping bool              `json:"freeShipping"`
+	Rejected     []RejectedCoupon  `json:"rejected"`
+}
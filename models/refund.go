@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+)
+
+// RefundPartial and RefundFull are an order's RefundStatus once part or all
+// of what it charged has been refunded.
+const (
+	RefundPartial = "partial"
+	RefundFull    = "full"
+)
+
+// RefundLine is Quantity units of an order line given back, and what they
+// were refunded.
+type RefundLine struct {
+	ID       primitive.ObjectID `json:"id" bson:"id"`
+	Variant  string             `json:"variant,omitempty" bson:"variant,omitempty"`
+	Name     *string            `json:"name,omitempty" bson:"name,omitempty"`
+	Quantity int64              `json:"quantity" bson:"quantity" validate:"gte=1"`
+	Amount   Money              `json:"amount" bson:"amount"`
+}
+
+// Refund is money given back on an order, through the payment it was paid
+// with or, for cash orders, by hand. IntentID links it to that payment.
+// Restock puts the refunded lines back into stock.
+type Refund struct {
+	ID        primitive.ObjectID  `json:"id" bson:"id"`
+	OrderID   primitive.ObjectID  `json:"orderId" bson:"orderId"`
+	UID       primitive.ObjectID  `json:"uid" bson:"uid"`
+	IntentID  *primitive.ObjectID `json:"intentId,omitempty" bson:"intentId,omitempty"`
+	Lines     []RefundLine        `json:"lines" bson:"lines"`
+	Amount    Money               `json:"amount" bson:"amount"`
+	Reason    string              `json:"reason,omitempty" bson:"reason,omitempty"`
+	Restock   bool                `json:"restock" bson:"restock"`
+	Status    string              `json:"status" bson:"status"`
+	By        string              `json:"by" bson:"by"`
+	CreatedAt time.Time           `json:"createdAt" bson:"createdAt"`
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnRejected  = "rejected"
+	ReturnShipped   = "shipped"
+	ReturnReceived  = "received"
+	ReturnRefunded  = "refunded"
+)
+
+// returnMoves lists the states a return may move to from each state. An
+// approved return may be received without the buyer sending tracking, when
+// it is handed over in person. Rejected and refunded returns are final.
+var returnMoves = map[string][]string{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnShipped, ReturnReceived},
+	ReturnShipped:   {ReturnReceived},
+	ReturnReceived:  {ReturnRefunded},
+}
+
+// Reason codes a buyer picks for each returned line.
+const (
+	ReturnDamaged        = "damaged"
+	ReturnDefective      = "defective"
+	ReturnWrongItem      = "wrong_item"
+	ReturnNotAsDescribed = "not_as_described"
+	ReturnNotNeeded      = "no_longer_needed"
+	ReturnOther          = "other"
+)
+
+// ReturnLine is Quantity units of an order line the buyer wants to send
+// back, and why.
+type ReturnLine struct {
+	ID       primitive.ObjectID `json:"id" bson:"id"`
+	Variant  string             `json:"variant,omitempty" bson:"variant,omitempty"`
+	Name     *string            `json:"name,omitempty" bson:"name,omitempty"`
+	Quantity int64              `json:"quantity" bson:"quantity" validate:"gte=1"`
+	Reason   string             `json:"reason" bson:"reason" validate:"required,oneof=damaged defective wrong_item not_as_described no_longer_needed other"`
+	Note     string             `json:"note,omitempty" bson:"note,omitempty" validate:"max=1000"`
+}
+
+// ReturnParcel is how the buyer sent a return back.
+type ReturnParcel struct {
+	Carrier   string    `json:"carrier" bson:"carrier" validate:"required,max=100"`
+	Tracking  string    `json:"tracking" bson:"tracking" validate:"required,max=100"`
+	ShippedAt time.Time `json:"shippedAt" bson:"shippedAt"`
+}
+
+// Return is a buyer's request to send lines of an order back. The seller
+// approves it with Instructions on where and how to send it, or rejects it
+// with a Decision. Once the parcel is received the lines are refunded, and
+// RefundID links the refund; RefundError keeps why the last attempt failed.
+// History records every move, like an order's.
+type Return struct {
+	ID           primitive.ObjectID  `json:"id" bson:"id"`
+	OrderID      primitive.ObjectID  `json:"orderId" bson:"orderId"`
+	UID          primitive.ObjectID  `json:"uid" bson:"uid"`
+	Seller       *primitive.ObjectID `json:"seller,omitempty" bson:"seller,omitempty"`
+	Lines        []ReturnLine        `json:"lines" bson:"lines"`
+	Photos       []string            `json:"photos" bson:"photos"`
+	Status       string              `json:"status" bson:"status"`
+	Instructions string              `json:"instructions,omitempty" bson:"instructions,omitempty"`
+	Decision     string              `json:"decision,omitempty" bson:"decision,omitempty"`
+	Parcel       *ReturnParcel       `json:"parcel,omitempty" bson:"parcel,omitempty"`
+	Restock      bool                `json:"restock" bson:"restock"`
+	RefundID     *primitive.ObjectID `json:"refundId,omitempty" bson:"refundId,omitempty"`
+	RefundError  string              `json:"refundError,omitempty" bson:"refundError,omitempty"`
+	History      []OrderTransition   `json:"history" bson:"history"`
+	CreatedAt    time.Time           `json:"createdAt" bson:"createdAt"`
+	UpdatedAt    time.Time           `json:"updatedAt" bson:"updatedAt"`
+}
+
+// ReturnNext returns the states a return in state may move to.
+func ReturnNext(state string) []string {
+	return append([]string{}, returnMoves[state]...)
+}
+
+// CanMoveReturn rejects moving a return from one state to another unless
+// its workflow allows it.
+func CanMoveReturn(from, to string) error {
+	for _, next := range returnMoves[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("return can not move from %s to %s", from, to)
+}
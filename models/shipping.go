@@ -0,0 +1,65 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ShipFlat     = "flat"
+	ShipWeight   = "weight"
+	ShipFreeOver = "free_over"
+	ShipPickup   = "pickup"
+)
+
+// ShippingZone groups destinations by postal code prefix. A zone without
+// prefixes catches every address no other zone matches.
+type ShippingZone struct {
+	ID             primitive.ObjectID `json:"id" bson:"id"`
+	Name           string             `json:"name" bson:"name" validate:"required,min=1,max=100"`
+	PostalPrefixes []string           `json:"postalPrefixes" bson:"postalPrefixes" validate:"dive,min=1,max=10"`
+	CreatedAt      time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// ShippingMethod is a way to get an order to the buyer. Zones limits it to
+// those zones, empty offers it everywhere.
+//
+// flat costs Rate. weight costs Rate plus PerKg for every started kilogram.
+// free_over costs Rate, or nothing once the cart reaches Threshold. pickup
+// is free and offered regardless of zone.
+type ShippingMethod struct {
+	ID        primitive.ObjectID   `json:"id" bson:"id"`
+	Name      string               `json:"name" bson:"name" validate:"required,min=1,max=100"`
+	Kind      string               `json:"kind" bson:"kind" validate:"required,oneof=flat weight free_over pickup"`
+	Zones     []primitive.ObjectID `json:"zones" bson:"zones"`
+	Rate      *Money               `json:"rate,omitempty" bson:"rate"`
+	PerKg     *Money               `json:"perKg,omitempty" bson:"perKg"`
+	Threshold *Money               `json:"threshold,omitempty" bson:"threshold"`
+	Active    bool                 `json:"active" bson:"active"`
+	CreatedAt time.Time            `json:"createdAt" bson:"createdAt"`
+}
+
+// Check rejects methods missing the prices their kind needs.
+func (m ShippingMethod) Check() error {
+	if m.Kind != ShipPickup && (m.Rate == nil || m.Rate.Amount < 0) {
+		return errors.New("shipping method needs a rate")
+	}
+	if m.Kind == ShipWeight && (m.PerKg == nil || m.PerKg.Amount < 0 || m.PerKg.Currency != m.Rate.Currency) {
+		return errors.New("weight based shipping needs perKg in the currency of rate")
+	}
+	if m.Kind == ShipFreeOver && (m.Threshold == nil || m.Threshold.Amount <= 0) {
+		return errors.New("free over threshold shipping needs a threshold")
+	}
+	return nil
+}
+
+// ShippingQuote is what one method costs for a cart.
+type ShippingQuote struct {
+	MethodID primitive.ObjectID `json:"methodId" bson:"methodId"`
+	Name     string             `json:"name" bson:"name"`
+	Kind     string             `json:"kind" bson:"kind"`
+	Zone     string             `json:"zone,omitempty" bson:"zone,omitempty"`
+	Cost     Money              `json:"cost" bson:"cost"`
+}
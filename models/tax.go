@@ -0,0 +1,57 @@
+package models
+
+import (
+	"errors"
+	"math/big"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TaxStandard is the tax class of products listed without one.
+const TaxStandard = "standard"
+
+// TaxRate is one rule of the tax table. Region, PostalPrefix and TaxClass
+// narrow where it applies, empty matches anything. Rate is a percentage as
+// a decimal string, like "8.25". Inclusive rates are already part of the
+// listed prices and are only shown, not added.
+type TaxRate struct {
+	ID           primitive.ObjectID `json:"id" bson:"id"`
+	Name         string             `json:"name" bson:"name" validate:"required,min=1,max=100"`
+	Region       string             `json:"region" bson:"region" validate:"max=50"`
+	PostalPrefix string             `json:"postalPrefix" bson:"postalPrefix" validate:"max=10"`
+	TaxClass     string             `json:"taxClass" bson:"taxClass" validate:"max=50"`
+	Rate         string             `json:"rate" bson:"rate" validate:"required"`
+	Inclusive    bool               `json:"inclusive" bson:"inclusive"`
+	CreatedAt    time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt    time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+// Percent parses Rate, which must lie between 0 and 100.
+func (r TaxRate) Percent() (*big.Rat, error) {
+	v, ok := new(big.Rat).SetString(r.Rate)
+	if !ok || v.Sign() < 0 || v.Cmp(big.NewRat(100, 1)) > 0 {
+		return nil, errors.New("rate must be a percentage between 0 and 100")
+	}
+	return v, nil
+}
+
+// TaxLine is the tax on one cart or order line.
+type TaxLine struct {
+	ID        primitive.ObjectID `json:"id" bson:"id"`
+	Variant   string             `json:"variant,omitempty" bson:"variant,omitempty"`
+	TaxClass  string             `json:"taxClass" bson:"taxClass"`
+	Name      string             `json:"name" bson:"name"`
+	Rate      string             `json:"rate" bson:"rate"`
+	Inclusive bool               `json:"inclusive" bson:"inclusive"`
+	Taxable   Money              `json:"taxable" bson:"taxable"`
+	Tax       Money              `json:"tax" bson:"tax"`
+}
+
+// TaxSummary sums up the tax lines. Total is all tax, Added only the part
+// from exclusive rates that comes on top of the prices.
+type TaxSummary struct {
+	Lines []TaxLine `json:"lines"`
+	Total Money     `json:"total"`
+	Added Money     `json:"added"`
+}
@@ -0,0 +1,208 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+)
+
+// Payment methods the mock understands, standing in for card tokens.
+const (
+	MockSuccess   = "mock_success"
+	MockDecline   = "mock_decline"
+	MockChallenge = "mock_challenge"
+)
+
+// MockPass is the answer that passes a mock challenge.
+const MockPass = "pass"
+
+type mockPayment struct {
+	reference string
+	amount    models.Money
+	status    string
+	captured  int64
+	refunded  int64
+}
+
+// Mock is a Provider that keeps payments in memory, for development and
+// tests. mock_success authorizes straight away, mock_decline is declined
+// and mock_challenge requires the buyer to pass a challenge first, the way
+// 3-D Secure does. Events are signed with Secret and posted to WebhookURL
+// like a real gateway would; leave it empty to send none.
+type Mock struct {
+	Secret     []byte
+	WebhookURL string
+
+	mu       sync.Mutex
+	payments map[string]*mockPayment
+	client   *http.Client
+}
+
+func NewMock(secret []byte, webhookURL string) *Mock {
+	return &Mock{
+		Secret:     secret,
+		WebhookURL: webhookURL,
+		payments:   map[string]*mockPayment{},
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (m *Mock) Name() string {
+	return "mock"
+}
+
+func (m *Mock) Authorize(ctx context.Context, req Request) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ref := "mock_" + randomHex(12)
+	p := &mockPayment{reference: req.Reference, amount: req.Amount}
+	m.payments[ref] = p
+	switch req.Method {
+	case MockSuccess:
+		p.status = models.PayAuthorized
+		return Result{Ref: ref, Status: p.status}, nil
+	case MockChallenge:
+		p.status = models.PayRequiresAction
+		return Result{Ref: ref, Status: p.status, Action: "/payments/mock/challenge/" + ref}, nil
+	default:
+		p.status = models.PayDeclined
+		return Result{Ref: ref, Status: p.status, Reason: "card declined"}, nil
+	}
+}
+
+// Challenge settles a payment waiting on a challenge: MockPass authorizes
+// it, any other answer declines it. The outcome arrives through the webhook.
+func (m *Mock) Challenge(ref, answer string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.payments[ref]
+	if !ok {
+		return ErrUnknownPayment
+	}
+	if p.status != models.PayRequiresAction {
+		return ErrInvalidState
+	}
+	if answer == MockPass {
+		p.status = models.PayAuthorized
+		m.send(Event{Type: EventAuthorized, Ref: ref, Reference: p.reference, Amount: p.amount})
+		return nil
+	}
+	p.status = models.PayDeclined
+	m.send(Event{Type: EventFailed, Ref: ref, Reference: p.reference, Amount: p.amount, Reason: "challenge failed"})
+	return nil
+}
+
+func (m *Mock) Capture(ctx context.Context, ref string, amount models.Money) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.payments[ref]
+	if !ok {
+		return Result{}, ErrUnknownPayment
+	}
+	if p.status != models.PayAuthorized || amount.Currency != p.amount.Currency || amount.Amount > p.amount.Amount {
+		return Result{Ref: ref, Status: p.status}, ErrInvalidState
+	}
+	p.status = models.PayCaptured
+	p.captured = amount.Amount
+	m.send(Event{Type: EventCaptured, Ref: ref, Reference: p.reference, Amount: amount})
+	return Result{Ref: ref, Status: p.status}, nil
+}
+
+func (m *Mock) Void(ctx context.Context, ref string) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.payments[ref]
+	if !ok {
+		return Result{}, ErrUnknownPayment
+	}
+	if p.status != models.PayAuthorized && p.status != models.PayRequiresAction {
+		return Result{Ref: ref, Status: p.status}, ErrInvalidState
+	}
+	p.status = models.PayVoided
+	m.send(Event{Type: EventVoided, Ref: ref, Reference: p.reference, Amount: p.amount})
+	return Result{Ref: ref, Status: p.status}, nil
+}
+
+func (m *Mock) Refund(ctx context.Context, ref string, amount models.Money) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.payments[ref]
+	if !ok {
+		return Result{}, ErrUnknownPayment
+	}
+	if p.status != models.PayCaptured && p.status != models.PayRefunded || amount.Currency != p.amount.Currency || amount.Amount <= 0 || p.refunded+amount.Amount > p.captured {
+		return Result{Ref: ref, Status: p.status}, ErrInvalidState
+	}
+	p.refunded += amount.Amount
+	if p.refunded == p.captured {
+		p.status = models.PayRefunded
+	}
+	m.send(Event{Type: EventRefunded, Ref: ref, Reference: p.reference, Amount: amount})
+	return Result{Ref: ref, Status: p.status}, nil
+}
+
+func (m *Mock) VerifyWebhook(payload []byte, signature string) (Event, error) {
+	var ev Event
+	if err := Verify(m.Secret, payload, signature, time.Now()); err != nil {
+		return ev, err
+	}
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return ev, err
+	}
+	return ev, nil
+}
+
+// send posts an event to the webhook in the background, retrying a few
+// times like a gateway would.
+func (m *Mock) send(ev Event) {
+	if m.WebhookURL == "" {
+		return
+	}
+	ev.ID = "evt_" + randomHex(12)
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Println("mock payment:", err)
+		return
+	}
+	go func() {
+		for attempt, wait := 0, time.Second; attempt < 3; attempt, wait = attempt+1, wait*2 {
+			req, err := http.NewRequest(http.MethodPost, m.WebhookURL, bytes.NewReader(payload))
+			if err != nil {
+				log.Println("mock payment:", err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(SignatureHeader, Sign(m.Secret, payload, time.Now()))
+			res, err := m.client.Do(req)
+			if err == nil {
+				res.Body.Close()
+				if res.StatusCode < 300 {
+					return
+				}
+				err = fmt.Errorf("webhook answered %s", res.Status)
+			}
+			log.Println("mock payment webhook:", err)
+			time.Sleep(wait)
+		}
+	}()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,106 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/cyzhang39/go_market/models"
+)
+
+// Event types a provider reports through its webhook.
+const (
+	EventAuthorized = "payment.authorized"
+	EventCaptured   = "payment.captured"
+	EventFailed     = "payment.failed"
+	EventVoided     = "payment.voided"
+	EventRefunded   = "payment.refunded"
+)
+
+var (
+	ErrNoProvider       = errors.New("no payment provider configured")
+	ErrUnknownPayment   = errors.New("unknown payment")
+	ErrInvalidState     = errors.New("payment is not in a state that allows this")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// Request asks a provider to authorize Amount. Reference is ours, the
+// payment intent id, and comes back on the provider's events. Method is
+// whatever the client got from the provider to pay with, such as a card
+// token.
+type Request struct {
+	Reference string
+	Amount    models.Money
+	Method    string
+}
+
+// Result is a provider's answer. Ref is the provider's id of the payment.
+// Status is one of the models.Pay states. A payment that needs the buyer to
+// pass a challenge first comes back requires_action with Action, the URL of
+// the challenge.
+type Result struct {
+	Ref    string
+	Status string
+	Action string
+	Reason string
+}
+
+// Event is a verified webhook call about the payment Ref, made for the
+// Reference it was authorized with.
+type Event struct {
+	ID        string       `json:"id"`
+	Type      string       `json:"type"`
+	Ref       string       `json:"ref"`
+	Reference string       `json:"reference"`
+	Amount    models.Money `json:"amount"`
+	Reason    string       `json:"reason,omitempty"`
+}
+
+// Provider is a payment gateway. Authorize reserves the money, Capture takes
+// what was reserved, Void releases it and Refund gives captured money back.
+// Whatever a provider settles later, like the outcome of a challenge, it
+// reports through its webhook, which VerifyWebhook checks and reads.
+type Provider interface {
+	Name() string
+	Authorize(ctx context.Context, req Request) (Result, error)
+	Capture(ctx context.Context, ref string, amount models.Money) (Result, error)
+	Void(ctx context.Context, ref string) (Result, error)
+	Refund(ctx context.Context, ref string, amount models.Money) (Result, error)
+	VerifyWebhook(payload []byte, signature string) (Event, error)
+}
+
+var (
+	mu        sync.RWMutex
+	providers = map[string]Provider{}
+	fallback  string
+)
+
+// Register makes a provider available by its name. The first one registered
+// is the default for new payments.
+func Register(p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[p.Name()] = p
+	if fallback == "" {
+		fallback = p.Name()
+	}
+}
+
+// Get returns the provider a payment was made with.
+func Get(name string) (Provider, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	p, ok := providers[name]
+	if !ok {
+		return nil, ErrNoProvider
+	}
+	return p, nil
+}
+
+// Default returns the provider new payments go through.
+func Default() (Provider, error) {
+	mu.RLock()
+	name := fallback
+	mu.RUnlock()
+	return Get(name)
+}
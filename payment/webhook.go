@@ -0,0 +1,58 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the signature of a webhook call.
+const SignatureHeader = "Payment-Signature"
+
+// Tolerance is how old a signed webhook call may be, so a captured call can
+// not be replayed later.
+const Tolerance = 5 * time.Minute
+
+// Sign signs a webhook payload sent at t. The signature reads
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<payload>">".
+func Sign(secret, payload []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", ts, mac(secret, ts, payload))
+}
+
+// Verify checks a signature made by Sign, and that it is no older than
+// Tolerance at now.
+func Verify(secret, payload []byte, signature string, now time.Time) error {
+	var ts, sig string
+	for _, part := range strings.Split(signature, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > Tolerance || age < -Tolerance {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(sig), []byte(mac(secret, ts, payload))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func mac(secret []byte, ts string, payload []byte) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(ts + "."))
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,235 @@
+package promo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// line is a cart line being discounted, in minor units of its currency.
+type line struct {
+	item      models.UserProd
+	remaining int64
+	applied   []models.AppliedDiscount
+}
+
+// Evaluate works out what the promotions take off the cart, with totals in
+// to, or the cart's own currency when to is empty.
+//
+// Stackable promotions add up, each taken off what the ones before it left.
+// A promotion that is not stackable only ever applies alone, so whichever of
+// the best such promotion and all stackable ones together saves more wins.
+// Free shipping has nothing to take off the items and always applies.
+func Evaluate(promos []models.Promotion, items []models.UserProd, to string, now time.Time) (models.Discounts, error) {
+	subtotal, err := currency.Total(items, to)
+	if err != nil {
+		return models.Discounts{}, err
+	}
+	out := models.Discounts{
+		Lines:      make([]models.LineDiscount, 0, len(items)),
+		Promotions: make([]models.AppliedDiscount, 0),
+		Subtotal:   subtotal,
+		Discount:   models.Money{Currency: subtotal.Currency},
+		Rejected:   make([]models.RejectedCoupon, 0),
+	}
+
+	var stackable, alone []models.Promotion
+	for _, p := range promos {
+		if reason := eligible(p, items, now); reason != "" {
+			if p.Code != "" {
+				out.Rejected = append(out.Rejected, models.RejectedCoupon{Code: p.Code, Reason: reason})
+			}
+			continue
+		}
+		switch {
+		case p.Kind == models.PromoFreeShipping:
+			out.FreeShipping = true
+			out.Promotions = append(out.Promotions, models.AppliedDiscount{PromoID: p.ID, Code: p.Code, Name: p.Name, Amount: models.Money{Currency: subtotal.Currency}})
+		case p.Stackable:
+			stackable = append(stackable, p)
+		default:
+			alone = append(alone, p)
+		}
+	}
+
+	best, bestValue, err := run(stackable, items, subtotal.Currency)
+	if err != nil {
+		return out, err
+	}
+	for _, p := range alone {
+		lines, value, err := run([]models.Promotion{p}, items, subtotal.Currency)
+		if err != nil {
+			return out, err
+		}
+		if value > bestValue {
+			best, bestValue = lines, value
+		}
+	}
+	for _, p := range append(stackable, alone...) {
+		if p.Code != "" && !used(best, p.ID) {
+			out.Rejected = append(out.Rejected, models.RejectedCoupon{Code: p.Code, Reason: "a better offer that can not be combined applies"})
+		}
+	}
+
+	totals := map[primitive.ObjectID]*models.AppliedDiscount{}
+	order := make([]primitive.ObjectID, 0)
+	for _, l := range best {
+		sub := l.item.LineTotal()
+		discount := models.Money{Amount: sub.Amount - l.remaining, Currency: sub.Currency}
+		out.Lines = append(out.Lines, models.LineDiscount{
+			ID:       l.item.ID,
+			Variant:  l.item.Variant,
+			Subtotal: sub,
+			Discount: discount,
+			Total:    models.Money{Amount: l.remaining, Currency: sub.Currency},
+			Applied:  l.applied,
+		})
+		for _, a := range l.applied {
+			v, err := currency.Convert(a.Amount, subtotal.Currency)
+			if err != nil {
+				return out, err
+			}
+			t, ok := totals[a.PromoID]
+			if !ok {
+				t = &models.AppliedDiscount{PromoID: a.PromoID, Code: a.Code, Name: a.Name, Amount: models.Money{Currency: subtotal.Currency}}
+				totals[a.PromoID] = t
+				order = append(order, a.PromoID)
+			}
+			t.Amount.Amount += v.Amount
+		}
+	}
+	for _, id := range order {
+		out.Promotions = append(out.Promotions, *totals[id])
+		out.Discount.Amount += totals[id].Amount.Amount
+	}
+	if out.Discount.Amount > subtotal.Amount {
+		out.Discount.Amount = subtotal.Amount
+	}
+	out.Total = models.Money{Amount: subtotal.Amount - out.Discount.Amount, Currency: subtotal.Currency}
+	return out, nil
+}
+
+// eligible returns why a promotion can not apply to the cart, or "".
+func eligible(p models.Promotion, items []models.UserProd, now time.Time) string {
+	if err := p.Live(now); err != nil {
+		return err.Error()
+	}
+	if p.MinSpend != nil && p.MinSpend.Amount > 0 {
+		spent, err := currency.Total(items, p.MinSpend.Currency)
+		if err != nil || spent.Amount < p.MinSpend.Amount {
+			return fmt.Sprintf("minimum spend of %s %s not reached", p.MinSpend, p.MinSpend.Currency)
+		}
+	}
+	if p.Kind == models.PromoFreeShipping {
+		return ""
+	}
+	for _, item := range items {
+		if p.Covers(item.ID) {
+			return ""
+		}
+	}
+	return "no items in the cart qualify"
+}
+
+func used(lines []line, id primitive.ObjectID) bool {
+	for _, l := range lines {
+		for _, a := range l.applied {
+			if a.PromoID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// run applies promotions one after another to fresh copies of the lines and
+// returns them with the total saved, in to.
+func run(promos []models.Promotion, items []models.UserProd, to string) ([]line, int64, error) {
+	lines := make([]line, len(items))
+	for i, item := range items {
+		lines[i] = line{item: item, remaining: item.LineTotal().Amount, applied: make([]models.AppliedDiscount, 0)}
+	}
+	for _, p := range promos {
+		for i, d := range take(p, lines) {
+			if d <= 0 {
+				continue
+			}
+			lines[i].remaining -= d
+			lines[i].applied = append(lines[i].applied, models.AppliedDiscount{
+				PromoID: p.ID,
+				Code:    p.Code,
+				Name:    p.Name,
+				Amount:  models.Money{Amount: d, Currency: lines[i].item.Price.Currency},
+			})
+		}
+	}
+
+	var value int64
+	for _, l := range lines {
+		saved := models.Money{Amount: l.item.LineTotal().Amount - l.remaining, Currency: l.item.Price.Currency}
+		v, err := currency.Convert(saved, to)
+		if err != nil {
+			return nil, 0, err
+		}
+		value += v.Amount
+	}
+	return lines, value, nil
+}
+
+// take works out what a promotion takes off each line, never more than the
+// line has left.
+func take(p models.Promotion, lines []line) []int64 {
+	out := make([]int64, len(lines))
+	switch p.Kind {
+	case models.PromoPercent:
+		for i, l := range lines {
+			if p.Covers(l.item.ID) {
+				out[i] = (l.remaining*p.Percent + 50) / 100
+			}
+		}
+
+	case models.PromoBuyXGetY:
+		// every BuyQty paid units of a product bring GetQty more of it free
+		for i, l := range lines {
+			if !p.Covers(l.item.ID) {
+				continue
+			}
+			free := l.item.Units() / (p.BuyQty + p.GetQty) * p.GetQty
+			out[i] = min(free*l.item.Price.Amount, l.remaining)
+		}
+
+	case models.PromoFixed:
+		// spread over the lines priced in the promotion's currency, in
+		// proportion to what is left on each
+		var base int64
+		idx := make([]int, 0)
+		for i, l := range lines {
+			if p.Covers(l.item.ID) && l.item.Price.Currency == p.Amount.Currency && l.remaining > 0 {
+				base += l.remaining
+				idx = append(idx, i)
+			}
+		}
+		if base == 0 {
+			return out
+		}
+		amount := min(p.Amount.Amount, base)
+		var given int64
+		for _, i := range idx {
+			out[i] = amount * lines[i].remaining / base
+			given += out[i]
+		}
+		// hand the rounding leftover to the largest lines first
+		sort.SliceStable(idx, func(a, b int) bool { return lines[idx[a]].remaining > lines[idx[b]].remaining })
+		for k := 0; given < amount; k = (k + 1) % len(idx) {
+			if out[idx[k]] < lines[idx[k]].remaining {
+				out[idx[k]]++
+				given++
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,156 @@
+package promo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func usd(amount int64) models.Money {
+	return models.Money{Amount: amount, Currency: "USD"}
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(24 * time.Hour)
+	a, b, c := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	cart := []models.UserProd{
+		{ID: a, Price: usd(1000), Quantity: 2},
+		{ID: b, Price: usd(500), Quantity: 1},
+	}
+	even := []models.UserProd{
+		{ID: a, Price: usd(100), Quantity: 1},
+		{ID: b, Price: usd(100), Quantity: 1},
+		{ID: c, Price: usd(100), Quantity: 1},
+	}
+	percent := func(n int64, stackable bool, products ...primitive.ObjectID) models.Promotion {
+		return models.Promotion{ID: primitive.NewObjectID(), Kind: models.PromoPercent, Percent: n, Stackable: stackable, Products: products, Active: true}
+	}
+	fixed := func(amount int64, stackable bool) models.Promotion {
+		m := usd(amount)
+		return models.Promotion{ID: primitive.NewObjectID(), Kind: models.PromoFixed, Amount: &m, Stackable: stackable, Active: true}
+	}
+	coupon := func(p models.Promotion, code string) models.Promotion {
+		p.Code = code
+		return p
+	}
+	minSpend := usd(3000)
+
+	tests := []struct {
+		name     string
+		items    []models.UserProd
+		promos   []models.Promotion
+		discount int64
+		lines    []int64
+		free     bool
+		rejected []string
+	}{
+		{name: "nothing", items: cart, discount: 0, lines: []int64{0, 0}},
+		{name: "percent off all", items: cart, promos: []models.Promotion{percent(10, true)}, discount: 250, lines: []int64{200, 50}},
+		{name: "percent off one product", items: cart, promos: []models.Promotion{percent(20, true, b)}, discount: 100, lines: []int64{0, 100}},
+		{name: "fixed spread by line", items: cart, promos: []models.Promotion{fixed(300, true)}, discount: 300, lines: []int64{240, 60}},
+		{name: "fixed over the cart", items: cart, promos: []models.Promotion{fixed(3000, true)}, discount: 2500, lines: []int64{2000, 500}},
+		{name: "fixed rounding leftover", items: even, promos: []models.Promotion{fixed(100, true)}, discount: 100, lines: []int64{34, 33, 33}},
+		{
+			name:     "buy one get one",
+			items:    cart,
+			promos:   []models.Promotion{{ID: primitive.NewObjectID(), Kind: models.PromoBuyXGetY, BuyQty: 1, GetQty: 1, Active: true}},
+			discount: 1000,
+			lines:    []int64{1000, 0},
+		},
+		{
+			name:     "stackable add up on what is left",
+			items:    cart,
+			promos:   []models.Promotion{percent(10, true), fixed(500, true)},
+			discount: 750,
+			lines:    []int64{600, 150},
+		},
+		{
+			name:     "better promotion alone wins",
+			items:    cart,
+			promos:   []models.Promotion{coupon(percent(10, true), "TEN"), percent(50, false)},
+			discount: 1250,
+			lines:    []int64{1000, 250},
+			rejected: []string{"TEN"},
+		},
+		{
+			name:     "stackable together beat one alone",
+			items:    cart,
+			promos:   []models.Promotion{percent(10, true), fixed(500, true), coupon(percent(20, false), "TWENTY")},
+			discount: 750,
+			lines:    []int64{600, 150},
+			rejected: []string{"TWENTY"},
+		},
+		{
+			name:     "inactive coupon",
+			items:    cart,
+			promos:   []models.Promotion{{ID: primitive.NewObjectID(), Code: "OFF", Kind: models.PromoPercent, Percent: 10}},
+			lines:    []int64{0, 0},
+			rejected: []string{"OFF"},
+		},
+		{
+			name:     "not started yet",
+			items:    cart,
+			promos:   []models.Promotion{{ID: primitive.NewObjectID(), Code: "SOON", Kind: models.PromoPercent, Percent: 10, Active: true, StartAt: &later}},
+			lines:    []int64{0, 0},
+			rejected: []string{"SOON"},
+		},
+		{
+			name:     "minimum spend not reached",
+			items:    cart,
+			promos:   []models.Promotion{{ID: primitive.NewObjectID(), Code: "BIG", Kind: models.PromoPercent, Percent: 10, Active: true, MinSpend: &minSpend}},
+			lines:    []int64{0, 0},
+			rejected: []string{"BIG"},
+		},
+		{
+			name:     "no product qualifies",
+			items:    cart,
+			promos:   []models.Promotion{coupon(percent(10, true, c), "OTHER")},
+			lines:    []int64{0, 0},
+			rejected: []string{"OTHER"},
+		},
+		{
+			name:   "free shipping",
+			items:  cart,
+			promos: []models.Promotion{{ID: primitive.NewObjectID(), Kind: models.PromoFreeShipping, Active: true}},
+			lines:  []int64{0, 0},
+			free:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Evaluate(tt.promos, tt.items, "", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var subtotal int64
+			for _, item := range tt.items {
+				subtotal += item.LineTotal().Amount
+			}
+			if got.Subtotal != usd(subtotal) || got.Discount != usd(tt.discount) || got.Total != usd(subtotal-tt.discount) {
+				t.Errorf("subtotal, discount, total = %v, %v, %v, want %d, %d, %d", got.Subtotal, got.Discount, got.Total, subtotal, tt.discount, subtotal-tt.discount)
+			}
+			if len(got.Lines) != len(tt.lines) {
+				t.Fatalf("got %d lines, want %d", len(got.Lines), len(tt.lines))
+			}
+			for i, want := range tt.lines {
+				if got.Lines[i].Discount.Amount != want {
+					t.Errorf("line %d discount = %d, want %d", i, got.Lines[i].Discount.Amount, want)
+				}
+			}
+			if got.FreeShipping != tt.free {
+				t.Errorf("free shipping = %v, want %v", got.FreeShipping, tt.free)
+			}
+			if len(got.Rejected) != len(tt.rejected) {
+				t.Fatalf("rejected = %+v, want %v", got.Rejected, tt.rejected)
+			}
+			for i, code := range tt.rejected {
+				if got.Rejected[i].Code != code {
+					t.Errorf("rejected[%d] = %s, want %s", i, got.Rejected[i].Code, code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/middleware"
+	"github.com/cyzhang39/go_market/models"
+)
+
+var valcat = validator.New()
+
+func CategoryRoutes(r *gin.Engine) {
+	rt := r.Group("/categories")
+	rt.GET("", ListCategories)
+	rt.GET("/:cid", GetCategory)
+	rt.POST("", middleware.Admin(), CreateCategory)
+	rt.PUT("/:cid", middleware.Admin(), UpdateCategory)
+
+	r.GET("/products/compare", CompareProducts)
+}
+
+func bindCategory(c *gin.Context) (models.Category, bool) {
+	var cat models.Category
+	if err := c.BindJSON(&cat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return cat, false
+	}
+	if err := valcat.Struct(cat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return cat, false
+	}
+	if err := cat.Check(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return cat, false
+	}
+	if cat.Attributes == nil {
+		cat.Attributes = make([]models.AttributeDef, 0)
+	}
+	return cat, true
+}
+
+func CreateCategory(c *gin.Context) {
+	cat, ok := bindCategory(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	cat.ID = primitive.NewObjectID()
+	cat.CreatedAt = now
+	cat.UpdatedAt = now
+	if _, err := db.Categories.InsertOne(ctx, cat); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "category already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create category"})
+		return
+	}
+	c.JSON(http.StatusCreated, cat)
+}
+
+// UpdateCategory replaces the name and attribute schema. Products listed
+// earlier keep their attributes and are checked again when next edited.
+func UpdateCategory(c *gin.Context) {
+	cHex, err := primitive.ObjectIDFromHex(c.Param("cid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid categoryId"})
+		return
+	}
+	cat, ok := bindCategory(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	idx := bson.M{"id": cHex}
+	update := bson.M{"$set": bson.M{"name": cat.Name, "attributes": cat.Attributes, "updatedAt": time.Now()}}
+	res, err := db.Categories.UpdateOne(ctx, idx, update)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update category"})
+		return
+	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "category not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "updated"})
+}
+
+func ListCategories(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := db.Categories.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out := make([]models.Category, 0)
+	if err := cur.All(ctx, &out); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func GetCategory(c *gin.Context) {
+	cHex, err := primitive.ObjectIDFromHex(c.Param("cid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid categoryId"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cat, err := db.GetCategory(ctx, cHex)
+	if err == db.ErrInvalidCategory {
+		c.JSON(http.StatusNotFound, gin.H{"error": "category not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	c.JSON(http.StatusOK, cat)
+}
+
+type compareRow struct {
+	Key    string        `json:"key"`
+	Label  string        `json:"label"`
+	Unit   string        `json:"unit"`
+	Values []interface{} `json:"values"`
+}
+
+// CompareProducts lines up the attributes of several products side by side,
+// one row per attribute in schema order with a value per product.
+func CompareProducts(c *gin.Context) {
+	var ids []primitive.ObjectID
+	for _, id := range strings.Split(c.Query("ids"), ",") {
+		pHex, err := primitive.ObjectIDFromHex(strings.TrimSpace(id))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid productId " + id})
+			return
+		}
+		ids = append(ids, pHex)
+	}
+	if len(ids) < 2 || len(ids) > 10 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "compare between 2 and 10 products"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := products.Find(ctx, bson.M{"id": bson.M{"$in": ids}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	var found []models.Product
+	if err := cur.All(ctx, &found); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	byID := map[primitive.ObjectID]models.Product{}
+	for _, p := range found {
+		byID[p.ID] = p
+	}
+
+	display := currency.Display(c)
+	list := make([]models.Product, 0, len(ids))
+	for _, id := range ids {
+		p, ok := byID[id]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "product not found " + id.Hex()})
+			return
+		}
+		p.DisplayPrice = currency.ConvertPtr(p.Price, display)
+		list = append(list, p)
+	}
+
+	rows := make([]compareRow, 0)
+	seenCat := map[primitive.ObjectID]bool{}
+	seenKey := map[string]bool{}
+	for _, p := range list {
+		if p.Category == nil || seenCat[*p.Category] {
+			continue
+		}
+		seenCat[*p.Category] = true
+		cat, err := db.GetCategory(ctx, *p.Category)
+		if err != nil {
+			continue
+		}
+		for _, def := range cat.Attributes {
+			if seenKey[def.Key] {
+				continue
+			}
+			seenKey[def.Key] = true
+			row := compareRow{Key: def.Key, Label: def.Label, Unit: def.Unit, Values: make([]interface{}, len(list))}
+			for i, q := range list {
+				row.Values[i] = q.Attributes[def.Key]
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"products": list, "attributes": rows})
+}
@@ -0,0 +1,67 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/middleware"
+)
+
+func CurrencyRoutes(r *gin.Engine) {
+	r.GET("/rates", ListRates)
+	r.PUT("/users/currency", SetCurrency)
+
+	admin := r.Group("/admin", middleware.Admin())
+	admin.POST("/rates/reload", ReloadRates)
+}
+
+func ListRates(c *gin.Context) {
+	c.JSON(http.StatusOK, currency.Current())
+}
+
+func SetCurrency(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Currency string `json:"currency"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := currency.Supported(body.Currency)
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported currency"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := users.UpdateOne(ctx, bson.M{"id": userID}, bson.M{"$set": bson.M{"currency": code}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save currency"})
+		return
+	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"currency": code})
+}
+
+func ReloadRates(c *gin.Context) {
+	if err := currency.Reload(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, currency.Current())
+}
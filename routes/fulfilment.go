@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"context"
+	"encoding/csv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/middleware"
+	"github.com/cyzhang39/go_market/models"
+)
+
+func FulfilmentRoutes(r *gin.Engine) {
+	seller := r.Group("/seller/orders")
+	seller.GET("", SellerListOrders)
+	seller.GET("/picklist", PickList)
+	seller.POST("/:oid/pack", func(c *gin.Context) { sellerFulfil(c, packOrder) })
+	seller.POST("/:oid/ship", func(c *gin.Context) { sellerFulfil(c, shipOrder) })
+
+	admin := r.Group("/admin/orders", middleware.Admin())
+	admin.POST("/:oid/pack", func(c *gin.Context) { packOrder(c, nil, "admin:"+c.GetString("email")) })
+	admin.POST("/:oid/ship", func(c *gin.Context) { shipOrder(c, nil, "admin:"+c.GetString("email")) })
+}
+
+// SellerListOrders pages through the orders for the signed in seller's
+// products, with the same filters as ListOrders.
+func SellerListOrders(c *gin.Context) {
+	seller, err := primitive.ObjectIDFromHex(c.GetString("uid"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	listOrders(c, bson.M{"seller": seller})
+}
+
+// PickList sums up what the signed in seller has to pack for their paid
+// orders, as CSV by default or as JSON with format=json.
+func PickList(c *gin.Context) {
+	seller, err := primitive.ObjectIDFromHex(c.GetString("uid"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or json"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	items, err := db.PickList(ctx, seller)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build pick list"})
+		return
+	}
+	if format == "json" {
+		c.JSON(http.StatusOK, items)
+		return
+	}
+
+	var sb strings.Builder
+	w := csv.NewWriter(&sb)
+	w.Write([]string{"product_id", "variant", "name", "quantity", "orders"})
+	for _, item := range items {
+		orders := make([]string, 0, len(item.Orders))
+		for _, oid := range item.Orders {
+			orders = append(orders, oid.Hex())
+		}
+		w.Write([]string{item.ID.Hex(), item.Variant, item.Name, strconv.FormatInt(item.Quantity, 10), strings.Join(orders, " ")})
+	}
+	w.Flush()
+	c.Header("Content-Disposition", `attachment; filename="picklist-`+time.Now().Format(time.DateOnly)+`.csv"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", []byte(sb.String()))
+}
+
+// sellerFulfil runs a fulfilment step on one of the signed in seller's
+// orders.
+func sellerFulfil(c *gin.Context, step func(c *gin.Context, seller *primitive.ObjectID, by string)) {
+	seller, err := primitive.ObjectIDFromHex(c.GetString("uid"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	step(c, &seller, "seller:"+seller.Hex())
+}
+
+// bindFulfil reads an optional body for a fulfilment step. A request
+// without one keeps the defaults.
+func bindFulfil(c *gin.Context, body interface{}) bool {
+	if c.Request.ContentLength == 0 {
+		return true
+	}
+	return bindReturn(c, body)
+}
+
+// answerFulfil answers with the order after a fulfilment step, or why it
+// failed.
+func answerFulfil(c *gin.Context, order models.Order, to string, err error) {
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, order)
+	case db.ErrInvalidPack:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "packed": order.Packed})
+	case db.ErrNotPackable:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": order.Status})
+	case db.ErrOrderTransition:
+		if why := models.CanMove(order.Status, to); why != nil {
+			err = why
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": order.Status, "allowed": models.OrderNext(order.Status)})
+	case db.ErrSplitOrder:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "subOrderIds": order.SubOrderIDs})
+	default:
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update order"})
+	}
+}
+
+// packOrder marks lines of a paid order packed, all of them when none are
+// given. The order is fulfilled once every line is.
+func packOrder(c *gin.Context, seller *primitive.ObjectID, by string) {
+	var body struct {
+		Lines []models.PackedLine `json:"lines" validate:"dive"`
+		Note  string              `json:"note" validate:"max=500"`
+	}
+	if !bindFulfil(c, &body) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := sellerOrder(ctx, c, seller)
+	if !ok {
+		return
+	}
+	order, err := db.PackOrder(ctx, order, body.Lines, by, body.Note)
+	answerFulfil(c, order, models.OrderFulfilled, err)
+}
+
+// shipOrder records the carrier and tracking number an order went out
+// with, packing whatever was left first.
+func shipOrder(c *gin.Context, seller *primitive.ObjectID, by string) {
+	var body struct {
+		models.Shipment
+		Note string `json:"note" validate:"max=500"`
+	}
+	if !bindReturn(c, &body) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	order, ok := sellerOrder(ctx, c, seller)
+	if !ok {
+		return
+	}
+	order, err := db.ShipOrder(ctx, order, body.Shipment, by, body.Note)
+	answerFulfil(c, order, models.OrderShipped, err)
+}
@@ -0,0 +1,153 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/invoice"
+	"github.com/cyzhang39/go_market/middleware"
+	"github.com/cyzhang39/go_market/models"
+)
+
+func InvoiceRoutes(r *gin.Engine) {
+	r.GET("/orders/:oid/invoice", GetInvoice)
+	r.GET("/orders/:oid/credit-notes", ListCreditNotes)
+	r.GET("/orders/:oid/credit-notes/:cid", GetCreditNote)
+
+	r.GET("/seller/orders/:oid/invoice", SellerGetInvoice)
+	r.GET("/admin/orders/:oid/invoice", middleware.Admin(), AdminGetInvoice)
+}
+
+// sendInvoice answers with an invoice or credit note in the format query:
+// pdf, the default, html or json.
+func sendInvoice(c *gin.Context, inv models.Invoice) {
+	switch c.DefaultQuery("format", "pdf") {
+	case "json":
+		c.JSON(http.StatusOK, inv)
+	case "html":
+		page, err := invoice.HTML(inv)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to render invoice"})
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+	case "pdf":
+		c.Header("Content-Disposition", `attachment; filename="`+inv.Number+`.pdf"`)
+		c.Data(http.StatusOK, "application/pdf", invoice.PDF(inv))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be pdf, html or json"})
+	}
+}
+
+func orderInvoice(ctx context.Context, c *gin.Context, order models.Order) {
+	inv, err := db.IssueInvoice(ctx, order)
+	switch err {
+	case nil:
+		sendInvoice(c, inv)
+	case db.ErrNotInvoiceable:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": order.Status})
+	case db.ErrSplitOrder:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "subOrderIds": order.SubOrderIDs})
+	default:
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue invoice"})
+	}
+}
+
+// GetInvoice downloads the invoice of one of the buyer's paid orders.
+func GetInvoice(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	orderInvoice(ctx, c, order)
+}
+
+// SellerGetInvoice downloads the invoice of one of the seller's orders.
+func SellerGetInvoice(c *gin.Context) {
+	seller, err := primitive.ObjectIDFromHex(c.GetString("uid"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := sellerOrder(ctx, c, &seller)
+	if !ok {
+		return
+	}
+	orderInvoice(ctx, c, order)
+}
+
+// AdminGetInvoice downloads the invoice of any paid order.
+func AdminGetInvoice(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := sellerOrder(ctx, c, nil)
+	if !ok {
+		return
+	}
+	orderInvoice(ctx, c, order)
+}
+
+// ListCreditNotes lists the credit notes of one of the buyer's orders, one
+// for each refund.
+func ListCreditNotes(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	notes, err := db.CreditNotes(ctx, order)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list credit notes"})
+		return
+	}
+	c.JSON(http.StatusOK, notes)
+}
+
+// GetCreditNote downloads one credit note of one of the buyer's orders.
+func GetCreditNote(c *gin.Context) {
+	cHex, err := primitive.ObjectIDFromHex(c.Param("cid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid creditNoteId"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	notes, err := db.CreditNotes(ctx, order)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list credit notes"})
+		return
+	}
+	for _, n := range notes {
+		if n.ID == cHex {
+			sendInvoice(c, n)
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "credit note not found"})
+}
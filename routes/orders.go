@@ -0,0 +1,334 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/middleware"
+	"github.com/cyzhang39/go_market/models"
+)
+
+var valorder = validator.New()
+
+// sellerMoves are the states a seller may move their own orders to. Payment
+// is settled by admins, and refunds go through the refunds endpoints.
+// Shipping goes through the ship endpoint, which records the carrier and
+// tracking, and delivery is reported by tracking or set by admins.
+var sellerMoves = map[string]bool{
+	models.OrderFulfilled: true,
+	models.OrderCancelled: true,
+}
+
+func OrderRoutes(r *gin.Engine) {
+	rt := r.Group("/orders")
+	rt.GET("", ListOrders)
+	rt.GET("/:oid", GetOrder)
+	rt.POST("/:oid/reorder", Reorder)
+
+	r.POST("/seller/orders/:oid/status", SellerAdvanceOrder)
+
+	admin := r.Group("/admin/orders", middleware.Admin())
+	admin.GET("", AdminListOrders)
+	admin.POST("/:oid/status", AdminAdvanceOrder)
+}
+
+// orderDate reads a from/to bound given either as RFC 3339 or as a plain
+// date. A plain to date covers the whole day.
+func orderDate(v string, end bool) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, true
+}
+
+func displayOrder(c *gin.Context, order *models.Order) {
+	display := currency.Display(c)
+	order.DisplayPrice = currency.ConvertPtr(&order.Price, display)
+	for i := range order.Cart {
+		order.Cart[i].DisplayPrice = currency.ConvertPtr(&order.Cart[i].Price, display)
+	}
+}
+
+// ListOrders pages through the buyer's orders, newest first, optionally
+// only those placed between from and to, containing product or in status.
+// Split orders are listed once, without their sub-orders.
+func ListOrders(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	listOrders(c, bson.M{"uid": userID, "parentId": bson.M{"$exists": false}})
+}
+
+// AdminListOrders pages through every order, with the same filters as
+// ListOrders plus buyer and seller.
+func AdminListOrders(c *gin.Context) {
+	filter := bson.M{}
+	for param, field := range map[string]string{"buyer": "uid", "seller": "seller"} {
+		if v := c.Query(param); v != "" {
+			id, err := primitive.ObjectIDFromHex(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param})
+				return
+			}
+			filter[field] = id
+		}
+	}
+	listOrders(c, filter)
+}
+
+func listOrders(c *gin.Context, filter bson.M) {
+	page := Limit(c.DefaultQuery("page", "1"), 1, 1<<31)
+	limit := Limit(c.DefaultQuery("limit", "20"), 1, 100)
+
+	if v := c.Query("status"); v != "" {
+		filter["status"] = v
+	}
+	placed := bson.M{}
+	if v := c.Query("from"); v != "" {
+		t, ok := orderDate(v, false)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from date"})
+			return
+		}
+		placed["$gte"] = t
+	}
+	if v := c.Query("to"); v != "" {
+		t, ok := orderDate(v, true)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to date"})
+			return
+		}
+		placed["$lt"] = t
+	}
+	if len(placed) > 0 {
+		filter["orderTime"] = placed
+	}
+	if v := c.Query("product"); v != "" {
+		pHex, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid productId"})
+			return
+		}
+		filter["cart.id"] = pHex
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := db.Orders.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "orderTime", Value: -1}}).SetSkip((page - 1) * limit).SetLimit(limit)
+	cur, err := db.Orders.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out := make([]models.Order, 0)
+	if err := cur.All(ctx, &out); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	for i := range out {
+		displayOrder(c, &out[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"orders": out, "page": page, "limit": limit, "total": total})
+}
+
+// signedIn reads the user the request's token was issued to.
+func signedIn(c *gin.Context) (primitive.ObjectID, bool) {
+	uHex, err := primitive.ObjectIDFromHex(c.GetString("uid"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return uHex, false
+	}
+	return uHex, true
+}
+
+// buyerOrder loads the order in the oid param if it belongs to the signed
+// in user. Orders of anyone else are reported as not found.
+func buyerOrder(ctx context.Context, c *gin.Context) (models.Order, bool) {
+	var order models.Order
+	userID, ok := signedIn(c)
+	if !ok {
+		return order, false
+	}
+	oHex, err := primitive.ObjectIDFromHex(c.Param("oid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid orderId"})
+		return order, false
+	}
+	err = db.Orders.FindOne(ctx, bson.M{"id": oHex, "uid": userID}).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return order, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return order, false
+	}
+	return order, true
+}
+
+// GetOrder shows one of the buyer's orders, a split order with each of its
+// sub-orders.
+func GetOrder(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	subs, err := db.SubOrders(ctx, order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	for i := range subs {
+		displayOrder(c, &subs[i])
+	}
+	if len(subs) > 0 {
+		order.SubOrders = subs
+	}
+	displayOrder(c, &order)
+	c.JSON(http.StatusOK, order)
+}
+
+// Reorder puts the lines of one of the buyer's past orders back into their
+// cart at today's prices, reporting what costs something else now and what
+// is no longer sold.
+func Reorder(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	review, err := db.Reorder(ctx, products, order)
+	switch err {
+	case nil:
+		display := currency.Display(c)
+		for i := range review.Items {
+			review.Items[i].DisplayPrice = currency.ConvertPtr(&review.Items[i].Price, display)
+		}
+		c.JSON(http.StatusOK, gin.H{"added": review.Items, "priceChanges": review.PriceChanges, "unavailable": review.Unavailable})
+	case db.ErrNothingToReorder:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "unavailable": review.Unavailable})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reorder"})
+	}
+}
+
+type orderMove struct {
+	Status string `json:"status" validate:"required,oneof=pending_payment paid fulfilled shipped delivered cancelled refunded"`
+	Note   string `json:"note" validate:"max=500"`
+}
+
+func bindOrderMove(c *gin.Context) (primitive.ObjectID, orderMove, bool) {
+	var body orderMove
+	oHex, err := primitive.ObjectIDFromHex(c.Param("oid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid orderId"})
+		return oHex, body, false
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return oHex, body, false
+	}
+	if err := valorder.Struct(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return oHex, body, false
+	}
+	return oHex, body, true
+}
+
+func advanceOrder(c *gin.Context, oid primitive.ObjectID, seller *primitive.ObjectID, body orderMove, by string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	switch body.Status {
+	case models.OrderRefunded:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "orders are refunded through their refunds"})
+		return
+	case models.OrderCancelled:
+		// cancelling also restocks the order and settles its payment
+		order, ok := sellerOrder(ctx, c, seller)
+		if ok {
+			cancelOrder(ctx, c, order, false, by, body.Note)
+		}
+		return
+	}
+	order, err := db.AdvanceOrder(ctx, oid, seller, body.Status, by, body.Note)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, order)
+	case db.ErrInvalidOrder:
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+	case db.ErrOrderTransition:
+		// the order may have moved meanwhile to a state it can leave for
+		// body.Status, so this is only the likely reason
+		if why := models.CanMove(order.Status, body.Status); why != nil {
+			err = why
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": order.Status, "allowed": models.OrderNext(order.Status)})
+	case db.ErrSplitOrder:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "parentId": order.ParentID, "subOrderIds": order.SubOrderIDs})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update order"})
+	}
+}
+
+// SellerAdvanceOrder lets the seller of an order, as signed in, move it
+// through fulfilment or cancel it.
+func SellerAdvanceOrder(c *gin.Context) {
+	seller, err := primitive.ObjectIDFromHex(c.GetString("uid"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	oHex, body, ok := bindOrderMove(c)
+	if !ok {
+		return
+	}
+	if body.Status == models.OrderShipped {
+		c.JSON(http.StatusForbidden, gin.H{"error": "ship orders through /seller/orders/" + oHex.Hex() + "/ship"})
+		return
+	}
+	if !sellerMoves[body.Status] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "sellers can not move orders to " + body.Status})
+		return
+	}
+	advanceOrder(c, oHex, &seller, body, "seller:"+seller.Hex())
+}
+
+// AdminAdvanceOrder moves any order along any transition the lifecycle
+// allows.
+func AdminAdvanceOrder(c *gin.Context) {
+	oHex, body, ok := bindOrderMove(c)
+	if !ok {
+		return
+	}
+	advanceOrder(c, oHex, nil, body, "admin:"+c.GetString("email"))
+}
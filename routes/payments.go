@@ -0,0 +1,139 @@
+package routes
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/payment"
+)
+
+// PaymentHooks registers the routes payment providers call. They are signed
+// by the provider instead of carrying a user token, so they go before
+// Authenticate.
+func PaymentHooks(r *gin.Engine) {
+	r.POST("/payments/webhook/:provider", PaymentWebhook)
+	r.POST("/payments/mock/challenge/:ref", MockChallenge)
+}
+
+func PaymentRoutes(r *gin.Engine) {
+	r.POST("/orders/:oid/pay", PayOrder)
+	r.GET("/orders/:oid/payments", OrderPayments)
+}
+
+// PaymentWebhook applies a signed event from a payment provider.
+func PaymentWebhook(c *gin.Context) {
+	p, err := payment.Get(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown payment provider"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not read body"})
+		return
+	}
+	ev, err := p.VerifyWebhook(body, c.GetHeader(payment.SignatureHeader))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = db.ApplyPaymentEvent(ctx, p.Name(), ev)
+	if err == db.ErrInvalidIntent {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println("payment webhook:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to apply event"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "received"})
+}
+
+// MockChallenge stands in for the page where the buyer passes a mock
+// provider's challenge. Answer "pass" to authorize the payment.
+func MockChallenge(c *gin.Context) {
+	p, err := payment.Get("mock")
+	mock, ok := p.(*payment.Mock)
+	if err != nil || !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "mock payments are not enabled"})
+		return
+	}
+	var body struct {
+		Answer string `json:"answer"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch err := mock.Challenge(c.Param("ref"), body.Answer); err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"status": "answered"})
+	case payment.ErrUnknownPayment:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	}
+}
+
+// PayOrder pays for one of the buyer's orders awaiting payment, such as one
+// whose earlier payment was declined.
+func PayOrder(c *gin.Context) {
+	var body struct {
+		Method string `json:"method" validate:"required,max=100"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := valorder.Struct(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	intent, err := db.PayOrder(ctx, order, body.Method)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, intent)
+	case db.ErrOrderNotPayable:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case db.ErrPaymentDeclined:
+		c.JSON(http.StatusPaymentRequired, intent)
+	default:
+		log.Println(err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "payment failed"})
+	}
+}
+
+func OrderPayments(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	out, err := db.OrderPayments(ctx, order.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
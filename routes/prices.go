@@ -0,0 +1,224 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/middleware"
+	"github.com/cyzhang39/go_market/models"
+)
+
+var valprice = validator.New()
+
+func PriceRoutes(r *gin.Engine) {
+	rt := r.Group("/products")
+	rt.PUT("/:pid/price", EditPrice)
+	rt.GET("/:pid/price-history", ListPriceHistory)
+	rt.POST("/:pid/price-schedules", SchedulePrice)
+	rt.GET("/:pid/price-schedules", ListSchedules)
+	rt.DELETE("/:pid/price-schedules/:sid", CancelSchedule)
+}
+
+// ownProduct loads the product in the pid param for the signed in user, if
+// they sell it or are an admin. Products sold by the marketplace itself are
+// only priced by admins.
+func ownProduct(ctx context.Context, c *gin.Context) (models.Product, primitive.ObjectID, bool) {
+	var prod models.Product
+	userID, ok := signedIn(c)
+	if !ok {
+		return prod, userID, false
+	}
+	pHex, err := primitive.ObjectIDFromHex(c.Param("pid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid productId"})
+		return prod, userID, false
+	}
+	if err := products.FindOne(ctx, bson.M{"id": pHex}).Decode(&prod); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "product not found"})
+		return prod, userID, false
+	}
+	if (prod.Seller == nil || *prod.Seller != userID) && !middleware.IsAdmin(c.GetString("email")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the product's seller or an admin can change its price"})
+		return prod, userID, false
+	}
+	return prod, userID, true
+}
+
+func EditPrice(c *gin.Context) {
+	var body struct {
+		Price *models.Money `json:"price" validate:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := valprice.Struct(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if currency.Supported(body.Price.Currency) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported currency"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	prod, userID, ok := ownProduct(ctx, c)
+	if !ok {
+		return
+	}
+	if prod.Price != nil && prod.Price.Currency != body.Price.Currency {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price currency must match the listing currency"})
+		return
+	}
+	err := db.SetPrice(ctx, products, prod.ID, *body.Price, db.PriceEdit, &userID)
+	if err == db.ErrInvalidProduct {
+		c.JSON(http.StatusNotFound, gin.H{"error": "product not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update price"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "updated"})
+}
+
+func ListPriceHistory(c *gin.Context) {
+	pHex, err := primitive.ObjectIDFromHex(c.Param("pid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid productId"})
+		return
+	}
+	limit := Limit(c.DefaultQuery("limit", "50"), 1, 200)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := db.PriceHistory.Find(ctx, bson.M{"pid": pHex}, options.Find().SetSort(bson.D{{Key: "changedAt", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out := make([]models.PriceChange, 0)
+	if err := cur.All(ctx, &out); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func SchedulePrice(c *gin.Context) {
+	var body struct {
+		Price   *models.Money `json:"price" validate:"required"`
+		StartAt time.Time     `json:"startAt" validate:"required"`
+		EndAt   *time.Time    `json:"endAt"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := valprice.Struct(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.EndAt != nil && !body.EndAt.After(body.StartAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "endAt must be after startAt"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	prod, userID, ok := ownProduct(ctx, c)
+	if !ok {
+		return
+	}
+	if prod.Price != nil && prod.Price.Currency != body.Price.Currency {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price currency must match the listing currency"})
+		return
+	}
+
+	s := models.PriceSchedule{
+		ID:        primitive.NewObjectID(),
+		PID:       prod.ID,
+		Price:     *body.Price,
+		StartAt:   body.StartAt,
+		EndAt:     body.EndAt,
+		Status:    db.SchedulePending,
+		CreatedBy: userID,
+		CreatedAt: time.Now(),
+	}
+	err := db.SchedulePrice(ctx, s)
+	if err == db.ErrScheduleOverlap {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to schedule price"})
+		return
+	}
+	c.JSON(http.StatusCreated, s)
+}
+
+func ListSchedules(c *gin.Context) {
+	pHex, err := primitive.ObjectIDFromHex(c.Param("pid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid productId"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"pid": pHex}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+	cur, err := db.PriceSchedules.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "startAt", Value: -1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out := make([]models.PriceSchedule, 0)
+	if err := cur.All(ctx, &out); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func CancelSchedule(c *gin.Context) {
+	sHex, err := primitive.ObjectIDFromHex(c.Param("sid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid scheduleId"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	prod, _, ok := ownProduct(ctx, c)
+	if !ok {
+		return
+	}
+	err = db.CancelSchedule(ctx, prod.ID, sHex)
+	if err == db.ErrScheduleInvalid {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel schedule"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "cancelled"})
+}
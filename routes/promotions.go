@@ -0,0 +1,219 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/middleware"
+	"github.com/cyzhang39/go_market/models"
+)
+
+var valpromo = validator.New()
+
+func PromotionRoutes(r *gin.Engine) {
+	rt := r.Group("/admin/promotions", middleware.Admin())
+	rt.POST("", CreatePromotion)
+	rt.GET("", ListPromotions)
+	rt.PATCH("/:prid", UpdatePromotion)
+
+	r.POST("/cart/coupons", ApplyCoupon)
+	r.DELETE("/cart/coupons/:code", RemoveCoupon)
+	r.GET("/cart/discounts", CartDiscounts)
+}
+
+func CreatePromotion(c *gin.Context) {
+	var p models.Promotion
+	if err := c.BindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.Code = db.CouponCode(p.Code)
+	if err := valpromo.Struct(p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := p.Check(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if p.Amount != nil && currency.Supported(p.Amount.Currency) == "" || p.MinSpend != nil && currency.Supported(p.MinSpend.Currency) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported currency"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p.ID = primitive.NewObjectID()
+	p.Used = 0
+	p.CreatedAt = time.Now()
+	if p.Products == nil {
+		p.Products = make([]primitive.ObjectID, 0)
+	}
+	if _, err := db.Promotions.InsertOne(ctx, p); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "coupon code already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create promotion"})
+		return
+	}
+	c.JSON(http.StatusCreated, p)
+}
+
+func ListPromotions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if c.Query("active") == "true" {
+		filter["active"] = true
+	}
+	cur, err := db.Promotions.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out := make([]models.Promotion, 0)
+	if err := cur.All(ctx, &out); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// UpdatePromotion switches a promotion on or off and moves its end or usage
+// limit. The discount itself can not change once customers may have seen it.
+func UpdatePromotion(c *gin.Context) {
+	prHex, err := primitive.ObjectIDFromHex(c.Param("prid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid promotionId"})
+		return
+	}
+	var body struct {
+		Active     *bool      `json:"active"`
+		EndAt      *time.Time `json:"endAt"`
+		UsageLimit *int64     `json:"usageLimit" validate:"omitempty,gte=0"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := valpromo.Struct(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	set := bson.M{}
+	if body.Active != nil {
+		set["active"] = *body.Active
+	}
+	if body.EndAt != nil {
+		set["endAt"] = *body.EndAt
+	}
+	if body.UsageLimit != nil {
+		set["usageLimit"] = *body.UsageLimit
+	}
+	if len(set) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "nothing to update"})
+		return
+	}
+	var p models.Promotion
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = db.Promotions.FindOneAndUpdate(ctx, bson.M{"id": prHex}, bson.M{"$set": set}, opts).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "promotion not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update promotion"})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+func ApplyCoupon(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Code string `json:"code" validate:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := valpromo.Struct(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p, err := db.ApplyCoupon(ctx, userID, body.Code)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"status": "applied", "code": p.Code, "name": p.Name})
+	case db.ErrInvalidCoupon:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case db.ErrInvalidCart:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to apply coupon"})
+	default:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	}
+}
+
+func RemoveCoupon(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := db.RemoveCoupon(ctx, userID, c.Param("code")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove coupon"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "removed"})
+}
+
+// CartDiscounts shows what the promotions and coupons take off each cart
+// line, with totals in the display currency.
+func CartDiscounts(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cart, err := db.GetCart(ctx, db.CartKey{UID: userID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out, err := db.CartDiscounts(ctx, userID, cart.Items, cart.Coupons, currency.Display(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to price cart"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"coupons": cart.Coupons, "discounts": out})
+}
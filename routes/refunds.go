@@ -0,0 +1,157 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/middleware"
+	"github.com/cyzhang39/go_market/models"
+)
+
+func RefundRoutes(r *gin.Engine) {
+	r.POST("/orders/:oid/cancel", CancelOrder)
+	r.GET("/orders/:oid/refunds", OrderRefunds)
+	r.POST("/seller/orders/:oid/refunds", SellerRefundOrder)
+	r.POST("/admin/orders/:oid/refunds", middleware.Admin(), AdminRefundOrder)
+}
+
+type refundRequest struct {
+	Lines   []models.RefundLine `json:"lines" validate:"required_without=Full,dive"`
+	Full    bool                `json:"full"`
+	Reason  string              `json:"reason" validate:"required,max=500"`
+	Restock bool                `json:"restock"`
+}
+
+// sellerOrder loads the order in the oid param, if it is the seller's when
+// seller is set.
+func sellerOrder(ctx context.Context, c *gin.Context, seller *primitive.ObjectID) (models.Order, bool) {
+	var order models.Order
+	oHex, err := primitive.ObjectIDFromHex(c.Param("oid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid orderId"})
+		return order, false
+	}
+	filter := bson.M{"id": oHex}
+	if seller != nil {
+		filter["seller"] = *seller
+	}
+	err = db.Orders.FindOne(ctx, filter).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return order, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return order, false
+	}
+	return order, true
+}
+
+// cancelOrder cancels order and answers with it, or with why it can not be
+// cancelled.
+func cancelOrder(ctx context.Context, c *gin.Context, order models.Order, buyer bool, by, note string) {
+	cancelled, err := db.CancelOrder(ctx, products, order, buyer, by, note)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, cancelled)
+	case db.ErrNotCancellable:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": cancelled.Status, "allowed": models.OrderNext(cancelled.Status)})
+	case db.ErrSplitOrder:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "parentId": cancelled.ParentID})
+	case db.ErrRefundFailed:
+		c.JSON(http.StatusBadGateway, gin.H{"error": "order cancelled but the refund failed", "order": cancelled})
+	default:
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel order"})
+	}
+}
+
+// CancelOrder lets the buyer cancel an order that is not fulfilled yet. Its
+// items go back into stock and what was paid is refunded.
+func CancelOrder(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	cancelOrder(ctx, c, order, true, "buyer:"+order.UID.Hex(), "")
+}
+
+func refundOrder(c *gin.Context, seller *primitive.ObjectID, by string) {
+	var body refundRequest
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := valorder.Struct(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	order, ok := sellerOrder(ctx, c, seller)
+	if !ok {
+		return
+	}
+	refund, err := db.RefundOrder(ctx, products, order, body.Lines, body.Full, body.Reason, body.Restock, by)
+	switch err {
+	case nil:
+		c.JSON(http.StatusCreated, refund)
+	case db.ErrNothingPaid:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case db.ErrSplitOrder:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "subOrderIds": order.SubOrderIDs})
+	case db.ErrInvalidRefund:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case db.ErrRefundFailed:
+		c.JSON(http.StatusBadGateway, refund)
+	default:
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refund order"})
+	}
+}
+
+// SellerRefundOrder refunds lines of one of the seller's orders, or all of
+// it.
+func SellerRefundOrder(c *gin.Context) {
+	seller, err := primitive.ObjectIDFromHex(c.GetString("uid"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	refundOrder(c, &seller, "seller:"+seller.Hex())
+}
+
+// AdminRefundOrder refunds lines of any order, or all of it.
+func AdminRefundOrder(c *gin.Context) {
+	refundOrder(c, nil, "admin:"+c.GetString("email"))
+}
+
+// OrderRefunds lists the refunds of one of the buyer's orders.
+func OrderRefunds(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	out, err := db.OrderRefunds(ctx, order.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/models"
+)
+
+const (
+	SourceBoughtTogether = "bought_together"
+	SourceTopRated       = "top_rated"
+)
+
+type relatedProduct struct {
+	models.Product
+	Score  float64 `json:"score"`
+	Source string  `json:"source"`
+}
+
+func RelatedRoutes(r *gin.Engine) {
+	rt := r.Group("/products")
+	rt.GET("/:pid/related", ListRelated)
+}
+
+// ListRelated serves the co-purchase recommendations for a product and tops
+// the list up with the best rated products of the same category.
+func ListRelated(c *gin.Context) {
+	pHex, err := primitive.ObjectIDFromHex(c.Param("pid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid productId"})
+		return
+	}
+	limit := Limit(c.DefaultQuery("limit", "10"), 1, 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var prod models.Product
+	if err := products.FindOne(ctx, bson.M{"id": pHex}).Decode(&prod); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "product not found"})
+		return
+	}
+
+	out := make([]relatedProduct, 0, limit)
+	seen := []primitive.ObjectID{pHex}
+
+	var rel models.Related
+	if err := db.Related.FindOne(ctx, bson.M{"pid": pHex}).Decode(&rel); err == nil {
+		ids := make([]primitive.ObjectID, 0, len(rel.Items))
+		for _, item := range rel.Items {
+			ids = append(ids, item.PID)
+		}
+		cur, err := products.Find(ctx, bson.M{"id": bson.M{"$in": ids}})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+			return
+		}
+		var found []models.Product
+		if err := cur.All(ctx, &found); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+			return
+		}
+		byID := map[primitive.ObjectID]models.Product{}
+		for _, p := range found {
+			byID[p.ID] = p
+		}
+		// keep the similarity order and skip products that were removed
+		for _, item := range rel.Items {
+			p, ok := byID[item.PID]
+			if !ok || int64(len(out)) >= limit {
+				continue
+			}
+			out = append(out, relatedProduct{Product: p, Score: item.Score, Source: SourceBoughtTogether})
+			seen = append(seen, p.ID)
+		}
+	}
+
+	if int64(len(out)) < limit {
+		filter := bson.M{"id": bson.M{"$nin": seen}}
+		if prod.Category != nil {
+			filter["category"] = *prod.Category
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "ratingAvg", Value: -1}, {Key: "ratingCnt", Value: -1}}).SetLimit(limit - int64(len(out)))
+		cur, err := products.Find(ctx, filter, opts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+			return
+		}
+		var top []models.Product
+		if err := cur.All(ctx, &top); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+			return
+		}
+		for _, p := range top {
+			out = append(out, relatedProduct{Product: p, Source: SourceTopRated})
+		}
+	}
+
+	display := currency.Display(c)
+	for i := range out {
+		out[i].DisplayPrice = currency.ConvertPtr(out[i].Price, display)
+	}
+	c.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,334 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/middleware"
+	"github.com/cyzhang39/go_market/models"
+)
+
+func ReturnRoutes(r *gin.Engine) {
+	r.POST("/orders/:oid/returns", OpenReturn)
+	r.GET("/orders/:oid/returns", OrderReturns)
+	r.GET("/returns", ListReturns)
+	r.GET("/returns/:rid", GetReturn)
+	r.POST("/returns/:rid/ship", ShipReturn)
+
+	seller := r.Group("/seller/returns")
+	seller.GET("", SellerListReturns)
+	seller.POST("/:rid/approve", func(c *gin.Context) { sellerReturn(c, approveReturn) })
+	seller.POST("/:rid/reject", func(c *gin.Context) { sellerReturn(c, rejectReturn) })
+	seller.POST("/:rid/receive", func(c *gin.Context) { sellerReturn(c, receiveReturn) })
+
+	admin := r.Group("/admin/returns", middleware.Admin())
+	admin.GET("", AdminListReturns)
+	admin.POST("/:rid/approve", func(c *gin.Context) { approveReturn(c, nil, "admin:"+c.GetString("email")) })
+	admin.POST("/:rid/reject", func(c *gin.Context) { rejectReturn(c, nil, "admin:"+c.GetString("email")) })
+	admin.POST("/:rid/receive", func(c *gin.Context) { receiveReturn(c, nil, "admin:"+c.GetString("email")) })
+}
+
+// returnFilter finds the return in the rid param, among owner's only when
+// owner is set.
+func returnFilter(c *gin.Context, owner bson.M) (bson.M, bool) {
+	rHex, err := primitive.ObjectIDFromHex(c.Param("rid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid returnId"})
+		return nil, false
+	}
+	filter := bson.M{"id": rHex}
+	for k, v := range owner {
+		filter[k] = v
+	}
+	return filter, true
+}
+
+func bindReturn(c *gin.Context, body interface{}) bool {
+	if err := c.BindJSON(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if err := valorder.Struct(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// answerReturn answers with the return after a move, or why it failed.
+func answerReturn(c *gin.Context, ret models.Return, to string, err error) {
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, ret)
+	case db.ErrInvalidReturn:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case db.ErrReturnTransition:
+		if why := models.CanMoveReturn(ret.Status, to); why != nil {
+			err = why
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": ret.Status, "allowed": models.ReturnNext(ret.Status)})
+	case db.ErrInvalidRefund, db.ErrNothingPaid, db.ErrRefundFailed:
+		c.JSON(http.StatusBadGateway, gin.H{"error": "return received but the refund failed: " + err.Error(), "return": ret})
+	default:
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update return"})
+	}
+}
+
+// OpenReturn lets the buyer ask to return lines of a delivered order, each
+// with a reason code, and photos of the items.
+func OpenReturn(c *gin.Context) {
+	var body struct {
+		Lines  []models.ReturnLine `json:"lines" validate:"required,min=1,dive"`
+		Photos []string            `json:"photos" validate:"max=10,dive,url,max=2048"`
+	}
+	if !bindReturn(c, &body) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	ret, err := db.OpenReturn(ctx, order, body.Lines, body.Photos)
+	switch err {
+	case nil:
+		c.JSON(http.StatusCreated, ret)
+	case db.ErrNotReturnable:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": order.Status})
+	case db.ErrSplitOrder:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "subOrderIds": order.SubOrderIDs})
+	case db.ErrReturnTooLarge:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open return"})
+	}
+}
+
+// OrderReturns lists the returns of one of the buyer's orders.
+func OrderReturns(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	out := make([]models.Return, 0)
+	cur, err := db.Returns.Find(ctx, bson.M{"orderId": order.ID}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	if err := cur.All(ctx, &out); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// ListReturns pages through the buyer's returns, newest first, optionally
+// only those in status.
+func ListReturns(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	listReturns(c, bson.M{"uid": userID})
+}
+
+// SellerListReturns pages through the returns of the seller's orders.
+func SellerListReturns(c *gin.Context) {
+	seller, err := primitive.ObjectIDFromHex(c.GetString("uid"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	listReturns(c, bson.M{"seller": seller})
+}
+
+// AdminListReturns pages through every return, optionally of one seller.
+func AdminListReturns(c *gin.Context) {
+	filter := bson.M{}
+	if v := c.Query("seller"); v != "" {
+		id, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid seller"})
+			return
+		}
+		filter["seller"] = id
+	}
+	listReturns(c, filter)
+}
+
+func listReturns(c *gin.Context, filter bson.M) {
+	page := Limit(c.DefaultQuery("page", "1"), 1, 1<<31)
+	limit := Limit(c.DefaultQuery("limit", "20"), 1, 100)
+	if v := c.Query("status"); v != "" {
+		filter["status"] = v
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := db.Returns.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetSkip((page - 1) * limit).SetLimit(limit)
+	cur, err := db.Returns.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out := make([]models.Return, 0)
+	if err := cur.All(ctx, &out); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"returns": out, "page": page, "limit": limit, "total": total})
+}
+
+// GetReturn shows one of the buyer's returns.
+func GetReturn(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	filter, ok := returnFilter(c, bson.M{"uid": userID})
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var ret models.Return
+	err := db.Returns.FindOne(ctx, filter).Decode(&ret)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "return not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+// ShipReturn records the parcel the buyer sent an approved return in.
+func ShipReturn(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	filter, ok := returnFilter(c, bson.M{"uid": userID})
+	if !ok {
+		return
+	}
+	var parcel models.ReturnParcel
+	if !bindReturn(c, &parcel) {
+		return
+	}
+	parcel.ShippedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ret, err := db.AdvanceReturn(ctx, filter, models.ReturnShipped, "buyer:"+userID.Hex(), "", bson.M{"parcel": parcel})
+	answerReturn(c, ret, models.ReturnShipped, err)
+}
+
+// sellerReturn runs a decision on one of the signed in seller's returns.
+func sellerReturn(c *gin.Context, decide func(c *gin.Context, seller *primitive.ObjectID, by string)) {
+	seller, err := primitive.ObjectIDFromHex(c.GetString("uid"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return
+	}
+	decide(c, &seller, "seller:"+seller.Hex())
+}
+
+func sellerFilter(c *gin.Context, seller *primitive.ObjectID) (bson.M, bool) {
+	if seller == nil {
+		return returnFilter(c, nil)
+	}
+	return returnFilter(c, bson.M{"seller": *seller})
+}
+
+// approveReturn accepts a return, telling the buyer where and how to send
+// it back.
+func approveReturn(c *gin.Context, seller *primitive.ObjectID, by string) {
+	filter, ok := sellerFilter(c, seller)
+	if !ok {
+		return
+	}
+	var body struct {
+		Instructions string `json:"instructions" validate:"required,max=2000"`
+	}
+	if !bindReturn(c, &body) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ret, err := db.AdvanceReturn(ctx, filter, models.ReturnApproved, by, "", bson.M{"instructions": body.Instructions})
+	answerReturn(c, ret, models.ReturnApproved, err)
+}
+
+// rejectReturn turns a return down, telling the buyer why.
+func rejectReturn(c *gin.Context, seller *primitive.ObjectID, by string) {
+	filter, ok := sellerFilter(c, seller)
+	if !ok {
+		return
+	}
+	var body struct {
+		Reason string `json:"reason" validate:"required,max=2000"`
+	}
+	if !bindReturn(c, &body) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ret, err := db.AdvanceReturn(ctx, filter, models.ReturnRejected, by, "", bson.M{"decision": body.Reason})
+	answerReturn(c, ret, models.ReturnRejected, err)
+}
+
+// receiveReturn records the returned parcel as received, which refunds its
+// lines.
+func receiveReturn(c *gin.Context, seller *primitive.ObjectID, by string) {
+	filter, ok := sellerFilter(c, seller)
+	if !ok {
+		return
+	}
+	var body struct {
+		Restock bool   `json:"restock"`
+		Note    string `json:"note" validate:"max=500"`
+	}
+	if !bindReturn(c, &body) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	ret, err := db.ReceiveReturn(ctx, products, filter, body.Restock, by, body.Note)
+	answerReturn(c, ret, models.ReturnReceived, err)
+}
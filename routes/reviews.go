@@ -31,8 +31,8 @@ func ReviewRoutes(r *gin.Engine) {
 }
 
 func CheckPurchase(ctx context.Context, userID, productID primitive.ObjectID) (bool, error) {
-	idx := bson.M{"id": userID, "status.cart.id": productID}
-	err := users.FindOne(ctx, idx).Err()
+	idx := bson.M{"uid": userID, "cart.id": productID}
+	err := db.Orders.FindOne(ctx, idx).Err()
 	if err != nil {
 		return false, err
 	}
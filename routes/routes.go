@@ -12,5 +12,6 @@ func Routes(route *gin.Engine) {
 	route.GET("/users/view", src.View())
 	route.GET("/users/search", src.Search())
 	route.POST("/users/listItem", src.ListItem())
+	route.GET("/wishlists/shared/:token", SharedWishlist)
 
 }
@@ -0,0 +1,303 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/middleware"
+	"github.com/cyzhang39/go_market/models"
+)
+
+var valship = validator.New()
+
+func ShippingRoutes(r *gin.Engine) {
+	rt := r.Group("/admin/shipping", middleware.Admin())
+	rt.POST("/zones", CreateZone)
+	rt.GET("/zones", ListZones)
+	rt.PUT("/zones/:zid", UpdateZone)
+	rt.DELETE("/zones/:zid", DeleteZone)
+	rt.POST("/methods", CreateShippingMethod)
+	rt.GET("/methods", ListShippingMethods)
+	rt.PUT("/methods/:mid", UpdateShippingMethod)
+	rt.DELETE("/methods/:mid", DeleteShippingMethod)
+
+	r.GET("/cart/shipping", CartShipping)
+}
+
+func bindZone(c *gin.Context) (models.ShippingZone, bool) {
+	var zone models.ShippingZone
+	if err := c.BindJSON(&zone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return zone, false
+	}
+	if err := valship.Struct(zone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return zone, false
+	}
+	if zone.PostalPrefixes == nil {
+		zone.PostalPrefixes = make([]string, 0)
+	}
+	return zone, true
+}
+
+func CreateZone(c *gin.Context) {
+	zone, ok := bindZone(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	zone.ID = primitive.NewObjectID()
+	zone.CreatedAt = time.Now()
+	if _, err := db.ShippingZones.InsertOne(ctx, zone); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "zone already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create zone"})
+		return
+	}
+	c.JSON(http.StatusCreated, zone)
+}
+
+func ListZones(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := db.ShippingZones.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out := make([]models.ShippingZone, 0)
+	if err := cur.All(ctx, &out); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func UpdateZone(c *gin.Context) {
+	zHex, err := primitive.ObjectIDFromHex(c.Param("zid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid zoneId"})
+		return
+	}
+	zone, ok := bindZone(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"name": zone.Name, "postalPrefixes": zone.PostalPrefixes}}
+	res, err := db.ShippingZones.UpdateOne(ctx, bson.M{"id": zHex}, update)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "zone already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update zone"})
+		return
+	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "zone not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "updated"})
+}
+
+// DeleteZone removes a zone and takes it off the methods offered in it.
+func DeleteZone(c *gin.Context) {
+	zHex, err := primitive.ObjectIDFromHex(c.Param("zid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid zoneId"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := db.ShippingZones.DeleteOne(ctx, bson.M{"id": zHex})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete zone"})
+		return
+	}
+	if res.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "zone not found"})
+		return
+	}
+	_, _ = db.ShippingMethods.UpdateMany(ctx, bson.M{"zones": zHex}, bson.M{"$pull": bson.M{"zones": zHex}})
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+func bindShippingMethod(c *gin.Context) (models.ShippingMethod, bool) {
+	var m models.ShippingMethod
+	if err := c.BindJSON(&m); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return m, false
+	}
+	if err := valship.Struct(m); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return m, false
+	}
+	if err := m.Check(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return m, false
+	}
+	for _, price := range []*models.Money{m.Rate, m.PerKg, m.Threshold} {
+		if price != nil && currency.Supported(price.Currency) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported currency"})
+			return m, false
+		}
+	}
+	if m.Zones == nil {
+		m.Zones = make([]primitive.ObjectID, 0)
+	}
+	return m, true
+}
+
+func CreateShippingMethod(c *gin.Context) {
+	m, ok := bindShippingMethod(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	m.ID = primitive.NewObjectID()
+	m.CreatedAt = time.Now()
+	if _, err := db.ShippingMethods.InsertOne(ctx, m); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create shipping method"})
+		return
+	}
+	c.JSON(http.StatusCreated, m)
+}
+
+func ListShippingMethods(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := db.ShippingMethods.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out := make([]models.ShippingMethod, 0)
+	if err := cur.All(ctx, &out); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func UpdateShippingMethod(c *gin.Context) {
+	mHex, err := primitive.ObjectIDFromHex(c.Param("mid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid methodId"})
+		return
+	}
+	m, ok := bindShippingMethod(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	set := bson.M{
+		"name":      m.Name,
+		"kind":      m.Kind,
+		"zones":     m.Zones,
+		"rate":      m.Rate,
+		"perKg":     m.PerKg,
+		"threshold": m.Threshold,
+		"active":    m.Active,
+	}
+	res, err := db.ShippingMethods.UpdateOne(ctx, bson.M{"id": mHex}, bson.M{"$set": set})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update shipping method"})
+		return
+	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "shipping method not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "updated"})
+}
+
+func DeleteShippingMethod(c *gin.Context) {
+	mHex, err := primitive.ObjectIDFromHex(c.Param("mid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid methodId"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := db.ShippingMethods.DeleteOne(ctx, bson.M{"id": mHex})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete shipping method"})
+		return
+	}
+	if res.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "shipping method not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// CartShipping quotes every shipping method offered for the cart at one of
+// the user's addresses, or their first.
+func CartShipping(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addr, err := db.UserAddress(ctx, users, userID, c.Query("address"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cart, err := db.GetCart(ctx, db.CartKey{UID: userID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	review, err := db.ReviewCart(ctx, products, cart.Items)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	display := currency.Display(c)
+	discounts, err := db.CartDiscounts(ctx, userID, review.Items, cart.Coupons, display)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to price cart"})
+		return
+	}
+	quotes, err := db.ShippingQuotes(ctx, review.Items, discounts.Total, addr, discounts.FreeShipping, display)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to quote shipping"})
+		return
+	}
+	c.JSON(http.StatusOK, quotes)
+}
@@ -0,0 +1,196 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/middleware"
+	"github.com/cyzhang39/go_market/models"
+)
+
+var valtax = validator.New()
+
+func TaxRoutes(r *gin.Engine) {
+	rt := r.Group("/admin/tax-rates", middleware.Admin())
+	rt.POST("", CreateTaxRate)
+	rt.GET("", ListTaxRates)
+	rt.PUT("/:trid", UpdateTaxRate)
+	rt.DELETE("/:trid", DeleteTaxRate)
+
+	r.GET("/cart/tax", CartTax)
+}
+
+func bindTaxRate(c *gin.Context) (models.TaxRate, bool) {
+	var rate models.TaxRate
+	if err := c.BindJSON(&rate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return rate, false
+	}
+	if err := valtax.Struct(rate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return rate, false
+	}
+	if _, err := rate.Percent(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return rate, false
+	}
+	return rate, true
+}
+
+func CreateTaxRate(c *gin.Context) {
+	rate, ok := bindTaxRate(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	rate.ID = primitive.NewObjectID()
+	rate.CreatedAt = now
+	rate.UpdatedAt = now
+	if _, err := db.TaxRates.InsertOne(ctx, rate); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "a rate for this region, postal prefix and tax class already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create tax rate"})
+		return
+	}
+	c.JSON(http.StatusCreated, rate)
+}
+
+func ListTaxRates(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sort := bson.D{{Key: "region", Value: 1}, {Key: "postalPrefix", Value: 1}, {Key: "taxClass", Value: 1}}
+	cur, err := db.TaxRates.Find(ctx, bson.M{}, options.Find().SetSort(sort))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out := make([]models.TaxRate, 0)
+	if err := cur.All(ctx, &out); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func UpdateTaxRate(c *gin.Context) {
+	trHex, err := primitive.ObjectIDFromHex(c.Param("trid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid taxRateId"})
+		return
+	}
+	rate, ok := bindTaxRate(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	set := bson.M{
+		"name":         rate.Name,
+		"region":       rate.Region,
+		"postalPrefix": rate.PostalPrefix,
+		"taxClass":     rate.TaxClass,
+		"rate":         rate.Rate,
+		"inclusive":    rate.Inclusive,
+		"updatedAt":    time.Now(),
+	}
+	res, err := db.TaxRates.UpdateOne(ctx, bson.M{"id": trHex}, bson.M{"$set": set})
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "a rate for this region, postal prefix and tax class already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update tax rate"})
+		return
+	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tax rate not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "updated"})
+}
+
+func DeleteTaxRate(c *gin.Context) {
+	trHex, err := primitive.ObjectIDFromHex(c.Param("trid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid taxRateId"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := db.TaxRates.DeleteOne(ctx, bson.M{"id": trHex})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete tax rate"})
+		return
+	}
+	if res.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tax rate not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// CartTax itemizes the tax on the cart at current prices after discounts,
+// for one of the user's addresses or their first.
+func CartTax(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addr, err := db.UserAddress(ctx, users, userID, c.Query("address"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cart, err := db.GetCart(ctx, db.CartKey{UID: userID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	review, err := db.ReviewCart(ctx, products, cart.Items)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	display := currency.Display(c)
+	discounts, err := db.CartDiscounts(ctx, userID, review.Items, cart.Coupons, display)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to price cart"})
+		return
+	}
+	taxes, err := db.CartTax(ctx, review.Items, discounts, addr, display)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to work out tax"})
+		return
+	}
+	total, err := discounts.Total.Add(taxes.Added)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to work out tax"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tax": taxes, "subtotal": discounts.Total, "total": total})
+}
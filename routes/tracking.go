@@ -0,0 +1,91 @@
+package routes
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/cyzhang39/go_market/carrier"
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/models"
+)
+
+// TrackingHooks registers the route carriers push tracking events to. Like
+// PaymentHooks it is signed instead of carrying a user token.
+func TrackingHooks(r *gin.Engine) {
+	r.POST("/shipments/webhook/:carrier", CarrierWebhook)
+}
+
+func TrackingRoutes(r *gin.Engine) {
+	r.GET("/orders/:oid/tracking", OrderTracking)
+}
+
+// CarrierWebhook applies a signed tracking update from a carrier.
+func CarrierWebhook(c *gin.Context) {
+	t, err := carrier.Get(c.Param("carrier"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown carrier"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not read body"})
+		return
+	}
+	up, err := t.VerifyWebhook(body, c.GetHeader(carrier.SignatureHeader))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = db.ApplyCarrierUpdate(ctx, t.Name(), up)
+	if err == db.ErrUnknownShipment {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println("carrier webhook:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to apply update"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "received"})
+}
+
+type orderTracking struct {
+	OrderID  string           `json:"orderId"`
+	Status   string           `json:"status"`
+	Shipment *models.Shipment `json:"shipment"`
+}
+
+// OrderTracking shows where the parcels of one of the buyer's orders are,
+// one for each sub-order of a split order.
+func OrderTracking(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	order, ok := buyerOrder(ctx, c)
+	if !ok {
+		return
+	}
+	orders := []models.Order{order}
+	if len(order.SubOrderIDs) > 0 {
+		subs, err := db.SubOrders(ctx, order)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+			return
+		}
+		orders = subs
+	}
+	out := make([]orderTracking, 0, len(orders))
+	for _, o := range orders {
+		out = append(out, orderTracking{OrderID: o.ID.Hex(), Status: o.Status, Shipment: o.Shipment})
+	}
+	c.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,349 @@
+package routes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/models"
+)
+
+var valwish = validator.New()
+
+func WishlistRoutes(r *gin.Engine) {
+	rt := r.Group("/wishlists")
+	rt.POST("", CreateWishlist)
+	rt.GET("", ListWishlists)
+	rt.GET("/:wid", GetWishlist)
+	rt.PATCH("/:wid", UpdateWishlist)
+	rt.DELETE("/:wid", DeleteWishlist)
+	rt.POST("/:wid/items", AddWishItem)
+	rt.DELETE("/:wid/items/:pid", RemoveWishItem)
+	rt.POST("/:wid/items/:pid/move-to-cart", MoveWishItem)
+}
+
+func shareToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func displayWishlist(c *gin.Context, list *models.Wishlist) {
+	display := currency.Display(c)
+	for i := range list.Items {
+		list.Items[i].DisplayPrice = currency.ConvertPtr(&list.Items[i].Price, display)
+	}
+}
+
+func GetWID(c *gin.Context) (primitive.ObjectID, bool) {
+	wHex, err := primitive.ObjectIDFromHex(c.Param("wid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid wishlistId"})
+		return primitive.NilObjectID, false
+	}
+	return wHex, true
+}
+
+func CreateWishlist(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Name   string `json:"name" validate:"required,min=1,max=100"`
+		Public bool   `json:"public"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := valwish.Struct(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	list := models.Wishlist{
+		ID:        primitive.NewObjectID(),
+		UID:       userID,
+		Name:      body.Name,
+		Kind:      db.KindWishlist,
+		Public:    body.Public,
+		Items:     make([]models.WishItem, 0),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if list.Public {
+		list.ShareToken = shareToken()
+	}
+	if _, err := db.Wishlists.InsertOne(ctx, list); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create wishlist"})
+		return
+	}
+	c.JSON(http.StatusCreated, list)
+}
+
+func ListWishlists(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := db.Wishlists.Find(ctx, bson.M{"uid": userID}, options.Find().SetSort(bson.D{{Key: "updatedAt", Value: -1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	out := make([]models.Wishlist, 0)
+	if err := cur.All(ctx, &out); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor read failed"})
+		return
+	}
+	for i := range out {
+		displayWishlist(c, &out[i])
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func GetWishlist(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	wHex, ok := GetWID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var list models.Wishlist
+	if err := db.Wishlists.FindOne(ctx, bson.M{"id": wHex, "uid": userID}).Decode(&list); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "wishlist not found"})
+		return
+	}
+	displayWishlist(c, &list)
+	c.JSON(http.StatusOK, list)
+}
+
+// UpdateWishlist renames a list or changes its visibility. Making a list
+// public hands out a new share link; making it private revokes the old one.
+func UpdateWishlist(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	wHex, ok := GetWID(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Name   *string `json:"name" validate:"omitempty,min=1,max=100"`
+		Public *bool   `json:"public"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := valwish.Struct(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var list models.Wishlist
+	if err := db.Wishlists.FindOne(ctx, bson.M{"id": wHex, "uid": userID}).Decode(&list); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "wishlist not found"})
+		return
+	}
+
+	set := bson.M{"updatedAt": time.Now()}
+	update := bson.M{"$set": set}
+	if body.Name != nil {
+		set["name"] = *body.Name
+	}
+	if body.Public != nil && *body.Public != list.Public {
+		set["public"] = *body.Public
+		if *body.Public {
+			set["shareToken"] = shareToken()
+		} else {
+			update["$unset"] = bson.M{"shareToken": ""}
+		}
+	}
+	if _, err := db.Wishlists.UpdateOne(ctx, bson.M{"id": wHex, "uid": userID}, update); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update wishlist"})
+		return
+	}
+
+	if err := db.Wishlists.FindOne(ctx, bson.M{"id": wHex}).Decode(&list); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	displayWishlist(c, &list)
+	c.JSON(http.StatusOK, list)
+}
+
+func DeleteWishlist(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	wHex, ok := GetWID(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := db.Wishlists.DeleteOne(ctx, bson.M{"id": wHex, "uid": userID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete wishlist"})
+		return
+	}
+	if res.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "wishlist not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+func AddWishItem(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	wHex, ok := GetWID(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		ProductID string `json:"productId" validate:"required,len=24"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := valwish.Struct(body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	pHex, err := primitive.ObjectIDFromHex(body.ProductID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid productId"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = db.WishlistAdd(ctx, products, wHex, userID, pHex)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"status": "added"})
+	case db.ErrInvalidProduct:
+		c.JSON(http.StatusNotFound, gin.H{"error": "product not found"})
+	case db.ErrInvalidWishlist:
+		c.JSON(http.StatusNotFound, gin.H{"error": "wishlist not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add item"})
+	}
+}
+
+func RemoveWishItem(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	wHex, ok := GetWID(c)
+	if !ok {
+		return
+	}
+	pHex, err := primitive.ObjectIDFromHex(c.Param("pid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid productId"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = db.WishlistRemove(ctx, wHex, userID, pHex, c.Query("variant"))
+	if err == db.ErrInvalidWishlist {
+		c.JSON(http.StatusNotFound, gin.H{"error": "wishlist not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove item"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "removed"})
+}
+
+func MoveWishItem(c *gin.Context) {
+	userID, ok := signedIn(c)
+	if !ok {
+		return
+	}
+	wHex, ok := GetWID(c)
+	if !ok {
+		return
+	}
+	pHex, err := primitive.ObjectIDFromHex(c.Param("pid"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid productId"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = db.MoveToCart(ctx, products, wHex, userID, pHex, c.Query("variant"))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"status": "moved"})
+	case db.ErrInvalidWishlist:
+		c.JSON(http.StatusNotFound, gin.H{"error": "wishlist not found"})
+	case db.ErrInvalidProduct:
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not on wishlist"})
+	case db.ErrCartLimit:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to move item"})
+	}
+}
+
+// SharedWishlist shows a public list to anyone with its link, without the
+// owner's id.
+func SharedWishlist(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var list models.Wishlist
+	err := db.Wishlists.FindOne(ctx, bson.M{"shareToken": c.Param("token"), "public": true}).Decode(&list)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "wishlist not found"})
+		return
+	}
+	displayWishlist(c, &list)
+	c.JSON(http.StatusOK, gin.H{"name": list.Name, "items": list.Items, "updatedAt": list.UpdatedAt})
+}
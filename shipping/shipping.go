@@ -0,0 +1,102 @@
+package shipping
+
+import (
+	"strings"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/models"
+)
+
+// Zone picks the zone with the longest postal prefix matching postal, or a
+// catch-all zone without prefixes.
+func Zone(zones []models.ShippingZone, postal string) (models.ShippingZone, bool) {
+	postal = normalize(postal)
+	var best models.ShippingZone
+	score := -1
+	for _, z := range zones {
+		if len(z.PostalPrefixes) == 0 && score < 0 {
+			best, score = z, 0
+			continue
+		}
+		for _, prefix := range z.PostalPrefixes {
+			p := normalize(prefix)
+			if postal != "" && strings.HasPrefix(postal, p) && len(p) > score {
+				best, score = z, len(p)
+			}
+		}
+	}
+	return best, score >= 0
+}
+
+func normalize(postal string) string {
+	return strings.ToUpper(strings.ReplaceAll(postal, " ", ""))
+}
+
+// Quote prices every active method offered at the address for the items.
+// subtotal is the cart after discounts, for free over threshold methods;
+// free is set when a promotion gives free shipping. Costs are in to.
+func Quote(methods []models.ShippingMethod, zones []models.ShippingZone, items []models.UserProd, subtotal models.Money, addr models.Address, free bool, to string) ([]models.ShippingQuote, error) {
+	postal := ""
+	if addr.Postal != nil {
+		postal = *addr.Postal
+	}
+	zone, zoned := Zone(zones, postal)
+
+	var grams int64
+	for _, item := range items {
+		grams += item.Weight * item.Units()
+	}
+
+	out := make([]models.ShippingQuote, 0, len(methods))
+	for _, m := range methods {
+		if !m.Active {
+			continue
+		}
+		q := models.ShippingQuote{MethodID: m.ID, Name: m.Name, Kind: m.Kind, Cost: models.Money{Currency: to}}
+		if m.Kind == models.ShipPickup {
+			out = append(out, q)
+			continue
+		}
+		if !zoned || !offered(m, zone) {
+			continue
+		}
+		q.Zone = zone.Name
+
+		cost := *m.Rate
+		switch m.Kind {
+		case models.ShipWeight:
+			kg := (grams + 999) / 1000
+			cost = models.Money{Amount: cost.Amount + m.PerKg.Amount*kg, Currency: cost.Currency}
+		case models.ShipFreeOver:
+			reached, err := currency.Convert(subtotal, m.Threshold.Currency)
+			if err != nil {
+				return nil, err
+			}
+			if reached.Amount >= m.Threshold.Amount {
+				cost.Amount = 0
+			}
+		}
+		if free {
+			cost.Amount = 0
+		}
+		v, err := currency.Convert(cost, to)
+		if err != nil {
+			return nil, err
+		}
+		q.Cost = v
+		out = append(out, q)
+	}
+	return out, nil
+}
+
+func offered(m models.ShippingMethod, zone models.ShippingZone) bool {
+	if len(m.Zones) == 0 {
+		return true
+	}
+	for _, id := range m.Zones {
+		if id == zone.ID {
+			return true
+		}
+	}
+	return false
+}
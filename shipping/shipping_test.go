@@ -0,0 +1,90 @@
+package shipping
+
+import (
+	"testing"
+
+	"github.com/cyzhang39/go_market/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func usd(amount int64) *models.Money {
+	return &models.Money{Amount: amount, Currency: "USD"}
+}
+
+var (
+	local    = models.ShippingZone{ID: primitive.NewObjectID(), Name: "local", PostalPrefixes: []string{"M5"}}
+	downtown = models.ShippingZone{ID: primitive.NewObjectID(), Name: "downtown", PostalPrefixes: []string{"m5v"}}
+	rest     = models.ShippingZone{ID: primitive.NewObjectID(), Name: "rest"}
+)
+
+func TestZone(t *testing.T) {
+	tests := []struct {
+		zones  []models.ShippingZone
+		postal string
+		want   string
+	}{
+		{[]models.ShippingZone{rest, local, downtown}, "M5V 2T6", "downtown"},
+		{[]models.ShippingZone{rest, local, downtown}, "m5a1a1", "local"},
+		{[]models.ShippingZone{rest, local, downtown}, "H2X", "rest"},
+		{[]models.ShippingZone{rest, local, downtown}, "", "rest"},
+		{[]models.ShippingZone{local, downtown}, "H2X", ""},
+	}
+	for _, tt := range tests {
+		got, ok := Zone(tt.zones, tt.postal)
+		if got.Name != tt.want || ok != (tt.want != "") {
+			t.Errorf("Zone(%q) = %s, %v, want %s", tt.postal, got.Name, ok, tt.want)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	flat := models.ShippingMethod{ID: primitive.NewObjectID(), Name: "flat", Kind: models.ShipFlat, Rate: usd(500), Active: true}
+	weight := models.ShippingMethod{ID: primitive.NewObjectID(), Name: "weight", Kind: models.ShipWeight, Rate: usd(400), PerKg: usd(100), Zones: []primitive.ObjectID{local.ID}, Active: true}
+	freeOver := models.ShippingMethod{ID: primitive.NewObjectID(), Name: "free over", Kind: models.ShipFreeOver, Rate: usd(800), Threshold: usd(5000), Active: true}
+	pickup := models.ShippingMethod{ID: primitive.NewObjectID(), Name: "pickup", Kind: models.ShipPickup, Active: true}
+	off := models.ShippingMethod{ID: primitive.NewObjectID(), Name: "off", Kind: models.ShipFlat, Rate: usd(100)}
+	methods := []models.ShippingMethod{flat, weight, freeOver, pickup, off}
+	zones := []models.ShippingZone{rest, local, downtown}
+	items := []models.UserProd{{Weight: 1500, Quantity: 1}, {Weight: 200, Quantity: 2}}
+	at := func(postal string) models.Address {
+		return models.Address{Postal: &postal}
+	}
+
+	tests := []struct {
+		name     string
+		zones    []models.ShippingZone
+		addr     models.Address
+		subtotal int64
+		free     bool
+		want     map[string]int64
+	}{
+		// 1.9 kg is charged as two started kilograms
+		{"in a zone of the method", zones, at("M5A 1A1"), 3000, false, map[string]int64{"flat": 500, "weight": 600, "free over": 800, "pickup": 0}},
+		{"outside the method's zones", zones, at("M5V 2T6"), 3000, false, map[string]int64{"flat": 500, "free over": 800, "pickup": 0}},
+		{"threshold reached", zones, at("H2X"), 5000, false, map[string]int64{"flat": 500, "free over": 0, "pickup": 0}},
+		{"free shipping", zones, at("M5A"), 3000, true, map[string]int64{"flat": 0, "weight": 0, "free over": 0, "pickup": 0}},
+		{"no zone reaches", []models.ShippingZone{local}, at("H2X"), 3000, false, map[string]int64{"pickup": 0}},
+		{"no address", []models.ShippingZone{local}, models.Address{}, 3000, false, map[string]int64{"pickup": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Quote(methods, tt.zones, items, *usd(tt.subtotal), tt.addr, tt.free, "USD")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d quotes %+v, want %v", len(got), got, tt.want)
+			}
+			for _, q := range got {
+				want, ok := tt.want[q.Name]
+				if !ok {
+					t.Errorf("unexpected quote for %s", q.Name)
+					continue
+				}
+				if q.Cost.Amount != want || q.Cost.Currency != "USD" {
+					t.Errorf("%s costs %v, want %d USD", q.Name, q.Cost, want)
+				}
+			}
+		})
+	}
+}
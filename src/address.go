@@ -2,174 +2,142 @@ package src
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/cyzhang39/go_market/db"
 	"github.com/cyzhang39/go_market/models"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func AddressAdd() gin.HandlerFunc {
-	return func(ctx *gin.Context) {
-		uid := ctx.Query("id")
-		if uid == "" {
-			ctx.Header("Content-Type", "application/json")
-			ctx.JSON(http.StatusNotFound, gin.H{"error": "Invalid uid"})
-			ctx.Abort()
-			return
-		}
-		uHex, err := primitive.ObjectIDFromHex(uid)
-		if err != nil {
-			ctx.IndentedJSON(http.StatusInternalServerError, "Internal server error")
-
-		}
-		var address models.Address
+// addressUser reads the user the request's token was issued to, and the
+// address in the aid param when withAddress is set.
+func addressUser(ctx *gin.Context, withAddress bool) (primitive.ObjectID, primitive.ObjectID, bool) {
+	uHex, err := primitive.ObjectIDFromHex(ctx.GetString("uid"))
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+		return uHex, primitive.NilObjectID, false
+	}
+	if !withAddress {
+		return uHex, primitive.NilObjectID, true
+	}
+	aHex, err := primitive.ObjectIDFromHex(ctx.Param("aid"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address id"})
+		return uHex, aHex, false
+	}
+	return uHex, aHex, true
+}
 
-		address.ID = primitive.NewObjectID()
-		err = ctx.BindJSON(&address)
-		if err != nil {
-			ctx.IndentedJSON(http.StatusNotAcceptable, err.Error())
-		}
+func addressError(ctx *gin.Context, err error) {
+	switch err {
+	case db.ErrInvalidUser:
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+	case db.ErrAddressNotFound:
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case db.ErrAddressesBusy:
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Oops, something went wrong"})
+	}
+}
 
-		c, cancel := context.WithTimeout(context.Background(), 100*time.Second)
-		match := bson.D{{Key: "$match", Value: bson.D{primitive.E{Key: "id", Value: uHex}}}}
-		ret := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$addressInfo"}}}}
-		group := bson.D{{Key: "$group", Value: bson.D{primitive.E{Key: "_id", Value: "$address_id"}, {Key: "count", Value: bson.D{primitive.E{Key: "$sum", Value: 1}}}}}}
-		result, err := users.Aggregate(c, mongo.Pipeline{match, ret, group})
-		if err != nil {
-			ctx.IndentedJSON(http.StatusInternalServerError, "Internal server error")
-		}
-		var info []bson.M
-		err = result.All(c, &info)
-		if err != nil {
-			panic(err)
+// AddressList lists the user's addresses.
+func AddressList() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		uHex, _, ok := addressUser(ctx, false)
+		if !ok {
+			return
 		}
+		c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
 
-		var size int32
-		for _, num := range info {
-			cnt := num["count"]
-			size = cnt.(int32)
+		var user models.User
+		if err := users.FindOne(c, bson.M{"id": uHex}).Decode(&user); err != nil {
+			addressError(ctx, db.ErrInvalidUser)
+			return
 		}
-		if size <= 1 {
-			idx := bson.D{primitive.E{Key: "id", Value: uHex}}
-			update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "addressInfo", Value: address}}}}
-			_, err = users.UpdateOne(c, idx, update)
-			if err != nil {
-				fmt.Println(err)
-			}
-			ctx.IndentedJSON(200, "Address added")
-		} else {
-			ctx.IndentedJSON(400, "Action not allowed")
+		if user.AddressInfo == nil {
+			user.AddressInfo = make([]models.Address, 0)
 		}
-		defer cancel()
-		c.Done()
-
+		ctx.JSON(http.StatusOK, user.AddressInfo)
 	}
 }
 
-func HomeEdit() gin.HandlerFunc {
+// AddressAdd adds an address, as many as the user likes. The first one
+// becomes the default for shipping and billing.
+func AddressAdd() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		uid := ctx.Query("id")
-		if uid == "" {
-			ctx.Header("Content-Type", "application/json")
-			ctx.JSON(http.StatusNotFound, gin.H{"error": "Invalid empty ID"})
-			ctx.Abort()
+		uHex, _, ok := addressUser(ctx, false)
+		if !ok {
 			return
 		}
-
-		uHex, err := primitive.ObjectIDFromHex(uid)
-		if err != nil {
-			ctx.IndentedJSON(http.StatusInternalServerError, "Internal server error")
+		var address models.Address
+		if err := ctx.BindJSON(&address); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
-		var edt models.Address
-		err = ctx.BindJSON(&edt)
-		if err != nil {
-			ctx.IndentedJSON(http.StatusBadRequest, err.Error())
-			// return
+		if err := validate.Struct(address); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
-		c, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		idx := bson.D{primitive.E{Key: "id", Value: uHex}}
-		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "addressInfo.0.house", Value: edt.House}, {Key: "addressInfo.0.street", Value: edt.Street}, {Key: "addressInfo.0.city", Value: edt.City}, {Key: "addressInfo.0.postal", Value: edt.Postal}}}}
-		_, err = users.UpdateOne(c, idx, update)
+		address, err := db.AddAddress(c, users, uHex, address)
 		if err != nil {
-			ctx.IndentedJSON(500, "Oops, something went wrong")
+			addressError(ctx, err)
 			return
 		}
-		defer cancel()
-		c.Done()
-		ctx.IndentedJSON(200, "Home address updated")
-
+		ctx.JSON(http.StatusCreated, address)
 	}
 }
 
-func WorkEdit() gin.HandlerFunc {
+// AddressEdit changes the fields given of one of the user's addresses, or
+// makes it a default.
+func AddressEdit() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		uid := ctx.Query("id")
-		if uid == "" {
-			ctx.Header("Content-Type", "application/json")
-			ctx.JSON(http.StatusNotFound, gin.H{"error": "Invalid empty ID"})
-			ctx.Abort()
+		uHex, aHex, ok := addressUser(ctx, true)
+		if !ok {
 			return
 		}
-
-		uHex, err := primitive.ObjectIDFromHex(uid)
-		if err != nil {
-			ctx.IndentedJSON(http.StatusInternalServerError, "Internal server error")
+		var patch db.AddressPatch
+		if err := ctx.BindJSON(&patch); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
-		var edt models.Address
-		err = ctx.BindJSON(&edt)
-		if err != nil {
-			ctx.IndentedJSON(http.StatusBadRequest, err.Error())
-			// return
+		if err := validate.Struct(patch); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
-		c, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		idx := bson.D{primitive.E{Key: "id", Value: uHex}}
-		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "addressInfo.1.house", Value: edt.House}, {Key: "addressInfo.1.street", Value: edt.Street}, {Key: "addressInfo.1.city", Value: edt.City}, {Key: "addressInfo.1.postal", Value: edt.Postal}}}}
-		_, err = users.UpdateOne(c, idx, update)
+		address, err := db.EditAddress(c, users, uHex, aHex, patch)
 		if err != nil {
-			ctx.IndentedJSON(500, "Oops, something went wrong")
+			addressError(ctx, err)
 			return
 		}
-		defer cancel()
-		c.Done()
-		ctx.IndentedJSON(200, "Work address updated")
+		ctx.JSON(http.StatusOK, address)
 	}
 }
 
+// AddressDelete removes one of the user's addresses.
 func AddressDelete() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		uid := ctx.Query("id")
-		if uid == "" {
-			ctx.Header("Content-Type", "application/json")
-			ctx.JSON(http.StatusNotFound, gin.H{"error": "Invalid empty ID"})
-			ctx.Abort()
+		uHex, aHex, ok := addressUser(ctx, true)
+		if !ok {
 			return
 		}
-		address := make([]models.Address, 0)
-		uHex, err := primitive.ObjectIDFromHex(uid)
-		if err != nil {
-			ctx.IndentedJSON(http.StatusInternalServerError, "Internal server error")
-		}
-		c, cancel := context.WithTimeout(context.Background(), 100 * time.Second)
+		c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		idx := bson.D{primitive.E{Key: "id", Value: uHex}}
-		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "addressInfo", Value: address}}}}
-		_, err = users.UpdateOne(c, idx, update)
-		if err != nil {
-			ctx.IndentedJSON(400, "Invalid")
+		if err := db.DeleteAddress(c, users, uHex, aHex); err != nil {
+			addressError(ctx, err)
 			return
 		}
-		defer cancel()
-		c.Done()
-		ctx.IndentedJSON(200, "Address deleted")
+		ctx.JSON(http.StatusOK, "Address deleted")
 	}
 }
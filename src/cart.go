@@ -5,12 +5,13 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/cyzhang39/go_market/currency"
 	"github.com/cyzhang39/go_market/db"
 	"github.com/cyzhang39/go_market/models"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -27,40 +28,165 @@ func NewApp(products *mongo.Collection, users *mongo.Collection) *App {
 	}
 }
 
+// cartKey picks the guest cart when GuestCart middleware found a token, and
+// otherwise the cart of the user named by the param query parameter.
+func cartKey(ctx *gin.Context, param string) (db.CartKey, bool) {
+	if token := ctx.GetString("cartToken"); token != "" {
+		return db.GuestCart(token), true
+	}
+
+	uid := ctx.Query(param)
+	if uid == "" {
+		log.Println("Invalide user id")
+		_ = ctx.AbortWithError(http.StatusBadRequest, errors.New("invalid user id"))
+		return db.CartKey{}, false
+	}
+	key, err := db.UserCart(uid)
+	if err != nil {
+		log.Println(err)
+		_ = ctx.AbortWithError(http.StatusBadRequest, errors.New("invalid user id"))
+		return db.CartKey{}, false
+	}
+	return key, true
+}
+
+// lineQuery reads the product, cart, variant and quantity of a cart line
+// from the query string.
+func lineQuery(ctx *gin.Context) (primitive.ObjectID, db.CartKey, string, int64, bool) {
+	pid := ctx.Query("id")
+	if pid == "" {
+		log.Println("Invalid product id")
+		_ = ctx.AbortWithError(http.StatusBadRequest, errors.New("invalid product id"))
+		return primitive.NilObjectID, db.CartKey{}, "", 0, false
+	}
+
+	key, ok := cartKey(ctx, "userID")
+	if !ok {
+		return primitive.NilObjectID, db.CartKey{}, "", 0, false
+	}
+
+	pHex, err := primitive.ObjectIDFromHex(pid)
+	if err != nil {
+		log.Println(err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return primitive.NilObjectID, db.CartKey{}, "", 0, false
+	}
+
+	qty, err := strconv.ParseInt(ctx.DefaultQuery("qty", "1"), 10, 64)
+	if err != nil || qty < 0 {
+		ctx.IndentedJSON(http.StatusBadRequest, "Invalid quantity")
+		ctx.Abort()
+		return primitive.NilObjectID, db.CartKey{}, "", 0, false
+	}
+	return pHex, key, ctx.Query("variant"), qty, true
+}
+
+func cartError(ctx *gin.Context, err error) {
+	switch err {
+	case db.ErrCartLimit:
+		ctx.IndentedJSON(http.StatusBadRequest, "Quantity over the per order limit")
+	case db.ErrInvalidProduct:
+		ctx.IndentedJSON(http.StatusNotFound, "Invalid product")
+	case db.ErrInvalidUser:
+		ctx.IndentedJSON(http.StatusNotFound, "Invalid user")
+	case db.ErrInvalidGuestCart:
+		ctx.IndentedJSON(http.StatusNotFound, "Cart not found or expired")
+	case db.ErrOutOfStock:
+		ctx.IndentedJSON(http.StatusConflict, "Not enough stock")
+	case db.ErrInvalidAddress:
+		ctx.IndentedJSON(http.StatusBadRequest, "Invalid address")
+	case db.ErrShippingMethod:
+		ctx.IndentedJSON(http.StatusBadRequest, "Choose one of the shipping methods quoted for the order")
+	case db.ErrCouponUsedUp:
+		ctx.IndentedJSON(http.StatusConflict, "A promotion has reached its usage limit")
+	default:
+		ctx.IndentedJSON(http.StatusInternalServerError, err)
+	}
+}
+
 func (app *App) CartAdd() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		pid := ctx.Query("id")
-		if pid == "" {
-			log.Println("Invalid product id")
-			_ = ctx.AbortWithError(http.StatusBadRequest, errors.New("invalid product id"))
+		pHex, key, variant, qty, ok := lineQuery(ctx)
+		if !ok {
+			return
+		}
+		if qty == 0 {
+			ctx.IndentedJSON(http.StatusBadRequest, "Invalid quantity")
+			return
+		}
+		c, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+		defer cancel()
+		err := db.CartAdd(c, app.products, key, pHex, variant, qty)
+		if err != nil {
+			cartError(ctx, err)
 			return
 		}
+		ctx.IndentedJSON(200, "Item successfully added")
+	}
+}
 
-		uid := ctx.Query("userID")
-		if uid == "" {
-			log.Println("Invalide user id")
-			_ = ctx.AbortWithError(http.StatusBadRequest, errors.New("invalid user id"))
+func (app *App) CartDecrement() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pHex, key, variant, qty, ok := lineQuery(ctx)
+		if !ok {
+			return
+		}
+		if qty == 0 {
+			ctx.IndentedJSON(http.StatusBadRequest, "Invalid quantity")
+			return
+		}
+		c, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+		defer cancel()
+		err := db.CartDecrement(c, key, pHex, variant, qty)
+		if err != nil {
+			cartError(ctx, err)
 			return
 		}
+		ctx.IndentedJSON(200, "Quantity updated")
+	}
+}
 
-		pHex, err := primitive.ObjectIDFromHex(pid)
+// CartQuantity sets a line to an exact quantity; 0 removes the line.
+func (app *App) CartQuantity() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Query("qty") == "" {
+			ctx.IndentedJSON(http.StatusBadRequest, "Invalid quantity")
+			return
+		}
+		pHex, key, variant, qty, ok := lineQuery(ctx)
+		if !ok {
+			return
+		}
+		c, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+		defer cancel()
+		err := db.CartSetQuantity(c, app.products, key, pHex, variant, qty)
 		if err != nil {
-			log.Println(err)
-			ctx.AbortWithStatus(http.StatusInternalServerError)
+			cartError(ctx, err)
+			return
+		}
+		ctx.IndentedJSON(200, "Quantity updated")
+	}
+}
+
+func (app *App) CartRemove() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pHex, key, _, _, ok := lineQuery(ctx)
+		if !ok {
 			return
 		}
 		c, cancel := context.WithTimeout(context.Background(), 8*time.Second)
 		defer cancel()
-		err = db.CartAdd(c, app.products, app.users, pHex, uid)
+
+		err := db.CartRemove(c, key, pHex)
 		if err != nil {
 			ctx.IndentedJSON(http.StatusInternalServerError, err)
-			// return
+			return
 		}
-		ctx.IndentedJSON(200, "Item successfully added")
+		ctx.IndentedJSON(200, "Item removed successfully")
 	}
 }
 
-func (app *App) CartRemove() gin.HandlerFunc {
+func (app *App) SaveForLater() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		pid := ctx.Query("id")
 		if pid == "" {
@@ -69,10 +195,10 @@ func (app *App) CartRemove() gin.HandlerFunc {
 			return
 		}
 
-		uid := ctx.Query("userID")
+		uid := ctx.GetString("uid")
 		if uid == "" {
 			log.Println("Invalide user id")
-			_ = ctx.AbortWithError(http.StatusBadRequest, errors.New("invalid user id"))
+			_ = ctx.AbortWithError(http.StatusUnauthorized, errors.New("invalid user id"))
 			return
 		}
 
@@ -85,62 +211,68 @@ func (app *App) CartRemove() gin.HandlerFunc {
 		c, cancel := context.WithTimeout(context.Background(), 8*time.Second)
 		defer cancel()
 
-		err = db.CartRemove(c, app.products, app.users, pHex, uid)
+		err = db.SaveForLater(c, pHex, ctx.Query("variant"), uid)
+		if err == db.ErrNotInCart {
+			ctx.IndentedJSON(http.StatusNotFound, "Item not in cart")
+			return
+		}
 		if err != nil {
 			ctx.IndentedJSON(http.StatusInternalServerError, err)
 			return
 		}
-		ctx.IndentedJSON(200, "Item removed successfully")
+		ctx.IndentedJSON(200, "Item saved for later")
 	}
 }
 
 func CartGet() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		uid := ctx.Query("id")
-
-		if uid == "" {
-			ctx.Header("Content-Type", "Application/json")
-			ctx.JSON(http.StatusNotFound, gin.H{"error": "Invalid user ID"})
-			ctx.Abort()
+		key, ok := cartKey(ctx, "id")
+		if !ok {
 			return
 		}
-
-		uHex, _ := primitive.ObjectIDFromHex(uid)
 		c, cancel := context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		var cart models.User
-		err := users.FindOne(c, bson.D{primitive.E{Key: "id", Value: uHex}}).Decode(&cart)
+		cart, err := db.GetCart(c, key)
 		if err != nil {
-			log.Println(err)
-			ctx.IndentedJSON(http.StatusNotFound, "Invalid user")
+			cartError(ctx, err)
 			return
 		}
-		match := bson.D{{Key: "$match", Value: bson.D{primitive.E{Key: "id", Value: uHex}}}}
-		ret := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$cart"}}}}
-		group := bson.D{{Key: "$group", Value: bson.D{primitive.E{Key: "_id", Value: "$id"}, {Key: "total", Value: bson.D{primitive.E{Key: "$sum", Value: "$cart.price"}}}}}}
-		result, err := users.Aggregate(c, mongo.Pipeline{match, ret, group})
-		if err != nil {
-			log.Println(err)
-		}
-
-		var lst []bson.M
-		err = result.All(c, &lst)
+		display := currency.Display(ctx)
+		total, err := currency.Total(cart.Items, display)
 		if err != nil {
 			log.Println(err)
 			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
 		}
-
-		for _, json := range lst {
-			ctx.IndentedJSON(200, json["total"])
-			ctx.IndentedJSON(200, cart.Cart)
+		for i := range cart.Items {
+			cart.Items[i].DisplayPrice = currency.ConvertPtr(&cart.Items[i].Price, display)
 		}
 
+		ctx.IndentedJSON(200, total)
+		ctx.IndentedJSON(200, cart.Items)
+
 		c.Done()
 
 	}
 }
 
+// NewGuestCart opens a cart for a visitor who has not signed in. The token
+// goes in the Cart-Token header of the /guest cart routes and of login.
+func NewGuestCart() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		c, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+		defer cancel()
+
+		cart, err := db.NewGuestCart(c)
+		if err != nil {
+			ctx.IndentedJSON(http.StatusInternalServerError, err)
+			return
+		}
+		ctx.JSON(http.StatusCreated, gin.H{"cartToken": cart.Token, "expiresAt": cart.ExpiresAt})
+	}
+}
+
 func (app *App) CartBuy() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		uid := ctx.Query("id")
@@ -152,12 +284,59 @@ func (app *App) CartBuy() gin.HandlerFunc {
 		c, cancel := context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		err := db.CartBuy(c, app.users, uid)
-		if err != nil {
+		order, review, err := db.CartBuy(c, app.products, app.users, uid, db.Checkout{Confirm: ctx.Query("confirm"), Address: ctx.Query("address"), Shipping: ctx.Query("shipping"), Cash: ctx.Query("payment") == payCash})
+		switch err {
+		case nil:
+		case db.ErrCartChanged:
+			ctx.IndentedJSON(http.StatusConflict, review)
+			return
+		case db.ErrEmptyCart:
+			ctx.IndentedJSON(http.StatusBadRequest, "Cart is empty")
+			return
+		case db.ErrInvalidAddress:
+			ctx.IndentedJSON(http.StatusBadRequest, "Invalid address")
+			return
+		case db.ErrShippingMethod:
+			ctx.IndentedJSON(http.StatusBadRequest, "Choose one of the shipping methods quoted for the cart")
+			return
+		case db.ErrCouponUsedUp:
+			ctx.IndentedJSON(http.StatusConflict, "A coupon on the cart has reached its usage limit")
+			return
+		case db.ErrOutOfStock:
+			ctx.IndentedJSON(http.StatusConflict, "Not enough stock for an item in the cart")
+			return
+		case db.ErrCartLimit:
+			ctx.IndentedJSON(http.StatusBadRequest, "Quantity over the per order limit")
+			return
+		default:
 			ctx.IndentedJSON(http.StatusInternalServerError, err)
+			return
+		}
+		placed(c, ctx, order)
+	}
+}
+
+// payCash is the payment query value of an order paid in cash on delivery.
+const payCash = "cash"
+
+// placed answers an order placement, first paying for the order when the
+// payment query parameter names an online method. Without one the order is
+// placed awaiting payment, and so it stays when the payment fails.
+func placed(c context.Context, ctx *gin.Context, order models.Order) {
+	out := gin.H{"message": "Order placed successfully"}
+	if method := ctx.Query("payment"); method != "" && method != payCash {
+		intent, err := db.PayOrder(c, order, method)
+		if err != nil && err != db.ErrPaymentDeclined {
+			log.Println(err)
+			out["paymentError"] = "payment failed, pay again from the order"
+		}
+		if !intent.ID.IsZero() {
+			order.Payment = models.Payment{Online: true, Provider: intent.Provider, IntentID: &intent.ID}
+			out["payment"] = intent
 		}
-		ctx.IndentedJSON(200, "Order placed successfully")
 	}
+	out["order"] = order
+	ctx.IndentedJSON(http.StatusOK, out)
 }
 
 func (app *App) Buy() gin.HandlerFunc {
@@ -182,13 +361,14 @@ func (app *App) Buy() gin.HandlerFunc {
 			ctx.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
-		c, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+		c, cancel := context.WithTimeout(context.Background(), 8*time.Second)
 		defer cancel()
 
-		err = db.Buy(c, app.products, app.users, pHex, uid)
+		order, err := db.Buy(c, app.products, app.users, pHex, uid, db.Checkout{Address: ctx.Query("address"), Shipping: ctx.Query("shipping"), Cash: ctx.Query("payment") == payCash})
 		if err != nil {
-			ctx.IndentedJSON(http.StatusInternalServerError, err)
+			cartError(ctx, err)
+			return
 		}
-		ctx.IndentedJSON(200, "Order placed successfully")
+		placed(c, ctx, order)
 	}
 }
@@ -9,7 +9,9 @@ import (
 	"time"
 
 	gen "github.com/cyzhang39/go_market/auth"
+	"github.com/cyzhang39/go_market/currency"
 	"github.com/cyzhang39/go_market/db"
+	"github.com/cyzhang39/go_market/middleware"
 	"github.com/cyzhang39/go_market/models"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -70,6 +72,10 @@ func View() gin.HandlerFunc {
 		}
 
 		defer cancel()
+		display := currency.Display(ctx)
+		for i := range lst {
+			lst[i].DisplayPrice = currency.ConvertPtr(lst[i].Price, display)
+		}
 		ctx.IndentedJSON(200, lst)
 	}
 }
@@ -89,11 +95,51 @@ func ListItem() gin.HandlerFunc {
 		prods.RatingCnt = 0
 		prods.RatingSum = 0
 
+		// a signed in lister sells the product, otherwise the marketplace does
+		prods.Seller = nil
+		if tok := ctx.GetHeader("token"); tok != "" {
+			claim, msg := gen.ValidateTok(tok)
+			if msg != "" {
+				ctx.JSON(http.StatusUnauthorized, gin.H{"error": msg})
+				return
+			}
+			seller, err := primitive.ObjectIDFromHex(claim.UID)
+			if err != nil {
+				ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
+				return
+			}
+			prods.Seller = &seller
+		}
+
 		err = validate.Struct(prods)
 		if err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if prods.Category != nil {
+			cat, err := db.GetCategory(c, *prods.Category)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category"})
+				return
+			}
+			prods.Attributes, err = cat.Validate(prods.Attributes)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		} else if len(prods.Attributes) > 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Attributes need a category"})
+			return
+		}
+
+		if currency.Supported(prods.Price.Currency) == "" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "unsupported currency"})
+			return
+		}
+
+		if prods.TaxClass == "" {
+			prods.TaxClass = models.TaxStandard
+		}
 
 		prods.ID = primitive.NewObjectID()
 		_, err = products.InsertOne(c, prods)
@@ -101,6 +147,12 @@ func ListItem() gin.HandlerFunc {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Could not add item"})
 			return
 		}
+		if prods.Price != nil {
+			err = db.RecordPrice(c, prods.ID, models.Money{Currency: prods.Price.Currency}, *prods.Price, db.PriceListed, nil)
+			if err != nil {
+				log.Println(err)
+			}
+		}
 		defer cancel()
 		ctx.JSON(http.StatusOK, "Item added successfully.")
 	}
@@ -110,7 +162,8 @@ func Search() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		var prod []models.Product
 		query := ctx.Query("name")
-		if query == "" {
+		cid := ctx.Query("category")
+		if query == "" && cid == "" {
 			log.Println("Empty query")
 			ctx.Header("Content-Type", "application/json")
 			ctx.JSON(http.StatusNotFound, gin.H{"error": "Invalid empty query"})
@@ -121,7 +174,36 @@ func Search() gin.HandlerFunc {
 		c, cancel := context.WithTimeout(context.Background(), 100*time.Second)
 		defer cancel()
 
-		result, err := products.Find(c, bson.M{"name": bson.M{"$regex": query}})
+		filter := bson.M{}
+		if query != "" {
+			filter["name"] = bson.M{"$regex": query}
+		}
+		if cid != "" {
+			cHex, err := primitive.ObjectIDFromHex(cid)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category"})
+				return
+			}
+			cat, err := db.GetCategory(c, cHex)
+			if err != nil {
+				ctx.JSON(http.StatusNotFound, gin.H{"error": "Invalid category"})
+				return
+			}
+			attrs, err := db.AttributeFilter(cat, ctx.Request.URL.Query())
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			for field, cond := range attrs {
+				filter[field] = cond
+			}
+			filter["category"] = cHex
+		} else if db.HasAttributeFilter(ctx.Request.URL.Query()) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Attribute filters need a category"})
+			return
+		}
+
+		result, err := products.Find(c, filter)
 		if err != nil {
 			ctx.IndentedJSON(http.StatusInternalServerError, "Failed to index with given query")
 			return
@@ -142,6 +224,10 @@ func Search() gin.HandlerFunc {
 		}
 
 		defer cancel()
+		display := currency.Display(ctx)
+		for i := range prod {
+			prod[i].DisplayPrice = currency.ConvertPtr(prod[i].Price, display)
+		}
 		ctx.IndentedJSON(200, prod)
 	}
 }
@@ -213,9 +299,7 @@ func Signup() gin.HandlerFunc {
 		user.Token = nil
 		user.Refresh = nil
 
-		user.Cart = make([]models.UserProd, 0)
 		user.AddressInfo = make([]models.Address, 0)
-		user.Status = make([]models.Order, 0)
 
 		_, err = users.InsertOne(ctx, user)
 		if err != nil {
@@ -309,6 +393,12 @@ func Login() gin.HandlerFunc {
 		defer cancel()
 
 		gen.UpdateTok(tok, rf, found.UID)
+		if cartToken := c.GetHeader(middleware.CartTokenHeader); cartToken != "" {
+			err = db.MergeGuestCart(ctx, products, cartToken, found.ID)
+			if err != nil {
+				log.Println("guest cart not merged:", err)
+			}
+		}
 		// fmt.Println("DONE")
 		c.JSON(http.StatusFound, found)
 
@@ -0,0 +1,138 @@
+package tax
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/cyzhang39/go_market/currency"
+	"github.com/cyzhang39/go_market/models"
+)
+
+// Destination is where an order ships to, as far as tax is concerned.
+type Destination struct {
+	Region string
+	Postal string
+}
+
+func To(addr models.Address) Destination {
+	var d Destination
+	if addr.Region != nil {
+		d.Region = *addr.Region
+	}
+	if addr.Postal != nil {
+		d.Postal = *addr.Postal
+	}
+	return d
+}
+
+// Item is a line to be taxed on its Taxable amount, which is the line total
+// after discounts.
+type Item struct {
+	Line    models.UserProd
+	Taxable models.Money
+}
+
+// Calculator works out the tax on items shipped to dest, with the summary
+// totals in to.
+type Calculator interface {
+	Calculate(items []Item, dest Destination, to string) (models.TaxSummary, error)
+}
+
+// Rules is a Calculator over a table of rates. Each line pays the single
+// most specific rate matching it: the longest postal prefix first, then a
+// region, then a tax class over rules for any class.
+type Rules []models.TaxRate
+
+func (r Rules) Match(class string, dest Destination) (models.TaxRate, bool) {
+	var best models.TaxRate
+	score := -1
+	for _, rate := range r {
+		if rate.Region != "" && !strings.EqualFold(rate.Region, dest.Region) {
+			continue
+		}
+		if rate.PostalPrefix != "" && !strings.HasPrefix(normalize(dest.Postal), normalize(rate.PostalPrefix)) {
+			continue
+		}
+		if rate.TaxClass != "" && rate.TaxClass != class {
+			continue
+		}
+		s := len(normalize(rate.PostalPrefix)) * 4
+		if rate.Region != "" {
+			s += 2
+		}
+		if rate.TaxClass != "" {
+			s++
+		}
+		if s > score {
+			best, score = rate, s
+		}
+	}
+	return best, score >= 0
+}
+
+func normalize(postal string) string {
+	return strings.ToUpper(strings.ReplaceAll(postal, " ", ""))
+}
+
+func (r Rules) Calculate(items []Item, dest Destination, to string) (models.TaxSummary, error) {
+	if to == "" {
+		lines := make([]models.UserProd, 0, len(items))
+		for _, item := range items {
+			lines = append(lines, item.Line)
+		}
+		total, err := currency.Total(lines, "")
+		if err != nil {
+			return models.TaxSummary{}, err
+		}
+		to = total.Currency
+	}
+	out := models.TaxSummary{
+		Lines: make([]models.TaxLine, 0, len(items)),
+		Total: models.Money{Currency: to},
+		Added: models.Money{Currency: to},
+	}
+
+	for _, item := range items {
+		class := item.Line.TaxClass
+		if class == "" {
+			class = models.TaxStandard
+		}
+		rate, ok := r.Match(class, dest)
+		if !ok {
+			continue
+		}
+		pct, err := rate.Percent()
+		if err != nil {
+			return out, err
+		}
+
+		// exclusive: taxable * pct / 100
+		// inclusive: taxable - taxable / (1 + pct / 100)
+		v := new(big.Rat).SetInt64(item.Taxable.Amount)
+		share := new(big.Rat).Quo(pct, big.NewRat(100, 1))
+		if rate.Inclusive {
+			share.Quo(share, new(big.Rat).Add(big.NewRat(1, 1), share))
+		}
+		amount := models.Money{Amount: currency.Round(v.Mul(v, share), currency.Rule{Mode: currency.HalfUp}), Currency: item.Taxable.Currency}
+
+		out.Lines = append(out.Lines, models.TaxLine{
+			ID:        item.Line.ID,
+			Variant:   item.Line.Variant,
+			TaxClass:  class,
+			Name:      rate.Name,
+			Rate:      rate.Rate,
+			Inclusive: rate.Inclusive,
+			Taxable:   item.Taxable,
+			Tax:       amount,
+		})
+		conv, err := currency.Convert(amount, to)
+		if err != nil {
+			return out, err
+		}
+		out.Total.Amount += conv.Amount
+		if !rate.Inclusive {
+			out.Added.Amount += conv.Amount
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,95 @@
+package tax
+
+import (
+	"testing"
+
+	"github.com/cyzhang39/go_market/models"
+)
+
+var rules = Rules{
+	{Name: "federal", Rate: "5"},
+	{Name: "ontario", Region: "ON", Rate: "13"},
+	{Name: "ontario books", Region: "ON", TaxClass: "books", Rate: "5"},
+	{Name: "toronto", PostalPrefix: "M5V", Rate: "15"},
+	{Name: "food", TaxClass: "food", Rate: "0"},
+	{Name: "vat", Region: "DE", Rate: "19", Inclusive: true},
+}
+
+func TestRulesMatch(t *testing.T) {
+	tests := []struct {
+		class string
+		dest  Destination
+		want  string
+	}{
+		{models.TaxStandard, Destination{}, "federal"},
+		{models.TaxStandard, Destination{Region: "on"}, "ontario"},
+		{"books", Destination{Region: "ON"}, "ontario books"},
+		{"books", Destination{Region: "QC"}, "federal"},
+		{models.TaxStandard, Destination{Region: "ON", Postal: "m5v 2t6"}, "toronto"},
+		{"books", Destination{Region: "ON", Postal: "M5V2T6"}, "toronto"},
+		{"food", Destination{Region: "QC"}, "food"},
+		{"food", Destination{Region: "ON"}, "ontario"},
+		{models.TaxStandard, Destination{Region: "DE"}, "vat"},
+	}
+	for _, tt := range tests {
+		got, ok := rules.Match(tt.class, tt.dest)
+		if !ok || got.Name != tt.want {
+			t.Errorf("Match(%s, %+v) = %s, %v, want %s", tt.class, tt.dest, got.Name, ok, tt.want)
+		}
+	}
+	if _, ok := (Rules{{Name: "ontario", Region: "ON", Rate: "13"}}).Match(models.TaxStandard, Destination{Region: "QC"}); ok {
+		t.Error("Match found a rate for a region without one")
+	}
+}
+
+func TestRulesCalculate(t *testing.T) {
+	line := func(class string, amount int64) Item {
+		m := models.Money{Amount: amount, Currency: "USD"}
+		return Item{Line: models.UserProd{TaxClass: class, Price: m, Quantity: 1}, Taxable: m}
+	}
+	regional := Rules{{Name: "ontario", Region: "ON", Rate: "13"}}
+	tests := []struct {
+		name  string
+		rules Rules
+		items []Item
+		dest  Destination
+		tax   []int64
+		total int64
+		added int64
+	}{
+		{"exclusive", rules, []Item{line("", 1000)}, Destination{Region: "ON"}, []int64{130}, 130, 130},
+		{"rounds half up", rules, []Item{line("", 1050)}, Destination{}, []int64{53}, 53, 53},
+		{"per class", rules, []Item{line("", 1000), line("books", 2000)}, Destination{Region: "ON"}, []int64{130, 100}, 230, 230},
+		{"zero rate", rules, []Item{line("food", 1000)}, Destination{}, []int64{0}, 0, 0},
+		// 11.90 with 19% included holds 1.90 of tax
+		{"inclusive", rules, []Item{line("", 1190)}, Destination{Region: "DE"}, []int64{190}, 190, 0},
+		{"no rate", regional, []Item{line("", 1000)}, Destination{Region: "QC"}, nil, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rules.Calculate(tt.items, tt.dest, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Lines) != len(tt.tax) {
+				t.Fatalf("got %d tax lines, want %d", len(got.Lines), len(tt.tax))
+			}
+			for i, want := range tt.tax {
+				if got.Lines[i].Tax.Amount != want {
+					t.Errorf("line %d tax = %d, want %d", i, got.Lines[i].Tax.Amount, want)
+				}
+			}
+			if got.Total.Amount != tt.total || got.Added.Amount != tt.added || got.Total.Currency != "USD" {
+				t.Errorf("total, added = %v, %v, want %d, %d USD", got.Total, got.Added, tt.total, tt.added)
+			}
+		})
+	}
+}
+
+func TestRulesCalculateInvalidRate(t *testing.T) {
+	r := Rules{{Name: "broken", Rate: "120"}}
+	m := models.Money{Amount: 1000, Currency: "USD"}
+	if _, err := r.Calculate([]Item{{Line: models.UserProd{Price: m}, Taxable: m}}, Destination{}, ""); err == nil {
+		t.Error("Calculate accepted a rate over 100%")
+	}
+}